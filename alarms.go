@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceAlarm is an alarm currently raised by a DC908.
+type deviceAlarm struct {
+	ID          string      `json:"id"`
+	Resource    string      `json:"resource"`
+	Text        string      `json:"text"`
+	Severity    string      `json:"severity"`
+	TypeID      string      `json:"type-id"`
+	TimeCreated json.Number `json:"time-created"`
+}
+
+func (a deviceAlarm) labels() prometheus.Labels {
+	return prometheus.Labels{
+		"id":       a.ID,
+		"resource": a.Resource,
+		"severity": stripModule(a.Severity),
+		"type":     stripModule(a.TypeID),
+	}
+}
+
+func handleAlarm(m *metricRegistry, j string, groups []string) error {
+	id := groups[0]
+	m.lock.Lock()
+	old, known := m.alarms[id]
+	m.lock.Unlock()
+
+	// Updates may only carry some of the leaves, so they are merged into
+	// what is already known.
+	val := old
+	if err := json.Unmarshal([]byte(j), &val); err != nil {
+		return fmt.Errorf("failed to parse alarm: %v", err)
+	}
+	val.ID = id
+	if known && val == old {
+		return nil
+	}
+	log.V(2).Infof("New alarm %q: %+v", id, val)
+	m.lock.Lock()
+	m.alarms[id] = val
+	m.lock.Unlock()
+	m.alarmActive.DeletePartialMatch(prometheus.Labels{"id": id})
+	m.alarmActive.With(val.labels()).Set(1)
+	return nil
+}
+
+// clearAlarm drops the alarm with the given id, or all alarms if id is empty.
+func clearAlarm(m *metricRegistry, groups []string) {
+	id := groups[0]
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if id == "" {
+		log.V(2).Infof("All alarms cleared")
+		m.alarms = make(map[string]deviceAlarm)
+		m.alarmActive.Reset()
+		return
+	}
+	if _, ok := m.alarms[id]; !ok {
+		return
+	}
+	log.V(2).Infof("Alarm %q cleared", id)
+	delete(m.alarms, id)
+	m.alarmActive.DeletePartialMatch(prometheus.Labels{"id": id})
+}
+
+type apiAlarm struct {
+	Target      string    `json:"target"`
+	ID          string    `json:"id"`
+	Resource    string    `json:"resource"`
+	Text        string    `json:"text"`
+	Severity    string    `json:"severity"`
+	Type        string    `json:"type"`
+	TimeCreated time.Time `json:"time_created"`
+}
+
+// activeAlarms returns the alarms currently raised by the device, oldest
+// first.
+func (m *metricRegistry) activeAlarms() []deviceAlarm {
+	m.lock.Lock()
+	res := make([]deviceAlarm, 0, len(m.alarms))
+	for _, a := range m.alarms {
+		res = append(res, a)
+	}
+	m.lock.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		ti, _ := res[i].TimeCreated.Int64()
+		tj, _ := res[j].TimeCreated.Int64()
+		if ti != tj {
+			return ti < tj
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// Alarms returns the alarms currently raised by all connected devices,
+// optionally limited to one target and to the given severities.
+func (srv *Server) Alarms(target string, severities []string) []apiAlarm {
+	regs := srv.registries()
+	target = normalizeTarget(target)
+	targets := make([]string, 0, len(regs))
+	for t := range regs {
+		if target == "" || t == target {
+			targets = append(targets, t)
+		}
+	}
+	sort.Strings(targets)
+
+	res := []apiAlarm{}
+	for _, t := range targets {
+		for _, a := range regs[t].activeAlarms() {
+			severity := stripModule(a.Severity)
+			if len(severities) > 0 && !containsFold(severities, severity) {
+				continue
+			}
+			aa := apiAlarm{
+				Target:   t,
+				ID:       a.ID,
+				Resource: a.Resource,
+				Text:     a.Text,
+				Severity: severity,
+				Type:     stripModule(a.TypeID),
+			}
+			// time-created is in nanoseconds since the epoch.
+			if ns, err := a.TimeCreated.Int64(); err == nil {
+				aa.TimeCreated = time.Unix(0, ns).UTC()
+			}
+			res = append(res, aa)
+		}
+	}
+	return res
+}
+
+func (srv *Server) serveAPIAlarms(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, srv.Alarms(r.URL.Query().Get("target"), queryList(r, "severity")))
+}
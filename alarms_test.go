@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/stretchr/testify/assert"
+)
+
+func getAlarms(t *testing.T, srv *Server, query string) []apiAlarm {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.serveAPIAlarms(rec, httptest.NewRequest(http.MethodGet, "/api/alarms"+query, nil))
+	var res []apiAlarm
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", rec.Body.String(), err)
+	}
+	return res
+}
+
+func TestAlarms(t *testing.T) {
+	assert := assert.New(t)
+	srv := startServer(t)
+
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/alarms.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(func() bool { return len(getAlarms(t, srv, "")) == 2 }, waitFor, tick)
+
+	assert.Equal([]apiAlarm{{
+		Target:      "127.0.0.1",
+		ID:          "1720382300-3",
+		Resource:    "FAN-1-33",
+		Text:        "Fan speed abnormal",
+		Severity:    "MINOR",
+		Type:        "FAN_ABNORMAL",
+		TimeCreated: time.Date(2024, 7, 7, 19, 58, 20, 0, time.UTC),
+	}, {
+		Target:      "127.0.0.1",
+		ID:          "1720382355-17",
+		Resource:    "TRANSCEIVER-1-1-C1",
+		Text:        "Input optical power too low",
+		Severity:    "MAJOR",
+		Type:        "IN_PWR_LOW",
+		TimeCreated: time.Date(2024, 7, 7, 19, 59, 15, 0, time.UTC),
+	}}, getAlarms(t, srv, ""))
+	assert.Len(getAlarms(t, srv, "?severity=major,critical"), 1)
+	assert.Empty(getAlarms(t, srv, "?target=10.0.0.1"))
+
+	body := probe(srv, "127.0.0.1")
+	assert.Contains(body, `dc908_alarm_active{id="1720382355-17",resource="TRANSCEIVER-1-1-C1",severity="MAJOR",type="IN_PWR_LOW"} 1`)
+
+	// The device clears an alarm by deleting it.
+	if err := stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: &gnmi.Notification{
+		Timestamp: 1720382370000000000,
+		Delete: []*gnmi.Path{{Elem: []*gnmi.PathElem{
+			{Name: "openconfig-system:system"},
+			{Name: "alarms"},
+			{Name: "alarm", Key: map[string]string{"id": "1720382355-17"}},
+		}}},
+	}}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(func() bool { return len(getAlarms(t, srv, "")) == 1 }, waitFor, tick)
+	assert.False(strings.Contains(probe(srv, "127.0.0.1"), `id="1720382355-17"`))
+}
+
+func TestClearAlarm(t *testing.T) {
+	var tests = []struct {
+		path string
+		want int
+	}{
+		{"/openconfig-system:system/alarms/alarm[id=1]", 1},
+		{"/openconfig-system:system/alarms/alarm[id=1]/state", 1},
+		{"/openconfig-system:system/alarms/alarm[id=3]", 2},
+		{"/openconfig-system:system/alarms", 0},
+		{"/openconfig-platform:components/component[name=FAN-1-33]", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			mr := NewMetricRegistry()
+			for _, id := range []string{"1", "2"} {
+				if err := mr.Update("/openconfig-system:system/alarms/alarm[id="+id+"]/state", `{"resource":"FAN-1-33","severity":"openconfig-alarm-types:MINOR"}`); err != nil {
+					t.Fatalf("Update: %v", err)
+				}
+			}
+			mr.Delete(tt.path)
+			assert.Len(t, mr.activeAlarms(), tt.want)
+		})
+	}
+}
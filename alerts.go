@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/golang/glog"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	alertRules          = flag.String("alert-rules", "", "path to a YAML file with alert rules and webhooks to notify")
+	alertResendInterval = flag.Duration("alert-resend-interval", time.Minute, "how often to re-send firing alerts to webhooks")
+	alertSessionGrace   = flag.Duration("alert-session-grace", 5*time.Minute, "how long the alerts of a device whose session ended keep firing before they are resolved, unless it reconnects")
+)
+
+type AlertConfig struct {
+	Webhooks []AlertWebhook `yaml:"webhooks"`
+	Rules    []AlertRule    `yaml:"rules"`
+}
+
+type AlertWebhook struct {
+	URL string `yaml:"url"`
+	// Format is either "alertmanager" to post alerts to the Alertmanager v2
+	// API, or "webhook" to post the payload Alertmanager sends to webhook
+	// receivers.
+	Format      string            `yaml:"format"`
+	Headers     map[string]string `yaml:"headers"`
+	BearerToken string            `yaml:"bearer_token"`
+	BasicAuth   *BasicAuth        `yaml:"basic_auth"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	MaxRetries  int               `yaml:"max_retries"`
+}
+
+type AlertRule struct {
+	Name   string `yaml:"name"`
+	Metric string `yaml:"metric"`
+	// Device and Component are globs matched against the device IP and
+	// component name, empty matches everything.
+	Device    string  `yaml:"device"`
+	Component string  `yaml:"component"`
+	Op        string  `yaml:"op"`
+	Threshold float64 `yaml:"threshold"`
+	// Clear is the threshold the value has to cross back over for a firing
+	// alert to resolve, defaulting to Threshold.
+	Clear *float64 `yaml:"clear"`
+	// For is how long the condition has to hold before the alert fires,
+	// ClearFor how long it has to be cleared before the alert resolves.
+	For         time.Duration     `yaml:"for"`
+	ClearFor    time.Duration     `yaml:"clear_for"`
+	Severity    string            `yaml:"severity"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+
+	annotations map[string]*template.Template
+}
+
+var alertOps = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// LoadAlertConfig reads an alert configuration file and validates its rules.
+func LoadAlertConfig(fn string) (*AlertConfig, error) {
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &AlertConfig{}
+	if err := yaml.Unmarshal(d, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", fn, err)
+	}
+	for i := range cfg.Webhooks {
+		wh := &cfg.Webhooks[i]
+		if wh.URL == "" {
+			return nil, fmt.Errorf("webhook %d has no url", i)
+		}
+		switch wh.Format {
+		case "":
+			wh.Format = "alertmanager"
+		case "alertmanager", "webhook":
+		default:
+			return nil, fmt.Errorf("webhook %s has unsupported format %q", wh.URL, wh.Format)
+		}
+		if wh.Timeout == 0 {
+			wh.Timeout = 10 * time.Second
+		}
+		if wh.MaxRetries == 0 {
+			wh.MaxRetries = 3
+		}
+	}
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (r *AlertRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("%s: missing metric", r.Name)
+	}
+	if _, ok := alertOps[r.Op]; !ok {
+		return fmt.Errorf("%s: unsupported op %q", r.Name, r.Op)
+	}
+	for _, g := range []string{r.Device, r.Component} {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("%s: invalid glob %q: %v", r.Name, g, err)
+		}
+	}
+	r.annotations = make(map[string]*template.Template)
+	for k, v := range r.Annotations {
+		t, err := template.New(k).Option("missingkey=zero").Parse(v)
+		if err != nil {
+			return fmt.Errorf("%s: annotation %s: %v", r.Name, k, err)
+		}
+		r.annotations[k] = t
+	}
+	return nil
+}
+
+func (r *AlertRule) matches(target string, u decodedUpdate) bool {
+	if u.Metric != r.Metric {
+		return false
+	}
+	if r.Device != "" {
+		if ok, _ := path.Match(r.Device, target); !ok {
+			return false
+		}
+	}
+	if r.Component != "" {
+		if ok, _ := path.Match(r.Component, u.Labels["device"]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// alertLabels returns the labels identifying an alert of r raised by u,
+// using the same labels as the exported metric plus the device IP as target.
+func (r *AlertRule) alertLabels(target string, u decodedUpdate) map[string]string {
+	labels := map[string]string{"alertname": r.Name, "target": target}
+	for k, v := range u.Labels {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	if r.Severity != "" {
+		labels["severity"] = r.Severity
+	}
+	for k, v := range r.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+func (r *AlertRule) alertAnnotations(labels map[string]string, value float64) map[string]string {
+	data := struct {
+		Labels    map[string]string
+		Value     float64
+		Threshold float64
+	}{labels, value, r.Threshold}
+	res := make(map[string]string)
+	for k, t := range r.annotations {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			log.Warningf("Failed to expand annotation %s of alert %s: %v", k, r.Name, err)
+			continue
+		}
+		res[k] = b.String()
+	}
+	return res
+}
+
+// amAlert is an alert as understood by Alertmanager.
+type amAlert struct {
+	Status       string            `json:"status,omitempty"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+	Fingerprint  string            `json:"fingerprint,omitempty"`
+}
+
+type alertState struct {
+	rule   *AlertRule
+	target string
+	// pendingSince is when the condition was first met, clearSince when a
+	// firing alert first stopped meeting its clear condition.
+	pendingSince time.Time
+	clearSince   time.Time
+	firing       bool
+	alert        amAlert
+}
+
+// AlertEngine evaluates alert rules on every decoded update and notifies
+// webhooks when alerts fire or resolve.
+type AlertEngine struct {
+	cfg    *AlertConfig
+	resend time.Duration
+	grace  time.Duration
+	client *http.Client
+
+	lock   sync.Mutex
+	states map[string]*alertState
+	// ended holds the timers resolving the alerts of devices whose session
+	// ended, until they send updates again.
+	ended map[string]*time.Timer
+
+	queue chan []amAlert
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewAlertEngine returns an engine evaluating the rules in cfg. Firing alerts
+// are sent again every resend, and resolved grace after the session of their
+// device ended unless it reconnects.
+func NewAlertEngine(cfg *AlertConfig, resend time.Duration, grace time.Duration) *AlertEngine {
+	ae := &AlertEngine{
+		cfg:    cfg,
+		resend: resend,
+		grace:  grace,
+		client: &http.Client{},
+		states: make(map[string]*alertState),
+		ended:  make(map[string]*time.Timer),
+		queue:  make(chan []amAlert, 1000),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go ae.run()
+	return ae
+}
+
+func alertKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// Observe evaluates all rules matching u.
+func (ae *AlertEngine) Observe(target string, u decodedUpdate) {
+	var events []amAlert
+	ae.lock.Lock()
+	// The device is back, so its alerts are kept.
+	if t, ok := ae.ended[target]; ok {
+		t.Stop()
+		delete(ae.ended, target)
+	}
+	for i := range ae.cfg.Rules {
+		r := &ae.cfg.Rules[i]
+		if !r.matches(target, u) {
+			continue
+		}
+		labels := r.alertLabels(target, u)
+		if ev, ok := ae.evaluate(r, target, alertKey(labels), labels, u); ok {
+			events = append(events, ev)
+		}
+	}
+	ae.lock.Unlock()
+	if len(events) > 0 {
+		ae.enqueue(events)
+	}
+}
+
+// evaluate updates the state of the alert identified by key and returns the
+// alert to notify about if it fired or resolved.
+func (ae *AlertEngine) evaluate(r *AlertRule, target, key string, labels map[string]string, u decodedUpdate) (amAlert, bool) {
+	op := alertOps[r.Op]
+	v, ts := u.Reading.Instant, u.Timestamp
+	st := ae.states[key]
+	if st == nil || !st.firing {
+		if !op(v, r.Threshold) {
+			delete(ae.states, key)
+			return amAlert{}, false
+		}
+		if st == nil {
+			st = &alertState{rule: r, target: target, pendingSince: ts}
+			ae.states[key] = st
+		}
+		if ts.Sub(st.pendingSince) < r.For {
+			return amAlert{}, false
+		}
+		st.firing = true
+		st.alert = amAlert{
+			Status:      "firing",
+			Labels:      labels,
+			Annotations: r.alertAnnotations(labels, v),
+			StartsAt:    ts,
+			Fingerprint: fingerprint(key),
+		}
+		log.Infof("Alert %s firing for %v", r.Name, labels)
+		return st.alert, true
+	}
+
+	clearAt := r.Threshold
+	if r.Clear != nil {
+		clearAt = *r.Clear
+	}
+	if op(v, clearAt) {
+		st.clearSince = time.Time{}
+		return amAlert{}, false
+	}
+	if st.clearSince.IsZero() {
+		st.clearSince = ts
+	}
+	if ts.Sub(st.clearSince) < r.ClearFor {
+		return amAlert{}, false
+	}
+	delete(ae.states, key)
+	res := st.alert
+	res.Status = "resolved"
+	res.EndsAt = ts
+	log.Infof("Alert %s resolved for %v", r.Name, labels)
+	return res, true
+}
+
+// SessionEnded resolves the alerts of a device whose session ended after the
+// grace period, as no update will ever resolve them. Devices reconnecting
+// within it keep their alerts, so brief reconnects do not resolve and fire
+// them again.
+func (ae *AlertEngine) SessionEnded(target string) {
+	ae.lock.Lock()
+	defer ae.lock.Unlock()
+	if t, ok := ae.ended[target]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(ae.grace, func() { ae.resolveEnded(target, t) })
+	ae.ended[target] = t
+}
+
+// resolveEnded resolves the alerts of target if t is still the timer started
+// when its session ended, i.e. it did not reconnect since.
+func (ae *AlertEngine) resolveEnded(target string, t *time.Timer) {
+	now := time.Now()
+	var events []amAlert
+	ae.lock.Lock()
+	if ae.ended[target] != t {
+		ae.lock.Unlock()
+		return
+	}
+	delete(ae.ended, target)
+	for key, st := range ae.states {
+		if st.target != target {
+			continue
+		}
+		delete(ae.states, key)
+		if !st.firing {
+			continue
+		}
+		res := st.alert
+		res.Status = "resolved"
+		res.EndsAt = now
+		log.Infof("Alert %s resolved for %v, the session ended", st.rule.Name, res.Labels)
+		events = append(events, res)
+	}
+	ae.lock.Unlock()
+	if len(events) > 0 {
+		ae.enqueue(events)
+	}
+}
+
+func fingerprint(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Firing returns all currently firing alerts.
+func (ae *AlertEngine) Firing() []amAlert {
+	ae.lock.Lock()
+	defer ae.lock.Unlock()
+	var res []amAlert
+	for _, st := range ae.states {
+		if st.firing {
+			res = append(res, st.alert)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Fingerprint < res[j].Fingerprint })
+	return res
+}
+
+func (ae *AlertEngine) enqueue(alerts []amAlert) {
+	select {
+	case ae.queue <- alerts:
+	default:
+		log.Warningf("Alert notification queue is full, dropping %d alerts", len(alerts))
+	}
+}
+
+func (ae *AlertEngine) run() {
+	defer close(ae.done)
+	t := time.NewTicker(ae.resend)
+	defer t.Stop()
+	for {
+		select {
+		case alerts := <-ae.queue:
+			ae.notify(alerts)
+		case <-t.C:
+			// Alertmanager resolves alerts it has not heard about for a
+			// while, so firing alerts are sent again periodically.
+			if alerts := ae.Firing(); len(alerts) > 0 {
+				ae.notify(alerts)
+			}
+		case <-ae.stop:
+			for {
+				select {
+				case alerts := <-ae.queue:
+					ae.notify(alerts)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (ae *AlertEngine) notify(alerts []amAlert) {
+	for i := range ae.cfg.Webhooks {
+		wh := &ae.cfg.Webhooks[i]
+		body, err := webhookPayload(wh.Format, alerts)
+		if err != nil {
+			log.Errorf("Failed to encode alerts for %s: %v", wh.URL, err)
+			continue
+		}
+		backoff := 100 * time.Millisecond
+		for attempt := 0; ; attempt++ {
+			retry, err := ae.post(wh, body)
+			if err == nil {
+				log.V(2).Infof("Sent %d alerts to %s", len(alerts), wh.URL)
+				break
+			}
+			if !retry || attempt >= wh.MaxRetries {
+				log.Errorf("Failed to send %d alerts to %s: %v", len(alerts), wh.URL, err)
+				break
+			}
+			log.Warningf("Failed to send alerts to %s, retrying in %s: %v", wh.URL, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// webhookPayload encodes alerts either for the Alertmanager v2 API or in the
+// format Alertmanager uses to notify webhook receivers.
+func webhookPayload(format string, alerts []amAlert) ([]byte, error) {
+	if format == "alertmanager" {
+		res := make([]amAlert, len(alerts))
+		for i, a := range alerts {
+			a.Status = ""
+			a.Fingerprint = ""
+			res[i] = a
+		}
+		return json.Marshal(res)
+	}
+	status := "resolved"
+	for _, a := range alerts {
+		if a.Status == "firing" {
+			status = "firing"
+		}
+	}
+	return json.Marshal(struct {
+		Version           string            `json:"version"`
+		Status            string            `json:"status"`
+		Receiver          string            `json:"receiver"`
+		GroupKey          string            `json:"groupKey"`
+		GroupLabels       map[string]string `json:"groupLabels"`
+		CommonLabels      map[string]string `json:"commonLabels"`
+		CommonAnnotations map[string]string `json:"commonAnnotations"`
+		ExternalURL       string            `json:"externalURL"`
+		Alerts            []amAlert         `json:"alerts"`
+	}{
+		Version:           "4",
+		Status:            status,
+		Receiver:          "dc908_exporter",
+		GroupKey:          "{}:{}",
+		GroupLabels:       map[string]string{},
+		CommonLabels:      commonLabels(alerts, func(a amAlert) map[string]string { return a.Labels }),
+		CommonAnnotations: commonLabels(alerts, func(a amAlert) map[string]string { return a.Annotations }),
+		Alerts:            alerts,
+	})
+}
+
+// commonLabels returns the label pairs shared by all alerts.
+func commonLabels(alerts []amAlert, get func(amAlert) map[string]string) map[string]string {
+	res := make(map[string]string)
+	if len(alerts) == 0 {
+		return res
+	}
+	for k, v := range get(alerts[0]) {
+		res[k] = v
+	}
+	for _, a := range alerts[1:] {
+		l := get(a)
+		for k, v := range res {
+			if l[k] != v {
+				delete(res, k)
+			}
+		}
+	}
+	return res
+}
+
+func (ae *AlertEngine) post(wh *AlertWebhook, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wh.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dc908_exporter")
+	if wh.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+wh.BearerToken)
+	}
+	if wh.BasicAuth != nil {
+		req.SetBasicAuth(wh.BasicAuth.Username, wh.BasicAuth.Password)
+	}
+	for k, v := range wh.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := ae.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Close sends all pending notifications, or gives up when ctx expires.
+func (ae *AlertEngine) Close(ctx context.Context) error {
+	ae.lock.Lock()
+	for target, t := range ae.ended {
+		t.Stop()
+		delete(ae.ended, target)
+	}
+	ae.lock.Unlock()
+	close(ae.stop)
+	select {
+	case <-ae.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("alert notification flush: %w", ctx.Err())
+	}
+}
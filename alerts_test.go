@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertEvaluation(t *testing.T) {
+	type step struct {
+		after time.Duration
+		value float64
+		want  string
+	}
+	var tests = []struct {
+		name  string
+		rule  AlertRule
+		steps []step
+	}{
+		{
+			name: "fires and resolves immediately",
+			rule: AlertRule{Op: "<=", Threshold: -60},
+			steps: []step{
+				{0, -10, ""},
+				{time.Second, -60, "firing"},
+				{2 * time.Second, -60, ""},
+				{3 * time.Second, -10, "resolved"},
+				{4 * time.Second, -10, ""},
+			},
+		},
+		{
+			name: "hold-down before firing",
+			rule: AlertRule{Op: ">", Threshold: 70, For: 10 * time.Second},
+			steps: []step{
+				{0, 71, ""},
+				{5 * time.Second, 72, ""},
+				{6 * time.Second, 69, ""},
+				{7 * time.Second, 71, ""},
+				{16 * time.Second, 71, ""},
+				{17 * time.Second, 71, "firing"},
+			},
+		},
+		{
+			name: "hysteresis",
+			rule: AlertRule{Op: "<", Threshold: -20, Clear: fp(-18)},
+			steps: []step{
+				{0, -21, "firing"},
+				{time.Second, -19, ""},
+				{2 * time.Second, -18.5, ""},
+				{3 * time.Second, -18, "resolved"},
+			},
+		},
+		{
+			name: "hold-down before resolving",
+			rule: AlertRule{Op: "==", Threshold: 0, ClearFor: 10 * time.Second},
+			steps: []step{
+				{0, 0, "firing"},
+				{time.Second, 3000, ""},
+				{5 * time.Second, 0, ""},
+				{6 * time.Second, 3000, ""},
+				{15 * time.Second, 3000, ""},
+				{16 * time.Second, 3000, "resolved"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Name = "Test"
+			tt.rule.Metric = "dc908_test"
+			assert.NoError(t, tt.rule.compile())
+			ae := &AlertEngine{cfg: &AlertConfig{Rules: []AlertRule{tt.rule}}, states: make(map[string]*alertState)}
+			labels := map[string]string{"alertname": "Test"}
+			start := time.Unix(1720382350, 0)
+			for i, s := range tt.steps {
+				ev, ok := ae.evaluate(&ae.cfg.Rules[0], "10.0.0.1", alertKey(labels), labels, decodedUpdate{
+					Reading:   reading{Instant: s.value},
+					Timestamp: start.Add(s.after),
+				})
+				got := ""
+				if ok {
+					got = ev.Status
+				}
+				assert.Equal(t, s.want, got, "step %d", i)
+			}
+		})
+	}
+}
+
+func TestAlertRuleMatches(t *testing.T) {
+	r := AlertRule{Metric: "dc908_laser_input_power_dbm", Device: "10.0.0.*", Component: "TRANSCEIVER-1-*"}
+	var tests = []struct {
+		target    string
+		metric    string
+		component string
+		want      bool
+	}{
+		{"10.0.0.1", "dc908_laser_input_power_dbm", "TRANSCEIVER-1-1-C1", true},
+		{"10.0.1.1", "dc908_laser_input_power_dbm", "TRANSCEIVER-1-1-C1", false},
+		{"10.0.0.1", "dc908_laser_output_power_dbm", "TRANSCEIVER-1-1-C1", false},
+		{"10.0.0.1", "dc908_laser_input_power_dbm", "TRANSCEIVER-2-1-C1", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, r.matches(tt.target, decodedUpdate{
+			Metric: tt.metric,
+			Labels: map[string]string{"device": tt.component},
+		}), "%+v", tt)
+	}
+}
+
+// webhookReceiver records the JSON bodies posted to it.
+type webhookReceiver struct {
+	lock   sync.Mutex
+	bodies [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	wr.bodies = append(wr.bodies, b)
+}
+
+func (wr *webhookReceiver) received() [][]byte {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	return append([][]byte{}, wr.bodies...)
+}
+
+func TestAlertWebhooks(t *testing.T) {
+	assert := assert.New(t)
+	am := &webhookReceiver{}
+	amSrv := httptest.NewServer(am)
+	defer amSrv.Close()
+	wh := &webhookReceiver{}
+	whSrv := httptest.NewServer(wh)
+	defer whSrv.Close()
+
+	fn := filepath.Join(t.TempDir(), "alerts.yaml")
+	if err := os.WriteFile(fn, []byte(`
+webhooks:
+  - url: `+amSrv.URL+`
+  - url: `+whSrv.URL+`
+    format: webhook
+rules:
+  - name: LaserLOS
+    metric: dc908_laser_input_power_dbm
+    component: TRANSCEIVER-*
+    op: "<="
+    threshold: -60
+    severity: critical
+    annotations:
+      summary: "Loss of signal on {{ .Labels.device }} ({{ .Value }} dBm)"
+`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg, err := LoadAlertConfig(fn)
+	if err != nil {
+		t.Fatalf("LoadAlertConfig: %v", err)
+	}
+	ae := NewAlertEngine(cfg, time.Hour, time.Hour)
+
+	mr := NewMetricRegistry()
+	mr.OnUpdate(func(u decodedUpdate) { ae.Observe("10.0.0.1", u) })
+	ts := time.Date(2024, 7, 7, 19, 59, 10, 0, time.UTC)
+	update := func(ts time.Time, power string) {
+		t.Helper()
+		if err := mr.UpdateAt("/openconfig-platform:components/component[name=TRANSCEIVER-1-1-C1]/openconfig-platform-transceiver:transceiver/state", ts,
+			`{"input-power":{"instant":`+power+`}}`); err != nil {
+			t.Fatalf("UpdateAt: %v", err)
+		}
+	}
+	update(ts, "-60")
+	assert.Eventually(func() bool { return len(am.received()) == 1 && len(wh.received()) == 1 }, waitFor, tick)
+	assert.Len(ae.Firing(), 1)
+
+	var alerts []map[string]any
+	assert.NoError(json.Unmarshal(am.received()[0], &alerts))
+	if assert.Len(alerts, 1) {
+		assert.Equal(map[string]any{
+			"alertname": "LaserLOS",
+			"device":    "TRANSCEIVER-1-1-C1",
+			"severity":  "critical",
+			"target":    "10.0.0.1",
+		}, alerts[0]["labels"])
+		assert.Equal(map[string]any{"summary": "Loss of signal on TRANSCEIVER-1-1-C1 (-60 dBm)"}, alerts[0]["annotations"])
+		assert.Equal("2024-07-07T19:59:10Z", alerts[0]["startsAt"])
+		assert.NotContains(alerts[0], "status")
+	}
+
+	var msg struct {
+		Version      string
+		Status       string
+		CommonLabels map[string]string
+		Alerts       []amAlert
+	}
+	assert.NoError(json.Unmarshal(wh.received()[0], &msg))
+	assert.Equal("4", msg.Version)
+	assert.Equal("firing", msg.Status)
+	assert.Equal("LaserLOS", msg.CommonLabels["alertname"])
+
+	update(ts.Add(time.Minute), "-3.5")
+	assert.Eventually(func() bool { return len(am.received()) == 2 && len(wh.received()) == 2 }, waitFor, tick)
+	assert.Empty(ae.Firing())
+	assert.NoError(json.Unmarshal(am.received()[1], &alerts))
+	if assert.Len(alerts, 1) {
+		assert.Equal("2024-07-07T20:00:10Z", alerts[0]["endsAt"])
+	}
+	assert.NoError(json.Unmarshal(wh.received()[1], &msg))
+	assert.Equal("resolved", msg.Status)
+
+	assert.NoError(ae.Close(context.Background()))
+}
+
+func TestAlertResend(t *testing.T) {
+	am := &webhookReceiver{}
+	amSrv := httptest.NewServer(am)
+	defer amSrv.Close()
+
+	r := AlertRule{Name: "FanStopped", Metric: "dc908_fan_rpm", Op: "==", Threshold: 0}
+	assert.NoError(t, r.compile())
+	ae := NewAlertEngine(&AlertConfig{
+		Webhooks: []AlertWebhook{{URL: amSrv.URL, Format: "alertmanager", Timeout: time.Second}},
+		Rules:    []AlertRule{r},
+	}, 20*time.Millisecond, time.Hour)
+	ae.Observe("10.0.0.1", decodedUpdate{Metric: "dc908_fan_rpm", Labels: map[string]string{"device": "FAN-1-33"}, Timestamp: time.Now()})
+	assert.Eventually(t, func() bool { return len(am.received()) >= 3 }, waitFor, tick)
+	assert.NoError(t, ae.Close(context.Background()))
+}
+
+func TestAlertSessionEnded(t *testing.T) {
+	assert := assert.New(t)
+	am := &webhookReceiver{}
+	amSrv := httptest.NewServer(am)
+	defer amSrv.Close()
+
+	r := AlertRule{Name: "FanSpinning", Metric: "dc908_fan_rpm", Op: ">", Threshold: 0}
+	assert.NoError(r.compile())
+	grace := 200 * time.Millisecond
+	ae := NewAlertEngine(&AlertConfig{
+		Webhooks: []AlertWebhook{{URL: amSrv.URL, Format: "alertmanager", Timeout: time.Second}},
+		Rules:    []AlertRule{r},
+	}, 20*time.Millisecond, grace)
+	defer ae.Close(context.Background())
+
+	srv, err := NewServer(&Config{Port: 0}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	srv.AddObserver(ae)
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	stream, closer := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(func() bool { return len(ae.Firing()) == 1 }, waitFor, tick)
+
+	// A device reconnecting within the grace period keeps its alerts.
+	ae.SessionEnded("127.0.0.1")
+	ae.Observe("127.0.0.1", decodedUpdate{Metric: "dc908_fan_rpm", Labels: map[string]string{"device": "FAN-1-33"}, Reading: reading{Instant: 4500}, Timestamp: time.Now()})
+	time.Sleep(2 * grace)
+	assert.Len(ae.Firing(), 1)
+
+	// The device goes away while the alert is firing.
+	closer()
+	time.Sleep(grace / 2)
+	assert.Len(ae.Firing(), 1)
+	assert.Eventually(func() bool { return len(ae.Firing()) == 0 }, waitFor, tick)
+
+	var resolved []amAlert
+	assert.Eventually(func() bool {
+		bodies := am.received()
+		if len(bodies) == 0 {
+			return false
+		}
+		var alerts []amAlert
+		if err := json.Unmarshal(bodies[len(bodies)-1], &alerts); err != nil || len(alerts) != 1 {
+			return false
+		}
+		resolved = alerts
+		return !alerts[0].EndsAt.IsZero()
+	}, waitFor, tick)
+	if len(resolved) == 1 {
+		assert.Equal("127.0.0.1", resolved[0].Labels["target"])
+		assert.Equal("FAN-1-33", resolved[0].Labels["device"])
+	}
+
+	// Resolved alerts are not sent again.
+	n := len(am.received())
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(am.received(), n)
+}
+
+func TestAlertsKeptOnShutdown(t *testing.T) {
+	r := AlertRule{Name: "FanSpinning", Metric: "dc908_fan_rpm", Op: ">", Threshold: 0}
+	assert.NoError(t, r.compile())
+	ae := NewAlertEngine(&AlertConfig{Rules: []AlertRule{r}}, time.Hour, 10*time.Millisecond)
+	defer ae.Close(context.Background())
+
+	srv := startServer(t)
+	srv.AddObserver(ae)
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return len(ae.Firing()) == 1 }, waitFor, tick)
+
+	assert.NoError(t, srv.GracefulStop(time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, ae.Firing(), 1)
+}
+
+func TestLoadAlertConfigErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{"missing name", "rules: [{metric: x, op: '<'}]", "missing name"},
+		{"missing metric", "rules: [{name: x, op: '<'}]", "missing metric"},
+		{"bad op", "rules: [{name: x, metric: x, op: '=<'}]", "unsupported op"},
+		{"bad glob", "rules: [{name: x, metric: x, op: '<', component: '['}]", "invalid glob"},
+		{"bad template", "rules: [{name: x, metric: x, op: '<', annotations: {summary: '{{'}}]", "annotation summary"},
+		{"bad format", "webhooks: [{url: http://localhost, format: slack}]", "unsupported format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "alerts.yaml")
+			if err := os.WriteFile(fn, []byte(tt.cfg), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			_, err := LoadAlertConfig(fn)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+type apiValue struct {
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+	Unit   string            `json:"unit,omitempty"`
+}
+
+type apiComponent struct {
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Timestamp time.Time  `json:"timestamp"`
+	Values    []apiValue `json:"values"`
+}
+
+type apiDevice struct {
+	sessionStatus
+	Components []apiComponent `json:"components,omitempty"`
+}
+
+// client returns the client currently registered for target, if any.
+func (srv *Server) client(target string) (*Client, bool) {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	c, ok := srv.clients[normalizeTarget(target)]
+	return c, ok
+}
+
+// apiHandler returns the handler for the JSON state API under /api/v1/.
+func (srv *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/devices", srv.serveAPIDevices)
+	mux.HandleFunc("GET /api/v1/devices/{target}", srv.serveAPIDevice)
+	mux.HandleFunc("GET /api/v1/devices/{target}/components", srv.serveAPIComponents)
+	mux.HandleFunc("GET /api/v1/devices/{target}/components/{name}", srv.serveAPIComponent)
+	return mux
+}
+
+// components returns the latest decoded values of the components known to
+// c, optionally limited to the given component types.
+func (c *Client) components(types []string) ([]apiComponent, error) {
+	samples, err := c.mr.Samples()
+	if err != nil {
+		return nil, err
+	}
+	var res []apiComponent
+	idx := make(map[string]int)
+	for _, s := range samples {
+		name := s.Labels["device"]
+		if name == "" {
+			// Not about a component, e.g. an alarm.
+			continue
+		}
+		if len(types) > 0 && !containsFold(types, componentType(name)) {
+			continue
+		}
+		i, ok := idx[name]
+		if !ok {
+			i = len(res)
+			idx[name] = i
+			res = append(res, apiComponent{
+				Name:      name,
+				Type:      componentType(name),
+				Timestamp: s.Timestamp,
+			})
+		}
+		labels := make(map[string]string)
+		for k, v := range s.Labels {
+			if k != "device" {
+				labels[k] = v
+			}
+		}
+		if len(labels) == 0 {
+			labels = nil
+		}
+		res[i].Values = append(res[i].Values, apiValue{
+			Metric: s.Name,
+			Labels: labels,
+			Value:  s.Value,
+			Unit:   metricUnit(s.Name),
+		})
+	}
+	return res, nil
+}
+
+func containsFold(l []string, s string) bool {
+	for _, e := range l {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeFilter returns the component types requested through one or more
+// "type" query parameters.
+func typeFilter(r *http.Request) []string {
+	return queryList(r, "type")
+}
+
+// queryList returns the values of one or more query parameters, each of which
+// may be a comma separated list.
+func queryList(r *http.Request, param string) []string {
+	var res []string
+	for _, v := range r.URL.Query()[param] {
+		for _, t := range strings.Split(v, ",") {
+			if t != "" {
+				res = append(res, t)
+			}
+		}
+	}
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warningf("Failed to encode API response: %v", err)
+	}
+}
+
+func (srv *Server) serveAPIDevices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, srv.Sessions())
+}
+
+func (srv *Server) serveAPIDevice(w http.ResponseWriter, r *http.Request) {
+	target := r.PathValue("target")
+	c, ok := srv.client(target)
+	if !ok {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+	comps, err := c.components(typeFilter(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, apiDevice{sessionStatus: c.status(target), Components: comps})
+}
+
+func (srv *Server) serveAPIComponents(w http.ResponseWriter, r *http.Request) {
+	c, ok := srv.client(r.PathValue("target"))
+	if !ok {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+	comps, err := c.components(typeFilter(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if comps == nil {
+		comps = []apiComponent{}
+	}
+	writeJSON(w, comps)
+}
+
+func (srv *Server) serveAPIComponent(w http.ResponseWriter, r *http.Request) {
+	c, ok := srv.client(r.PathValue("target"))
+	if !ok {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+	comps, err := c.components(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := r.PathValue("name")
+	for _, comp := range comps {
+		if comp.Name == name {
+			writeJSON(w, comp)
+			return
+		}
+	}
+	http.Error(w, "Unknown component", http.StatusNotFound)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func apiGet(t *testing.T, srv *Server, path string, v any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("json.Unmarshal(%s): %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAPI(t *testing.T) {
+	assert := assert.New(t)
+	srv := startServer(t)
+
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	for _, fn := range []string{"testdata/optics.textpb", "testdata/fan.textpb"} {
+		if err := stream.Send(readTestdata(t, fn)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	assert.Eventually(func() bool {
+		s := srv.Sessions()
+		return len(s) == 1 && s[0].Messages == 2
+	}, waitFor, tick)
+
+	var devices []sessionStatus
+	assert.Equal(http.StatusOK, apiGet(t, srv, "/api/v1/devices", &devices))
+	if assert.Len(devices, 1) {
+		assert.Equal("127.0.0.1", devices[0].Target)
+	}
+
+	assert.Equal(http.StatusNotFound, apiGet(t, srv, "/api/v1/devices/10.0.0.1", nil))
+	assert.Equal(http.StatusNotFound, apiGet(t, srv, "/api/v1/devices/127.0.0.1/components/FAN-9-99", nil))
+
+	var dev apiDevice
+	assert.Equal(http.StatusOK, apiGet(t, srv, "/api/v1/devices/127.0.0.1?type=fan", &dev))
+	assert.Equal("127.0.0.1", dev.Target)
+	assert.Equal([]apiComponent{{
+		Name:      "FAN-1-33",
+		Type:      "FAN",
+		Timestamp: time.Date(2024, 7, 7, 19, 59, 10, 0, time.UTC),
+		Values:    []apiValue{{Metric: "dc908_fan_rpm", Value: 4500, Unit: "{rpm}"}},
+	}}, dev.Components)
+
+	var comps []apiComponent
+	assert.Equal(http.StatusOK, apiGet(t, srv, "/api/v1/devices/127.0.0.1/components?type=OCH,FAN", &comps))
+	var names []string
+	for _, c := range comps {
+		names = append(names, c.Name)
+	}
+	assert.ElementsMatch([]string{"FAN-1-33", "OCH-1-1-L1", "OCH-1-1-L2"}, names)
+
+	var comp apiComponent
+	assert.Equal(http.StatusOK, apiGet(t, srv, "/api/v1/devices/127.0.0.1/components/TRANSCEIVER-1-1-L1", &comp))
+	assert.Equal("TRANSCEIVER", comp.Type)
+	assert.Equal(time.Date(2024, 7, 7, 19, 59, 6, 0, time.UTC), comp.Timestamp)
+	assert.Contains(comp.Values, apiValue{
+		Metric: "dc908_laser_input_power_dbm",
+		Labels: map[string]string{"index": ""},
+		Value:  -14.3,
+		Unit:   "dBm",
+	})
+	assert.Contains(comp.Values, apiValue{
+		Metric: "dc908_temperature_celsius",
+		Value:  50,
+		Unit:   "Cel",
+	})
+}
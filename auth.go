@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	gnmiAuthConfig = flag.String("gnmi-auth-config", "", "path to a YAML file with the credentials devices have to present when opening a gNMI session")
+
+	gnmiAuthRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dc908_exporter_gnmi_auth_rejected_total",
+		Help: "gNMI sessions rejected for missing or bad credentials.",
+	}, []string{"reason"})
+	gnmiAuthAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dc908_exporter_gnmi_auth_accepted_total",
+		Help: "gNMI sessions that presented valid credentials.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(gnmiAuthRejected, gnmiAuthAccepted)
+}
+
+type AuthConfig struct {
+	Devices []DeviceCredentials `yaml:"devices"`
+}
+
+// DeviceCredentials are the credentials expected from the devices connecting
+// from Address, which is an IP address or a CIDR prefix. A device either
+// sends Token as "authorization: Bearer <token>" metadata, or Username and
+// Password as "username" and "password" metadata.
+type DeviceCredentials struct {
+	Address  string `yaml:"address"`
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	prefix netip.Prefix
+}
+
+// LoadAuthConfig reads a gNMI authentication configuration file.
+func LoadAuthConfig(fn string) (*AuthConfig, error) {
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &AuthConfig{}
+	if err := yaml.Unmarshal(d, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", fn, err)
+	}
+	for i := range cfg.Devices {
+		dc := &cfg.Devices[i]
+		dc.prefix, err = parsePrefix(dc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("device %d: %v", i, err)
+		}
+		if dc.Token == "" && dc.Password == "" {
+			return nil, fmt.Errorf("device %s: neither token nor password set", dc.Address)
+		}
+		if dc.Token != "" && dc.Password != "" {
+			return nil, fmt.Errorf("device %s: only one of token and password may be set", dc.Address)
+		}
+	}
+	return cfg, nil
+}
+
+// parsePrefix parses an IP address or a CIDR prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q: %v", s, err)
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q: %v", s, err)
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// lookup returns the credentials for a device, preferring the most specific
+// matching prefix.
+func (cfg *AuthConfig) lookup(addr netip.Addr) *DeviceCredentials {
+	var best *DeviceCredentials
+	for i := range cfg.Devices {
+		dc := &cfg.Devices[i]
+		if dc.prefix.Contains(addr) && (best == nil || dc.prefix.Bits() > best.prefix.Bits()) {
+			best = dc
+		}
+	}
+	return best
+}
+
+func equalSecret(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// check verifies the credentials in md, returning the reason for rejecting
+// them if they are not valid.
+func (dc *DeviceCredentials) check(md metadata.MD) (string, bool) {
+	first := func(k string) (string, bool) {
+		v := md.Get(k)
+		if len(v) == 0 {
+			return "", false
+		}
+		return v[0], true
+	}
+	if dc.Token != "" {
+		auth, ok := first("authorization")
+		if !ok {
+			return "missing", false
+		}
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok || !equalSecret(token, dc.Token) {
+			return "invalid", false
+		}
+		return "", true
+	}
+	user, uok := first("username")
+	pass, pok := first("password")
+	if !uok && !pok {
+		return "missing", false
+	}
+	// Evaluate both to not leak which one was wrong through timing.
+	userOK := equalSecret(user, dc.Username)
+	passOK := equalSecret(pass, dc.Password)
+	if !userOK || !passOK {
+		return "invalid", false
+	}
+	return "", true
+}
+
+// peerAddr returns the IP address of the peer of a gRPC call.
+func peerAddr(ctx context.Context) (netip.Addr, bool) {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return addrOf(pr.Addr)
+}
+
+var publishMethod = "/" + pb.GNMIDialout_ServiceDesc.ServiceName + "/Publish"
+
+// StreamInterceptor rejects Publish streams of devices that do not present
+// the credentials configured for their address with Unauthenticated. Streams
+// on a unix domain socket are checked on their first message, which carries
+// the device address.
+func (cfg *AuthConfig) StreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if info.FullMethod != publishMethod {
+		return handler(srv, ss)
+	}
+	ctx := ss.Context()
+	addr, ok := peerAddr(ctx)
+	if !ok {
+		if pr, ok := peer.FromContext(ctx); ok && isUnixAddr(pr.Addr) {
+			return handler(srv, &firstMessageAuthStream{ServerStream: ss, cfg: cfg})
+		}
+		gnmiAuthRejected.WithLabelValues("unknown_peer").Inc()
+		return grpc.Errorf(codes.Unauthenticated, "failed to get peer address")
+	}
+	if err := cfg.authorize(ctx, addr); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// authorize checks the credentials sent with the call against the ones
+// configured for addr.
+func (cfg *AuthConfig) authorize(ctx context.Context, addr netip.Addr) error {
+	dc := cfg.lookup(addr)
+	if dc == nil {
+		gnmiAuthRejected.WithLabelValues("unknown_device").Inc()
+		log.Warningf("Rejecting gNMI session from %s: no credentials configured", addr)
+		return grpc.Errorf(codes.Unauthenticated, "no credentials configured for %s", addr)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if reason, ok := dc.check(md); !ok {
+		gnmiAuthRejected.WithLabelValues(reason).Inc()
+		log.Warningf("Rejecting gNMI session from %s: %s credentials", addr, reason)
+		return grpc.Errorf(codes.Unauthenticated, "%s credentials", reason)
+	}
+	gnmiAuthAccepted.Inc()
+	return nil
+}
+
+// firstMessageAuthStream authorizes a stream once its first message tells the
+// device address.
+type firstMessageAuthStream struct {
+	grpc.ServerStream
+	cfg     *AuthConfig
+	checked bool
+}
+
+func (s *firstMessageAuthStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil || s.checked {
+		return err
+	}
+	s.checked = true
+	sr, _ := m.(*gnmi.SubscribeResponse)
+	addr, ok := deviceIdentity(sr)
+	if !ok {
+		gnmiAuthRejected.WithLabelValues("unknown_peer").Inc()
+		return grpc.Errorf(codes.Unauthenticated, "missing device address in extension %d", deviceIDExtension)
+	}
+	return s.cfg.authorize(s.Context(), addr)
+}
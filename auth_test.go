@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func writeAuthConfig(t *testing.T, cfg string) *AuthConfig {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "auth.yaml")
+	if err := os.WriteFile(fn, []byte(cfg), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	ac, err := LoadAuthConfig(fn)
+	if err != nil {
+		t.Fatalf("LoadAuthConfig: %v", err)
+	}
+	return ac
+}
+
+func TestAuthInterceptor(t *testing.T) {
+	ac := writeAuthConfig(t, `
+devices:
+  - address: 127.0.0.0/8
+    username: dc908
+    password: hunter2
+  - address: 127.0.0.2
+    token: s3cret
+`)
+	srv, err := NewServer(&Config{Port: 0}, []grpc.ServerOption{grpc.ChainStreamInterceptor(ac.StreamInterceptor)})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	var tests = []struct {
+		name   string
+		src    string
+		md     []string
+		reason string
+	}{
+		{"password", "127.0.0.1", []string{"username", "dc908", "password", "hunter2"}, ""},
+		{"bad password", "127.0.0.3", []string{"username", "dc908", "password", "hunter3"}, "invalid"},
+		{"missing password", "127.0.0.4", nil, "missing"},
+		{"token", "127.0.0.2", []string{"authorization", "Bearer s3cret"}, ""},
+		{"token of other device", "127.0.0.5", []string{"authorization", "Bearer s3cret"}, "missing"},
+		{"password instead of token", "127.0.0.2", []string{"username", "dc908", "password", "hunter2"}, "missing"},
+		{"bad token", "127.0.0.2", []string{"authorization", "Bearer guess"}, "invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before float64
+			if tt.reason != "" {
+				before = testutil.ToFloat64(gnmiAuthRejected.WithLabelValues(tt.reason))
+			} else {
+				before = testutil.ToFloat64(gnmiAuthAccepted)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream, err := pb.NewGNMIDialoutClient(connFrom(t, srv, tt.src)).Publish(metadata.AppendToOutgoingContext(ctx, tt.md...))
+			if err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+			if tt.reason != "" {
+				_, err = stream.Recv()
+				assert.Equal(t, codes.Unauthenticated, status.Code(err))
+				assert.Equal(t, before+1, testutil.ToFloat64(gnmiAuthRejected.WithLabelValues(tt.reason)))
+				return
+			}
+			if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			assert.Eventually(t, func() bool { return probeSucceeds(srv, tt.src) }, waitFor, tick)
+			assert.Equal(t, before+1, testutil.ToFloat64(gnmiAuthAccepted))
+		})
+	}
+}
+
+func TestAuthUnixSocket(t *testing.T) {
+	ac := writeAuthConfig(t, `
+devices:
+  - address: 192.0.2.7
+    token: s3cret
+`)
+	path := filepath.Join(t.TempDir(), "gnmi.sock")
+	srv, err := NewServer(&Config{Addresses: []string{unixPrefix + path}}, []grpc.ServerOption{grpc.ChainStreamInterceptor(ac.StreamInterceptor)})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	var tests = []struct {
+		name     string
+		identity string
+		token    string
+		want     codes.Code
+	}{
+		{"token", "192.0.2.7", "s3cret", codes.OK},
+		{"bad token", "192.0.2.7", "guess", codes.Unauthenticated},
+		{"unknown device", "192.0.2.8", "s3cret", codes.Unauthenticated},
+		{"no identity", "", "s3cret", codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := grpc.NewClient("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatalf("grpc.NewClient: %v", err)
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+tt.token))
+			defer cancel()
+			stream, err := pb.NewGNMIDialoutClient(conn).Publish(ctx)
+			if err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+			if err := stream.Send(withIdentity(readTestdata(t, "testdata/fan.textpb"), tt.identity)); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if tt.want != codes.OK {
+				_, err = stream.Recv()
+				assert.Equal(t, tt.want, status.Code(err))
+				return
+			}
+			assert.Eventually(t, func() bool { return probeSucceeds(srv, tt.identity) }, waitFor, tick)
+		})
+	}
+}
+
+func TestAuthConfigLookup(t *testing.T) {
+	ac := writeAuthConfig(t, `
+devices:
+  - {address: 0.0.0.0/0, token: a}
+  - {address: 10.0.0.0/8, token: b}
+  - {address: 10.0.0.1, token: c}
+  - {address: "2001:db8::/32", token: d}
+`)
+	var tests = []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "a"},
+		{"10.1.2.3", "b"},
+		{"10.0.0.1", "c"},
+		{"::ffff:10.0.0.1", "c"},
+		{"2001:db8::1", "d"},
+		{"2001:db9::1", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if dc := ac.lookup(netip.MustParseAddr(tt.addr).Unmap()); dc != nil {
+			got = dc.Token
+		}
+		assert.Equal(t, tt.want, got, tt.addr)
+	}
+}
+
+func TestLoadAuthConfigErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{"bad address", "devices: [{address: 10.0.0.256, token: x}]", "invalid address"},
+		{"no secret", "devices: [{address: 10.0.0.1}]", "neither token nor password"},
+		{"both secrets", "devices: [{address: 10.0.0.1, token: x, password: y}]", "only one of"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "auth.yaml")
+			if err := os.WriteFile(fn, []byte(tt.cfg), 0600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			_, err := LoadAuthConfig(fn)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
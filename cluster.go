@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	clusterPeers           = flag.String("cluster-peers", "", "comma separated base URLs of the HTTP ports of the other exporter replicas, e.g. http://exporter-b:9908, clustering is disabled if empty")
+	clusterSyncInterval    = flag.Duration("cluster-sync-interval", 10*time.Second, "how often to fetch the devices and snapshots of the other replicas")
+	clusterSnapshotMaxAge  = flag.Duration("cluster-snapshot-max-age", 0, "how long a snapshot fetched from another replica is served after it was fetched or the device last sent an update, 0 for two heartbeat intervals plus the sync interval")
+	clusterBearerTokenFile = flag.String("cluster-bearer-token-file", "", "file with the bearer token sent to the other replicas, for replicas with -web-config-file authentication")
+
+	clusterSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dc908_exporter_cluster_syncs_total",
+		Help: "Fetches of the devices and snapshots of other replicas.",
+	}, []string{"peer", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(clusterSyncs)
+}
+
+// clusterSnapshot is the state of a device held by a replica.
+type clusterSnapshot struct {
+	Target string `json:"target"`
+	// AgeSeconds is how long ago the device last sent a message, measured
+	// by the replica holding it so that the clocks of the replicas do not
+	// need to agree. It is unset if the device never sent a message.
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+	// Metrics are the metrics of the device in the Prometheus text format.
+	Metrics string `json:"metrics"`
+}
+
+// ClusterConfig configures sharing sessions with other replicas.
+type ClusterConfig struct {
+	Peers        []string
+	SyncInterval time.Duration
+	MaxAge       time.Duration
+	BearerToken  string
+}
+
+// ClusterConfigFromFlags returns the cluster configuration set on the command
+// line, or nil if clustering is disabled.
+func ClusterConfigFromFlags() (*ClusterConfig, error) {
+	var peers []string
+	for _, p := range strings.Split(*clusterPeers, ",") {
+		if p = strings.TrimRight(strings.TrimSpace(p), "/"); p != "" {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	if *clusterSyncInterval <= 0 {
+		return nil, fmt.Errorf("-cluster-sync-interval must be positive, got %v", *clusterSyncInterval)
+	}
+	if *clusterSnapshotMaxAge < 0 {
+		return nil, fmt.Errorf("-cluster-snapshot-max-age must not be negative, got %v", *clusterSnapshotMaxAge)
+	}
+	cfg := &ClusterConfig{
+		Peers:        peers,
+		SyncInterval: *clusterSyncInterval,
+		MaxAge:       *clusterSnapshotMaxAge,
+	}
+	if cfg.MaxAge == 0 {
+		// Devices send at least a heartbeat every heartbeat interval, and
+		// the snapshot is served until the next fetch.
+		cfg.MaxAge = 2**gnmiHeartbeatInterval + cfg.SyncInterval
+	}
+	if *clusterBearerTokenFile != "" {
+		d, err := os.ReadFile(*clusterBearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.BearerToken = strings.TrimSpace(string(d))
+	}
+	return cfg, nil
+}
+
+type remoteSnapshot struct {
+	peer    string
+	fetched time.Time
+	// lastUpdate is when the device last sent an update to the peer in local
+	// time, zero if it never did.
+	lastUpdate time.Time
+	families   []*dto.MetricFamily
+}
+
+// Cluster periodically fetches the devices held by the other replicas with
+// their latest snapshots, so that any replica can answer probes for any
+// device.
+type Cluster struct {
+	cfg    ClusterConfig
+	client *http.Client
+	now    func() time.Time
+
+	lock   sync.RWMutex
+	remote map[string]remoteSnapshot
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewCluster(cfg ClusterConfig) *Cluster {
+	timeout := cfg.SyncInterval
+	if timeout <= 0 || timeout > 10*time.Second {
+		timeout = 10 * time.Second
+	}
+	return &Cluster{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+		now:    time.Now,
+		remote: make(map[string]remoteSnapshot),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start fetches from the peers right away and then every sync interval until
+// the cluster is closed.
+func (cl *Cluster) Start() {
+	go cl.run()
+}
+
+func (cl *Cluster) run() {
+	defer close(cl.done)
+	t := time.NewTicker(cl.cfg.SyncInterval)
+	defer t.Stop()
+	for {
+		cl.sync()
+		select {
+		case <-cl.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// sync fetches the snapshots of all peers.
+func (cl *Cluster) sync() {
+	var wg sync.WaitGroup
+	for _, p := range cl.cfg.Peers {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			snaps, err := cl.fetch(p)
+			if err != nil {
+				clusterSyncs.WithLabelValues(p, "error").Inc()
+				log.Warningf("Failed to fetch snapshots from replica %s: %v", p, err)
+				return
+			}
+			clusterSyncs.WithLabelValues(p, "success").Inc()
+			cl.update(p, snaps)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (cl *Cluster) fetch(peer string) ([]clusterSnapshot, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-cl.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/api/cluster/snapshots", nil)
+	if err != nil {
+		return nil, err
+	}
+	if cl.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cl.cfg.BearerToken)
+	}
+	resp, err := cl.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	var snaps []clusterSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snaps); err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+// update replaces the snapshots held by peer.
+func (cl *Cluster) update(peer string, snaps []clusterSnapshot) {
+	now := cl.now()
+	fresh := make(map[string]remoteSnapshot)
+	for _, s := range snaps {
+		mfs, err := parseMetricsText(s.Metrics)
+		if err != nil {
+			log.Warningf("Failed to parse snapshot of %q from replica %s: %v", s.Target, peer, err)
+			continue
+		}
+		rs := remoteSnapshot{peer: peer, fetched: now, families: mfs}
+		if s.AgeSeconds != nil {
+			rs.lastUpdate = now.Add(-time.Duration(*s.AgeSeconds * float64(time.Second)))
+		}
+		fresh[normalizeTarget(s.Target)] = rs
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	for target, rs := range cl.remote {
+		if _, ok := fresh[target]; !ok && rs.peer == peer {
+			delete(cl.remote, target)
+		}
+	}
+	for target, rs := range fresh {
+		cl.remote[target] = rs
+	}
+}
+
+// Snapshot returns the metrics of a device held by another replica, if they
+// were fetched recently enough and the device sent an update to the replica
+// recently enough.
+func (cl *Cluster) Snapshot(target string) (prometheus.Gatherer, string, bool) {
+	if cl == nil {
+		return nil, "", false
+	}
+	cl.lock.RLock()
+	rs, ok := cl.remote[target]
+	cl.lock.RUnlock()
+	if !ok {
+		return nil, "", false
+	}
+	now := cl.now()
+	if now.Sub(rs.fetched) > cl.cfg.MaxAge || now.Sub(rs.lastUpdate) > cl.cfg.MaxAge {
+		return nil, "", false
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return rs.families, nil
+	}), rs.peer, true
+}
+
+// Close stops fetching from the peers.
+func (cl *Cluster) Close(ctx context.Context) error {
+	close(cl.stop)
+	select {
+	case <-cl.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// localSnapshots returns the snapshots of the devices connected to this
+// replica. Devices only known from other replicas are not passed on.
+func (srv *Server) localSnapshots() []clusterSnapshot {
+	srv.lock.RLock()
+	clients := make(map[string]*Client, len(srv.clients))
+	for target, c := range srv.clients {
+		clients[target] = c
+	}
+	srv.lock.RUnlock()
+
+	now := time.Now()
+	res := make([]clusterSnapshot, 0, len(clients))
+	for target, c := range clients {
+		mfs, err := c.mr.PrometheusRegistry().Gather()
+		if err != nil {
+			log.Warningf("Failed to gather snapshot of %q: %v", target, err)
+			continue
+		}
+		text, err := metricsText(mfs)
+		if err != nil {
+			log.Warningf("Failed to encode snapshot of %q: %v", target, err)
+			continue
+		}
+		snap := clusterSnapshot{Target: target, Metrics: text}
+		if lu := c.lastUpdate.Load(); lu != 0 {
+			age := now.Sub(time.Unix(0, lu)).Seconds()
+			snap.AgeSeconds = &age
+		}
+		res = append(res, snap)
+	}
+	return res
+}
+
+// metricsText encodes metric families in the Prometheus text format.
+func metricsText(mfs []*dto.MetricFamily) (string, error) {
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// parseMetricsText decodes metric families in the Prometheus text format,
+// sorted by name.
+func parseMetricsText(text string) ([]*dto.MetricFamily, error) {
+	var p expfmt.TextParser
+	byName, err := p.TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*dto.MetricFamily, 0, len(byName))
+	for _, mf := range byName {
+		res = append(res, mf)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].GetName() < res[j].GetName() })
+	return res, nil
+}
+
+func (srv *Server) serveClusterSnapshots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(srv.localSnapshots()); err != nil {
+		log.Warningf("Failed to write cluster snapshots: %v", err)
+	}
+}
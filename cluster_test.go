@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// replicaEnv makes the test binary run the exporter instead of the tests, so
+// that tests can start several replicas as separate processes.
+const replicaEnv = "DC908_EXPORTER_REPLICA"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(replicaEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestClusterSnapshot(t *testing.T) {
+	a := startServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(a.serveClusterSnapshots))
+	t.Cleanup(ts.Close)
+
+	b := startServer(t)
+	b.cluster = NewCluster(ClusterConfig{Peers: []string{ts.URL}, SyncInterval: time.Hour, MaxAge: time.Minute})
+	now := time.Now()
+	b.cluster.now = func() time.Time { return now }
+
+	stream, closer := dialFrom(t, a, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(a, "127.0.0.1") }, waitFor, tick)
+	assert.False(t, probeSucceeds(b, "127.0.0.1"))
+
+	b.cluster.sync()
+	assert.True(t, probeSucceeds(b, "127.0.0.1"))
+	assert.Contains(t, probe(b, "127.0.0.1"), `dc908_fan_rpm{device="FAN-1-33"} 4500`)
+	assert.True(t, probeSucceeds(b, "::ffff:127.0.0.1"))
+
+	// Snapshots expire if the replica cannot be reached any more.
+	now = now.Add(2 * time.Minute)
+	assert.False(t, probeSucceeds(b, "127.0.0.1"))
+
+	// Devices that moved away are forgotten on the next sync.
+	now = time.Now()
+	b.cluster.sync()
+	assert.True(t, probeSucceeds(b, "127.0.0.1"))
+	closer()
+	assert.Eventually(t, func() bool { return !probeSucceeds(a, "127.0.0.1") }, waitFor, tick)
+	b.cluster.sync()
+	assert.False(t, probeSucceeds(b, "127.0.0.1"))
+}
+
+func TestClusterSnapshotSilentSession(t *testing.T) {
+	cl := NewCluster(ClusterConfig{MaxAge: time.Minute})
+	now := time.Now()
+	cl.now = func() time.Time { return now }
+	recent, old := 1.0, 120.0
+	cl.update("http://a:9908", []clusterSnapshot{
+		{Target: "127.0.0.1", AgeSeconds: &recent},
+		{Target: "127.0.0.2", AgeSeconds: &old},
+		{Target: "127.0.0.3"},
+	})
+
+	_, peer, ok := cl.Snapshot("127.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, "http://a:9908", peer)
+	// Freshly fetched, but the devices have not sent anything for too long.
+	_, _, ok = cl.Snapshot("127.0.0.2")
+	assert.False(t, ok)
+	_, _, ok = cl.Snapshot("127.0.0.3")
+	assert.False(t, ok)
+
+	// The age keeps growing after the fetch.
+	now = now.Add(time.Minute)
+	_, _, ok = cl.Snapshot("127.0.0.1")
+	assert.False(t, ok)
+}
+
+func TestClusterConfigFromFlags(t *testing.T) {
+	defer func(p string) { *clusterPeers = p }(*clusterPeers)
+	defer func(d time.Duration) { *clusterSyncInterval = d }(*clusterSyncInterval)
+	defer func(d time.Duration) { *clusterSnapshotMaxAge = d }(*clusterSnapshotMaxAge)
+
+	*clusterPeers = ""
+	cfg, err := ClusterConfigFromFlags()
+	assert.NoError(t, err)
+	assert.Nil(t, cfg)
+
+	*clusterPeers = " http://a:9908/, ,http://b:9908"
+	*clusterSyncInterval = 10 * time.Second
+	*clusterSnapshotMaxAge = 0
+	cfg, err = ClusterConfigFromFlags()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"http://a:9908", "http://b:9908"}, cfg.Peers)
+		assert.Equal(t, 2**gnmiHeartbeatInterval+10*time.Second, cfg.MaxAge)
+	}
+
+	*clusterSyncInterval = 0
+	_, err = ClusterConfigFromFlags()
+	assert.ErrorContains(t, err, "-cluster-sync-interval must be positive")
+
+	*clusterSyncInterval = 10 * time.Second
+	*clusterSnapshotMaxAge = -time.Second
+	_, err = ClusterConfigFromFlags()
+	assert.ErrorContains(t, err, "-cluster-snapshot-max-age must not be negative")
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+type replica struct {
+	gnmi string
+	http string
+}
+
+// startReplica runs the exporter in a separate process.
+func startReplica(t *testing.T, r replica, args ...string) {
+	t.Helper()
+	args = append([]string{
+		"-logtostderr",
+		"-gnmi-listen-addresses=" + r.gnmi,
+		"-metric-listen-addresses=" + r.http,
+		"-shutdown-timeout=1s",
+	}, args...)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), replicaEnv+"=1")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(waitFor):
+			cmd.Process.Kill()
+			<-exited
+		}
+		if t.Failed() {
+			t.Logf("Replica on %s:\n%s", r.http, out.String())
+		}
+	})
+	if !assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + r.http + "/healthz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, waitFor, tick) {
+		t.FailNow()
+	}
+}
+
+func httpProbe(addr string, target string) string {
+	resp, err := http.Get(fmt.Sprintf("http://%s/probe?target=%s", addr, target))
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+// TestClusterReplicas runs two replicas in separate processes and probes a
+// device connected to one of them on the other.
+func TestClusterReplicas(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts separate processes")
+	}
+	a := replica{gnmi: fmt.Sprintf("127.0.0.1:%d", freePort(t)), http: fmt.Sprintf("127.0.0.1:%d", freePort(t))}
+	b := replica{gnmi: fmt.Sprintf("127.0.0.1:%d", freePort(t)), http: fmt.Sprintf("127.0.0.1:%d", freePort(t))}
+	startReplica(t, a, "-cluster-peers=http://"+b.http, "-cluster-sync-interval=100ms")
+	startReplica(t, b, "-cluster-peers=http://"+a.http, "-cluster-sync-interval=100ms")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := pb.NewGNMIDialoutClient(connTo(t, a.gnmi, "127.0.0.1")).Publish(ctx)
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	for _, r := range []replica{a, b} {
+		assert.Eventually(t, func() bool {
+			p := httpProbe(r.http, "127.0.0.1")
+			return strings.Contains(p, "probe_success 1") && strings.Contains(p, "dc908_fan_rpm")
+		}, waitFor, tick, r.http)
+	}
+
+	// Once the device is gone, no replica claims to have it.
+	cancel()
+	for _, r := range []replica{a, b} {
+		assert.Eventually(t, func() bool {
+			return strings.Contains(httpProbe(r.http, "127.0.0.1"), "probe_success 0")
+		}, waitFor, tick, r.http)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gnmi/cache"
+	"github.com/openconfig/gnmi/ctree"
+	"github.com/openconfig/gnmi/path"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/openconfig/gnmi/subscribe"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	gnmiServerPort = flag.Int("gnmi-server-port", 0, "port to serve cached device telemetry on using gNMI Get and Subscribe, 0 disables")
+)
+
+// GNMICache keeps the latest notifications received from every connected
+// device and serves them to gNMI clients, using the device address as the
+// gNMI target.
+type GNMICache struct {
+	c   *cache.Cache
+	sub *subscribe.Server
+	s   *grpc.Server
+	lis net.Listener
+
+	gnmi.UnimplementedGNMIServer
+}
+
+func NewGNMICache(port int, opts []grpc.ServerOption) (*GNMICache, error) {
+	c := cache.New(nil)
+	sub, err := subscribe.NewServer(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gNMI subscribe server: %v", err)
+	}
+	c.SetClient(sub.Update)
+
+	gc := &GNMICache{
+		c:   c,
+		sub: sub,
+		s:   grpc.NewServer(opts...),
+	}
+	gc.lis, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open listener port %d: %v", port, err)
+	}
+	gnmi.RegisterGNMIServer(gc.s, gc)
+	reflection.Register(gc.s)
+	log.V(1).Infof("Created gNMI cache server on %s", gc.Address())
+	return gc, nil
+}
+
+func (gc *GNMICache) Serve() error {
+	return gc.s.Serve(gc.lis)
+}
+
+func (gc *GNMICache) Stop() {
+	gc.s.Stop()
+}
+
+// GracefulStop waits up to timeout for gNMI clients to finish before closing
+// their streams forcefully.
+func (gc *GNMICache) GracefulStop(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		gc.s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		gc.s.Stop()
+		<-done
+	}
+}
+
+func (gc *GNMICache) Address() string {
+	return gc.lis.Addr().String()
+}
+
+// AddTarget reserves space in the cache for a newly connected device.
+func (gc *GNMICache) AddTarget(target string) {
+	gc.c.Add(target).Connect()
+}
+
+// RemoveTarget drops all cached state of a device, notifying subscribers.
+func (gc *GNMICache) RemoveTarget(target string) {
+	gc.c.Remove(target)
+}
+
+// Update stores a notification received from target in the cache.
+func (gc *GNMICache) Update(target string, notif *gnmi.Notification) {
+	if notif == nil {
+		return
+	}
+	n := proto.Clone(notif).(*gnmi.Notification)
+	if n.Prefix == nil {
+		n.Prefix = &gnmi.Path{}
+	}
+	n.Prefix.Target = target
+	if err := gc.c.GnmiUpdate(n); err != nil {
+		log.V(2).Infof("gNMI cache rejected update from %q: %v", target, err)
+	}
+}
+
+// Sync marks target as having sent its initial set of updates.
+func (gc *GNMICache) Sync(target string) {
+	gc.c.Sync(target)
+}
+
+func (gc *GNMICache) Capabilities(ctx context.Context, req *gnmi.CapabilityRequest) (*gnmi.CapabilityResponse, error) {
+	ver, _ := proto.GetExtension(gnmi.File_proto_gnmi_gnmi_proto.Options(), gnmi.E_GnmiService).(string)
+	return &gnmi.CapabilityResponse{
+		SupportedEncodings: []gnmi.Encoding{gnmi.Encoding_JSON_IETF},
+		GNMIVersion:        ver,
+	}, nil
+}
+
+func (gc *GNMICache) Get(ctx context.Context, req *gnmi.GetRequest) (*gnmi.GetResponse, error) {
+	target := req.GetPrefix().GetTarget()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing target")
+	}
+	if target != "*" && !gc.c.HasTarget(target) {
+		return nil, status.Errorf(codes.NotFound, "no such target: %q", target)
+	}
+	paths := req.GetPath()
+	if len(paths) == 0 {
+		paths = []*gnmi.Path{{}}
+	}
+
+	resp := &gnmi.GetResponse{}
+	for _, p := range paths {
+		q := path.ToStrings(&gnmi.Path{
+			Origin: req.GetPrefix().GetOrigin(),
+			Elem:   append(append([]*gnmi.PathElem{}, req.GetPrefix().GetElem()...), p.GetElem()...),
+		}, true)
+		err := gc.c.Query(target, q, func(_ []string, l *ctree.Leaf, _ interface{}) error {
+			if n, ok := l.Value().(*gnmi.Notification); ok {
+				resp.Notification = append(resp.Notification, n)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "query failed: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+func (gc *GNMICache) Subscribe(stream gnmi.GNMI_SubscribeServer) error {
+	return gc.sub.Subscribe(stream)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func startGNMICache(t *testing.T, srv *Server) gnmi.GNMIClient {
+	t.Helper()
+	gc, err := NewGNMICache(0, nil)
+	if err != nil {
+		t.Fatalf("NewGNMICache: %v", err)
+	}
+	go gc.Serve()
+	t.Cleanup(gc.Stop)
+	srv.gnmiCache = gc
+
+	conn, err := grpc.NewClient(gc.Address(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return gnmi.NewGNMIClient(conn)
+}
+
+func fanPath(name string) *gnmi.Path {
+	return &gnmi.Path{Elem: []*gnmi.PathElem{
+		{Name: "openconfig-platform:components"},
+		{Name: "component", Key: map[string]string{"name": name}},
+		{Name: "fan"},
+		{Name: "state"},
+	}}
+}
+
+func TestGNMICacheGet(t *testing.T) {
+	assert := assert.New(t)
+	srv, err := NewServer(&Config{Port: 0}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	cl := startGNMICache(t, srv)
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+
+	caps, err := cl.Capabilities(ctx, &gnmi.CapabilityRequest{})
+	if assert.NoError(err) {
+		assert.Equal("0.10.0", caps.GetGNMIVersion())
+	}
+
+	_, err = cl.Get(ctx, &gnmi.GetRequest{Prefix: &gnmi.Path{Target: "127.0.0.1"}})
+	assert.Equal(codes.NotFound, status.Code(err))
+	_, err = cl.Get(ctx, &gnmi.GetRequest{})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+
+	stream, closer := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	var resp *gnmi.GetResponse
+	assert.Eventually(func() bool {
+		resp, err = cl.Get(ctx, &gnmi.GetRequest{
+			Prefix: &gnmi.Path{Target: "127.0.0.1"},
+			Path:   []*gnmi.Path{fanPath("FAN-1-33")},
+		})
+		return err == nil && len(resp.GetNotification()) == 1
+	}, waitFor, tick)
+	n := resp.GetNotification()[0]
+	assert.Equal("127.0.0.1", n.GetPrefix().GetTarget())
+	assert.Equal(time.Date(2024, 7, 7, 19, 59, 10, 0, time.UTC), time.Unix(0, n.GetTimestamp()).UTC())
+	if assert.Len(n.GetUpdate(), 1) {
+		assert.Contains(string(n.GetUpdate()[0].GetVal().GetJsonIetfVal()), `"speed":4500`)
+	}
+
+	resp, err = cl.Get(ctx, &gnmi.GetRequest{
+		Prefix: &gnmi.Path{Target: "127.0.0.1"},
+		Path:   []*gnmi.Path{fanPath("FAN-9-99")},
+	})
+	if assert.NoError(err) {
+		assert.Empty(resp.GetNotification())
+	}
+
+	closer()
+	assert.Eventually(func() bool {
+		_, err = cl.Get(ctx, &gnmi.GetRequest{Prefix: &gnmi.Path{Target: "127.0.0.1"}})
+		return status.Code(err) == codes.NotFound
+	}, waitFor, tick)
+}
+
+func TestGNMICacheSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	srv, err := NewServer(&Config{Port: 0}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	cl := startGNMICache(t, srv)
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(func() bool {
+		s := srv.Sessions()
+		return len(s) == 1 && s[0].Messages == 1
+	}, waitFor, tick)
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	sub, err := cl.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	err = sub.Send(&gnmi.SubscribeRequest{Request: &gnmi.SubscribeRequest_Subscribe{
+		Subscribe: &gnmi.SubscriptionList{
+			Prefix:       &gnmi.Path{Target: "127.0.0.1"},
+			Mode:         gnmi.SubscriptionList_ONCE,
+			Subscription: []*gnmi.Subscription{{Path: &gnmi.Path{Elem: []*gnmi.PathElem{{Name: "openconfig-platform:components"}}}}},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	var updates []*gnmi.Notification
+	synced := false
+	for {
+		resp, err := sub.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if resp.GetSyncResponse() {
+			synced = true
+			continue
+		}
+		updates = append(updates, resp.GetUpdate())
+	}
+	assert.True(synced)
+	if assert.Len(updates, 1) {
+		// Subscribe responses carry the full path without the device prefix.
+		assert.Equal("FAN-1-33", updates[0].GetUpdate()[0].GetPath().GetElem()[1].GetKey()["name"])
+	}
+}
+
+func TestGNMICacheSyncResponse(t *testing.T) {
+	assert := assert.New(t)
+	srv, err := NewServer(&Config{Port: 0}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	cl := startGNMICache(t, srv)
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	sync := &gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_SyncResponse{SyncResponse: true}}
+	if err := stream.Send(sync); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	// The session survives the sync response.
+	assert.Eventually(func() bool {
+		s := srv.Sessions()
+		return len(s) == 1 && s[0].Messages == 2
+	}, waitFor, tick)
+	assert.True(probeSucceeds(srv, "127.0.0.1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+	defer cancel()
+	sub, err := cl.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	err = sub.Send(&gnmi.SubscribeRequest{Request: &gnmi.SubscribeRequest_Subscribe{
+		Subscribe: &gnmi.SubscriptionList{
+			Prefix:       &gnmi.Path{Target: "127.0.0.1"},
+			Mode:         gnmi.SubscriptionList_ONCE,
+			Subscription: []*gnmi.Subscription{{Path: &gnmi.Path{Elem: []*gnmi.PathElem{{Name: "meta"}, {Name: "sync"}}}}},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	synced := false
+	for {
+		resp, err := sub.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		for _, u := range resp.GetUpdate().GetUpdate() {
+			synced = synced || u.GetVal().GetBoolVal()
+		}
+	}
+	assert.True(synced, "cache subscribers see the device as synced")
+}
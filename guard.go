@@ -0,0 +1,295 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+var (
+	gnmiAllow             = flag.String("gnmi-allow", "", "comma separated addresses or CIDR prefixes allowed to connect to the gNMI port, any if empty")
+	gnmiDeny              = flag.String("gnmi-deny", "", "comma separated addresses or CIDR prefixes denied to connect to the gNMI port, takes precedence over -gnmi-allow")
+	maxConnsPerSource     = flag.Int("max-gnmi-connections-per-source", 0, "maximum number of concurrent gNMI connections from a single address, 0 for unlimited")
+	maxMessageRate        = flag.Float64("max-gnmi-message-rate", 0, "maximum number of messages per second in a gNMI session, 0 for unlimited")
+	gnmiMessageBurst      = flag.Int("gnmi-message-burst", 100, "number of messages a gNMI session may send in a burst above -max-gnmi-message-rate")
+	gnmiRejectBackoff     = flag.Duration("gnmi-reject-backoff", time.Second, "how long an offending address is rejected for, doubled with every further offense")
+	gnmiRejectBackoffMax  = flag.Duration("gnmi-reject-backoff-max", 5*time.Minute, "maximum time an offending address is rejected for")
+	gnmiAdmissionDecision = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dc908_exporter_gnmi_admission_total",
+		Help: "Decisions about gNMI connections at accept time and about sessions.",
+	}, []string{"stage", "decision"})
+)
+
+func init() {
+	prometheus.MustRegister(gnmiAdmissionDecision)
+}
+
+// GuardConfig limits who may connect to the gNMI port and how much they may
+// send. The zero value does not limit anything.
+type GuardConfig struct {
+	Allow             []netip.Prefix
+	Deny              []netip.Prefix
+	MaxConnsPerSource int
+	MessageRate       float64
+	MessageBurst      int
+	Backoff           time.Duration
+	MaxBackoff        time.Duration
+}
+
+// GuardConfigFromFlags returns the guard configuration set on the command
+// line.
+func GuardConfigFromFlags() (*GuardConfig, error) {
+	allow, err := parsePrefixList(*gnmiAllow)
+	if err != nil {
+		return nil, fmt.Errorf("-gnmi-allow: %v", err)
+	}
+	deny, err := parsePrefixList(*gnmiDeny)
+	if err != nil {
+		return nil, fmt.Errorf("-gnmi-deny: %v", err)
+	}
+	return &GuardConfig{
+		Allow:             allow,
+		Deny:              deny,
+		MaxConnsPerSource: *maxConnsPerSource,
+		MessageRate:       *maxMessageRate,
+		MessageBurst:      *gnmiMessageBurst,
+		Backoff:           *gnmiRejectBackoff,
+		MaxBackoff:        *gnmiRejectBackoffMax,
+	}, nil
+}
+
+// parsePrefixList parses a comma separated list of addresses and prefixes.
+func parsePrefixList(s string) ([]netip.Prefix, error) {
+	var res []netip.Prefix
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		p, err := parsePrefix(e)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrOf returns the IP address of a network address.
+func addrOf(a net.Addr) (netip.Addr, bool) {
+	if a == nil {
+		return netip.Addr{}, false
+	}
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+type offender struct {
+	offenses int
+	until    time.Time
+}
+
+// Guard enforces a GuardConfig and keeps offending addresses out for an
+// exponentially growing time.
+type Guard struct {
+	cfg GuardConfig
+	now func() time.Time
+
+	lock      sync.Mutex
+	conns     map[netip.Addr]int
+	offenders map[netip.Addr]*offender
+	pruned    time.Time
+}
+
+func NewGuard(cfg GuardConfig) *Guard {
+	return &Guard{
+		cfg:       cfg,
+		now:       time.Now,
+		conns:     make(map[netip.Addr]int),
+		offenders: make(map[netip.Addr]*offender),
+	}
+}
+
+// prune forgets the offenders whose offenses would start over anyway, at most
+// once per maximum backoff. The guard lock has to be held.
+func (g *Guard) prune(now time.Time) {
+	if now.Sub(g.pruned) < g.cfg.MaxBackoff {
+		return
+	}
+	g.pruned = now
+	for addr, o := range g.offenders {
+		if now.Sub(o.until) > g.cfg.MaxBackoff {
+			delete(g.offenders, addr)
+		}
+	}
+}
+
+// offend records an offense of addr and returns how long it is rejected for.
+// The guard lock has to be held.
+func (g *Guard) offend(addr netip.Addr) time.Duration {
+	now := g.now()
+	g.prune(now)
+	o, ok := g.offenders[addr]
+	if !ok {
+		o = &offender{}
+		g.offenders[addr] = o
+	}
+	// Addresses that behaved for a while start over.
+	if !o.until.IsZero() && now.Sub(o.until) > g.cfg.MaxBackoff {
+		o.offenses = 0
+	}
+	o.offenses++
+	d := g.cfg.Backoff
+	for i := 1; i < o.offenses && d < g.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > g.cfg.MaxBackoff {
+		d = g.cfg.MaxBackoff
+	}
+	o.until = now.Add(d)
+	return d
+}
+
+// inBackoff returns whether addr is currently rejected for earlier offenses.
+// The guard lock has to be held.
+func (g *Guard) inBackoff(addr netip.Addr) bool {
+	o, ok := g.offenders[addr]
+	return ok && g.now().Before(o.until)
+}
+
+// admit decides whether a new connection from addr is accepted. Accepted
+// connections have to be released when closed.
+func (g *Guard) admit(addr netip.Addr) string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.prune(g.now())
+	decision := "accepted"
+	switch {
+	case containsAddr(g.cfg.Deny, addr):
+		decision = "denied"
+	case len(g.cfg.Allow) > 0 && !containsAddr(g.cfg.Allow, addr):
+		decision = "not_allowed"
+	case g.inBackoff(addr):
+		decision = "backoff"
+	case g.cfg.MaxConnsPerSource > 0 && g.conns[addr] >= g.cfg.MaxConnsPerSource:
+		decision = "too_many_connections"
+		d := g.offend(addr)
+		log.Warningf("Too many gNMI connections from %s, rejecting it for %s", addr, d)
+	default:
+		g.conns[addr]++
+	}
+	gnmiAdmissionDecision.WithLabelValues("accept", decision).Inc()
+	return decision
+}
+
+func (g *Guard) release(addr netip.Addr) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.conns[addr]--
+	if g.conns[addr] <= 0 {
+		delete(g.conns, addr)
+	}
+}
+
+// admitSession decides whether addr may start a session on an already
+// accepted connection.
+func (g *Guard) admitSession(addr netip.Addr) bool {
+	if g == nil {
+		return true
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.inBackoff(addr) {
+		gnmiAdmissionDecision.WithLabelValues("session", "backoff").Inc()
+		return false
+	}
+	gnmiAdmissionDecision.WithLabelValues("session", "accepted").Inc()
+	return true
+}
+
+// rateLimited records that a session of addr exceeded the message rate.
+func (g *Guard) rateLimited(addr netip.Addr) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	d := g.offend(addr)
+	gnmiAdmissionDecision.WithLabelValues("session", "rate_limited").Inc()
+	log.Warningf("gNMI session from %s exceeded the message rate, rejecting it for %s", addr, d)
+}
+
+// sessionLimiter returns the message rate limiter for a new session, or nil
+// if messages are not limited.
+func (g *Guard) sessionLimiter() *rate.Limiter {
+	if g == nil || g.cfg.MessageRate <= 0 {
+		return nil
+	}
+	burst := g.cfg.MessageBurst
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(g.cfg.MessageRate), burst)
+}
+
+// Listener wraps l to drop connections the guard does not admit right after
+// accepting them.
+func (g *Guard) Listener(l net.Listener) net.Listener {
+	return &guardListener{Listener: l, g: g}
+}
+
+type guardListener struct {
+	net.Listener
+	g *Guard
+}
+
+func (l *guardListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr, ok := addrOf(c.RemoteAddr())
+		if !ok {
+			return c, nil
+		}
+		if d := l.g.admit(addr); d != "accepted" {
+			log.V(1).Infof("Dropping gNMI connection from %s: %s", addr, d)
+			c.Close()
+			continue
+		}
+		return &guardConn{Conn: c, release: func() { l.g.release(addr) }}, nil
+	}
+}
+
+type guardConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *guardConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGuardAdmit(t *testing.T) {
+	now := time.Unix(1720382350, 0)
+	g := NewGuard(GuardConfig{
+		Allow:             []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Deny:              []netip.Prefix{netip.MustParsePrefix("10.0.0.66/32")},
+		MaxConnsPerSource: 1,
+		Backoff:           time.Second,
+		MaxBackoff:        4 * time.Second,
+	})
+	g.now = func() time.Time { return now }
+	a := netip.MustParseAddr("10.0.0.1")
+
+	assert.Equal(t, "not_allowed", g.admit(netip.MustParseAddr("192.0.2.1")))
+	assert.Equal(t, "denied", g.admit(netip.MustParseAddr("10.0.0.66")))
+	assert.Equal(t, "accepted", g.admit(a))
+
+	// Every further connection is an offense that doubles the backoff, up
+	// to the maximum.
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		assert.Equal(t, "too_many_connections", g.admit(a), "offense %d", i)
+		now = now.Add(want - time.Millisecond)
+		assert.Equal(t, "backoff", g.admit(a), "offense %d", i)
+		now = now.Add(time.Millisecond)
+	}
+
+	g.release(a)
+	assert.Equal(t, "accepted", g.admit(a))
+	g.release(a)
+
+	// After behaving for longer than the maximum backoff, offenses start
+	// over.
+	assert.Equal(t, "accepted", g.admit(a))
+	now = now.Add(time.Minute)
+	assert.Equal(t, "too_many_connections", g.admit(a))
+	now = now.Add(time.Second)
+	assert.Equal(t, "accepted", g.admit(netip.MustParseAddr("10.0.0.2")))
+	g.release(a)
+	assert.Equal(t, "accepted", g.admit(a))
+}
+
+func TestGuardPrunesOffenders(t *testing.T) {
+	now := time.Unix(1720382350, 0)
+	g := NewGuard(GuardConfig{
+		MaxConnsPerSource: 1,
+		Backoff:           time.Second,
+		MaxBackoff:        4 * time.Second,
+	})
+	g.now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		a := netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})
+		assert.Equal(t, "accepted", g.admit(a))
+		assert.Equal(t, "too_many_connections", g.admit(a))
+		g.release(a)
+	}
+	assert.Len(t, g.offenders, 3)
+
+	// Offenders are forgotten once their offenses would start over.
+	now = now.Add(5*time.Second + time.Millisecond)
+	assert.Equal(t, "accepted", g.admit(netip.MustParseAddr("10.0.0.9")))
+	assert.Empty(t, g.offenders)
+}
+
+func startGuardedServer(t *testing.T, cfg GuardConfig) *Server {
+	t.Helper()
+	srv, err := NewServer(&Config{Port: 0, Guard: &cfg}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+	return srv
+}
+
+func TestGuardDeny(t *testing.T) {
+	srv := startGuardedServer(t, GuardConfig{
+		Deny: []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")},
+	})
+	before := testutil.ToFloat64(gnmiAdmissionDecision.WithLabelValues("accept", "denied"))
+
+	stream, err := pb.NewGNMIDialoutClient(connFrom(t, srv, "127.0.0.2")).Publish(context.Background())
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Less(t, before, testutil.ToFloat64(gnmiAdmissionDecision.WithLabelValues("accept", "denied")))
+
+	stream, _ = dialFrom(t, srv, "127.0.0.3")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.3") }, waitFor, tick)
+}
+
+func TestGuardMessageRate(t *testing.T) {
+	srv := startGuardedServer(t, GuardConfig{
+		MessageRate:  0.001,
+		MessageBurst: 1,
+		Backoff:      time.Hour,
+		MaxBackoff:   time.Hour,
+	})
+	before := testutil.ToFloat64(gnmiAdmissionDecision.WithLabelValues("session", "rate_limited"))
+
+	client := pb.NewGNMIDialoutClient(connFrom(t, srv, "127.0.0.4"))
+	stream, err := client.Publish(context.Background())
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, before+1, testutil.ToFloat64(gnmiAdmissionDecision.WithLabelValues("session", "rate_limited")))
+
+	// The offender is kept out, both on existing and on new connections.
+	stream, err = client.Publish(context.Background())
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	stream, err = pb.NewGNMIDialoutClient(connFrom(t, srv, "127.0.0.4")).Publish(context.Background())
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.False(t, probeSucceeds(srv, "127.0.0.4"))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// deviceIdentity returns the address the device reports for itself in the
+// device ID extension.
+func deviceIdentity(resp *gnmi.SubscribeResponse) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(deviceID(resp)))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// isUnixAddr returns whether a is the address of a unix domain socket peer,
+// which does not identify the device.
+func isUnixAddr(a net.Addr) bool {
+	return a != nil && strings.HasPrefix(a.Network(), "unix")
+}
+
+// replayStream returns a message that was already received before the ones
+// still on the stream.
+type replayStream struct {
+	pb.GNMIDialout_PublishServer
+	first *gnmi.SubscribeResponse
+}
+
+func (s *replayStream) Recv() (*gnmi.SubscribeResponse, error) {
+	if m := s.first; m != nil {
+		s.first = nil
+		return m, nil
+	}
+	return s.GNMIDialout_PublishServer.Recv()
+}
+
+// streamIdentity receives the first message of a session on a unix domain
+// socket to learn the device address from its device ID extension. The
+// returned stream yields that message again. A timeout of 0 waits forever.
+func streamIdentity(stream pb.GNMIDialout_PublishServer, timeout time.Duration) (netip.Addr, pb.GNMIDialout_PublishServer, error) {
+	type result struct {
+		m   *gnmi.SubscribeResponse
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		m, err := stream.Recv()
+		res <- result{m, err}
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case r := <-res:
+		if r.err != nil {
+			return netip.Addr{}, nil, grpc.Errorf(grpc.Code(r.err), "failed to receive the first message: %v", r.err)
+		}
+		addr, ok := deviceIdentity(r.m)
+		if !ok {
+			return netip.Addr{}, nil, grpc.Errorf(codes.InvalidArgument, "missing device address in extension %d", deviceIDExtension)
+		}
+		return addr, &replayStream{GNMIDialout_PublishServer: stream, first: r.m}, nil
+	case <-expired:
+		// Returning ends the stream, which makes Recv return as well.
+		return netip.Addr{}, nil, grpc.Errorf(codes.Unavailable, "no message received for %s", timeout)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	influxURL           = flag.String("influx-url", "", "base URL of an InfluxDB v2 server to write decoded updates to, e.g. http://localhost:8086")
+	influxOrg           = flag.String("influx-org", "", "InfluxDB organization to write to")
+	influxBucket        = flag.String("influx-bucket", "", "InfluxDB bucket to write to")
+	influxToken         = flag.String("influx-token", "", "InfluxDB API token")
+	influxFile          = flag.String("influx-file", "", "file to append decoded updates to in InfluxDB line protocol, instead of or in addition to -influx-url")
+	influxFlushInterval = flag.Duration("influx-flush-interval", 10*time.Second, "how often to flush buffered InfluxDB lines")
+	influxBatchSize     = flag.Int("influx-batch-size", 5000, "maximum number of lines to send to InfluxDB in one request")
+	influxBufferSize    = flag.Int("influx-buffer-size", 100000, "maximum number of lines to buffer before dropping updates")
+	influxMaxRetries    = flag.Int("influx-max-retries", 5, "how often to retry a failed InfluxDB write")
+)
+
+type InfluxConfig struct {
+	URL           string
+	Org           string
+	Bucket        string
+	Token         string
+	File          string
+	FlushInterval time.Duration
+	BatchSize     int
+	BufferSize    int
+	MaxRetries    int
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	Timeout       time.Duration
+}
+
+// InfluxWriter turns every decoded update into InfluxDB line protocol and
+// writes it in batches to an InfluxDB v2 server and/or a local file.
+type InfluxWriter struct {
+	cfg    InfluxConfig
+	client *http.Client
+	file   *os.File
+
+	lock  sync.Mutex
+	lines []string
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewInfluxWriter(cfg InfluxConfig) (*InfluxWriter, error) {
+	if cfg.URL == "" && cfg.File == "" {
+		return nil, fmt.Errorf("neither an InfluxDB URL nor a file given")
+	}
+	if cfg.URL != "" && cfg.Bucket == "" {
+		return nil, fmt.Errorf("no InfluxDB bucket given")
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 10 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 5000
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 100000
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	iw := &InfluxWriter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		kick:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", cfg.File, err)
+		}
+		iw.file = f
+	}
+	go iw.run()
+	return iw, nil
+}
+
+// Observe buffers u as a line for the next flush.
+func (iw *InfluxWriter) Observe(target string, u decodedUpdate) {
+	line, ok := influxLine(target, u)
+	if !ok {
+		return
+	}
+	iw.lock.Lock()
+	if len(iw.lines) >= iw.cfg.BufferSize {
+		iw.lock.Unlock()
+		log.Warningf("InfluxDB buffer is full, dropping update of %s from %q", u.Metric, target)
+		return
+	}
+	iw.lines = append(iw.lines, line)
+	full := len(iw.lines) >= iw.cfg.BatchSize
+	iw.lock.Unlock()
+	if full {
+		select {
+		case iw.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (iw *InfluxWriter) run() {
+	defer close(iw.done)
+	t := time.NewTicker(iw.cfg.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-iw.stop:
+			return
+		case <-t.C:
+		case <-iw.kick:
+		}
+		iw.flush()
+	}
+}
+
+// flush writes out everything buffered so far, one batch at a time.
+func (iw *InfluxWriter) flush() {
+	iw.lock.Lock()
+	lines := iw.lines
+	iw.lines = nil
+	iw.lock.Unlock()
+
+	for len(lines) > 0 {
+		n := min(len(lines), iw.cfg.BatchSize)
+		body := []byte(strings.Join(lines[:n], "\n") + "\n")
+		lines = lines[n:]
+		if iw.file != nil {
+			if _, err := iw.file.Write(body); err != nil {
+				log.Errorf("Failed to write %d lines to %s: %v", n, iw.cfg.File, err)
+			}
+		}
+		if iw.cfg.URL != "" {
+			iw.send(body, n)
+		}
+	}
+}
+
+// send writes a batch to InfluxDB, retrying with exponential backoff on
+// network errors, 5xx and 429 responses.
+func (iw *InfluxWriter) send(body []byte, n int) {
+	backoff := iw.cfg.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := iw.post(body)
+		if err == nil {
+			log.V(2).Infof("Wrote %d lines to InfluxDB", n)
+			return
+		}
+		if !retry || attempt >= iw.cfg.MaxRetries {
+			log.Errorf("Failed to write %d lines to InfluxDB, dropping them: %v", n, err)
+			return
+		}
+		log.Warningf("Failed to write to InfluxDB, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > iw.cfg.MaxBackoff {
+			backoff = iw.cfg.MaxBackoff
+		}
+	}
+}
+
+func (iw *InfluxWriter) post(body []byte) (bool, error) {
+	q := url.Values{}
+	q.Set("org", iw.cfg.Org)
+	q.Set("bucket", iw.cfg.Bucket)
+	q.Set("precision", "ns")
+	u := strings.TrimSuffix(iw.cfg.URL, "/") + "/api/v2/write?" + q.Encode()
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "dc908_exporter")
+	if iw.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+iw.cfg.Token)
+	}
+	resp, err := iw.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Close flushes all buffered lines and closes the output file, if any.
+func (iw *InfluxWriter) Close(ctx context.Context) error {
+	close(iw.stop)
+	<-iw.done
+	done := make(chan struct{})
+	go func() {
+		iw.flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("InfluxDB flush: %w", ctx.Err())
+	}
+	if iw.file != nil {
+		return iw.file.Close()
+	}
+	return nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxLine formats u as a line of InfluxDB line protocol. The metric
+// family is the measurement, the device address, component name and index
+// are tags and the instant value and statistics are fields.
+func influxLine(target string, u decodedUpdate) (string, bool) {
+	tags := map[string]string{"device": target}
+	for k, v := range u.Labels {
+		if k == "device" {
+			k = "component"
+		}
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(u.Metric))
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s=%s", influxTagEscaper.Replace(k), influxTagEscaper.Replace(tags[k]))
+	}
+	sep := byte(' ')
+	for _, f := range []struct {
+		name string
+		v    *float64
+	}{
+		{"instant", &u.Reading.Instant},
+		{"min", u.Reading.Min},
+		{"max", u.Reading.Max},
+		{"avg", u.Reading.Avg},
+	} {
+		if f.v == nil || math.IsNaN(*f.v) || math.IsInf(*f.v, 0) {
+			continue
+		}
+		b.WriteByte(sep)
+		b.WriteString(f.name)
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(*f.v, 'g', -1, 64))
+		sep = ','
+	}
+	if sep == ' ' {
+		return "", false
+	}
+	fmt.Fprintf(&b, " %d", u.Timestamp.UnixNano())
+	return b.String(), true
+}
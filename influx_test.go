@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fp(v float64) *float64 {
+	return &v
+}
+
+func TestInfluxLine(t *testing.T) {
+	ts := time.Unix(1720382350, 123)
+	var tests = []struct {
+		name   string
+		target string
+		u      decodedUpdate
+		want   string
+	}{
+		{
+			name:   "instant only",
+			target: "10.0.0.1",
+			u: decodedUpdate{
+				Metric:    "dc908_fan_rpm",
+				Labels:    map[string]string{"device": "FAN-1-33"},
+				Reading:   reading{Instant: 4500},
+				Timestamp: ts,
+			},
+			want: "dc908_fan_rpm,component=FAN-1-33,device=10.0.0.1 instant=4500 1720382350000000123",
+		},
+		{
+			name:   "statistics and empty index",
+			target: "10.0.0.1",
+			u: decodedUpdate{
+				Metric:    "dc908_laser_input_power_dbm",
+				Labels:    map[string]string{"device": "TRANSCEIVER-1-1-C1", "index": ""},
+				Reading:   reading{Instant: -0.5, Min: fp(-0.6), Max: fp(-0.4), Avg: fp(-0.5)},
+				Timestamp: ts,
+			},
+			want: "dc908_laser_input_power_dbm,component=TRANSCEIVER-1-1-C1,device=10.0.0.1 instant=-0.5,min=-0.6,max=-0.4,avg=-0.5 1720382350000000123",
+		},
+		{
+			name:   "index and escaping",
+			target: "10.0.0.1",
+			u: decodedUpdate{
+				Metric:    "dc908 laser,power",
+				Labels:    map[string]string{"device": "A=B C,D", "index": "1"},
+				Reading:   reading{Instant: 1.5e-7},
+				Timestamp: ts,
+			},
+			want: `dc908\ laser\,power,component=A\=B\ C\,D,device=10.0.0.1,index=1 instant=1.5e-07 1720382350000000123`,
+		},
+		{
+			name:   "non-finite statistics are skipped",
+			target: "10.0.0.1",
+			u: decodedUpdate{
+				Metric:    "dc908_temperature_celsius",
+				Labels:    map[string]string{"device": "MCU-1-1"},
+				Reading:   reading{Instant: 34.7, Max: fp(math.Inf(1))},
+				Timestamp: ts,
+			},
+			want: "dc908_temperature_celsius,component=MCU-1-1,device=10.0.0.1 instant=34.7 1720382350000000123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := influxLine(tt.target, tt.u)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, ok := influxLine("10.0.0.1", decodedUpdate{Metric: "x", Reading: reading{Instant: math.NaN()}})
+	assert.False(t, ok)
+}
+
+// influxReceiver is a minimal stand-in for the InfluxDB v2 write API.
+type influxReceiver struct {
+	lock   sync.Mutex
+	lines  []string
+	reqs   []*http.Request
+	status func() int
+}
+
+func (ir *influxReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if ir.status != nil {
+		if code := ir.status(); code != http.StatusNoContent {
+			w.WriteHeader(code)
+			return
+		}
+	}
+	ir.lock.Lock()
+	defer ir.lock.Unlock()
+	ir.reqs = append(ir.reqs, r)
+	ir.lines = append(ir.lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ir *influxReceiver) received() []string {
+	ir.lock.Lock()
+	defer ir.lock.Unlock()
+	return append([]string{}, ir.lines...)
+}
+
+func TestInfluxWriterHTTP(t *testing.T) {
+	assert := assert.New(t)
+	ir := &influxReceiver{}
+	hs := httptest.NewServer(ir)
+	defer hs.Close()
+
+	iw, err := NewInfluxWriter(InfluxConfig{
+		URL:           hs.URL,
+		Org:           "sonix",
+		Bucket:        "optics",
+		Token:         "s3cret",
+		FlushInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewInfluxWriter: %v", err)
+	}
+
+	mr := NewMetricRegistry()
+	mr.OnUpdate(func(u decodedUpdate) { iw.Observe("10.0.0.1", u) })
+	ts := time.Unix(1720382350, 0)
+	if err := mr.UpdateAt("/openconfig-platform:components/component[name=TRANSCEIVER-1-1-C1]/openconfig-platform-transceiver:transceiver/state", ts,
+		`{"input-power":{"instant":-0.5,"max":-0.4,"min":-0.6},"laser-bias-current":{"instant":55.5,"max":55.5,"min":55}}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+
+	assert.Eventually(func() bool { return len(ir.received()) == 2 }, waitFor, tick)
+	assert.ElementsMatch([]string{
+		"dc908_laser_input_power_dbm,component=TRANSCEIVER-1-1-C1,device=10.0.0.1 instant=-0.5,min=-0.6,max=-0.4 1720382350000000000",
+		"dc908_laser_bias_current_amepere,component=TRANSCEIVER-1-1-C1,device=10.0.0.1 instant=0.0555,min=0.055,max=0.0555 1720382350000000000",
+	}, ir.received())
+
+	ir.lock.Lock()
+	req := ir.reqs[0]
+	ir.lock.Unlock()
+	assert.Equal("/api/v2/write", req.URL.Path)
+	assert.Equal("sonix", req.URL.Query().Get("org"))
+	assert.Equal("optics", req.URL.Query().Get("bucket"))
+	assert.Equal("ns", req.URL.Query().Get("precision"))
+	assert.Equal("Token s3cret", req.Header.Get("Authorization"))
+
+	assert.NoError(iw.Close(context.Background()))
+}
+
+func TestInfluxWriterRetries(t *testing.T) {
+	var tests = []struct {
+		name     string
+		code     int
+		attempts int32
+		received int
+	}{
+		{"server error is retried", http.StatusServiceUnavailable, 3, 1},
+		{"rate limit is retried", http.StatusTooManyRequests, 3, 1},
+		{"client error is not retried", http.StatusBadRequest, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			ir := &influxReceiver{status: func() int {
+				if attempts.Add(1) < 3 {
+					return tt.code
+				}
+				return http.StatusNoContent
+			}}
+			hs := httptest.NewServer(ir)
+			defer hs.Close()
+
+			iw, err := NewInfluxWriter(InfluxConfig{
+				URL:           hs.URL,
+				Bucket:        "optics",
+				FlushInterval: time.Hour,
+				MaxRetries:    5,
+				MinBackoff:    time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewInfluxWriter: %v", err)
+			}
+			iw.Observe("10.0.0.1", decodedUpdate{Metric: "dc908_fan_rpm", Reading: reading{Instant: 1}, Timestamp: time.Now()})
+			assert.NoError(t, iw.Close(context.Background()))
+			assert.Equal(t, tt.attempts, attempts.Load())
+			assert.Len(t, ir.received(), tt.received)
+		})
+	}
+}
+
+func TestInfluxWriterBufferLimit(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "dc908.lp")
+	iw, err := NewInfluxWriter(InfluxConfig{File: fn, FlushInterval: time.Hour, BufferSize: 2})
+	if err != nil {
+		t.Fatalf("NewInfluxWriter: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		iw.Observe("10.0.0.1", decodedUpdate{Metric: "dc908_fan_rpm", Reading: reading{Instant: float64(i)}, Timestamp: time.Now()})
+	}
+	assert.NoError(t, iw.Close(context.Background()))
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	assert.Equal(t, 2, strings.Count(string(d), "\n"))
+}
+
+func TestInfluxWriterFromSession(t *testing.T) {
+	assert := assert.New(t)
+	fn := filepath.Join(t.TempDir(), "dc908.lp")
+	iw, err := NewInfluxWriter(InfluxConfig{File: fn, FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewInfluxWriter: %v", err)
+	}
+	defer iw.Close(context.Background())
+
+	srv := startServer(t)
+	srv.AddObserver(iw)
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/mcu.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	assert.Eventually(func() bool {
+		d, _ := os.ReadFile(fn)
+		return strings.Contains(string(d), "dc908_temperature_celsius,component=MCU-1-41,device=127.0.0.1 instant=34.7,min=34.3,max=34.8 ")
+	}, waitFor, tick)
+}
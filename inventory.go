@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// componentInventory is the inventory part of the state of a component.
+type componentInventory struct {
+	Type            string `json:"type"`
+	Description     string `json:"description"`
+	PartNo          string `json:"part-no"`
+	SerialNo        string `json:"serial-no"`
+	MfgName         string `json:"mfg-name"`
+	HardwareVersion string `json:"hardware-version"`
+	FirmwareVersion string `json:"firmware-version"`
+	SoftwareVersion string `json:"software-version"`
+	OperStatus      string `json:"oper-status"`
+	Removable       *bool  `json:"removable"`
+}
+
+// operStatuses are the values of the OpenConfig COMPONENT_OPER_STATUS
+// identity, which are always exported for a component with an oper-status.
+var operStatuses = []string{"ACTIVE", "INACTIVE", "DISABLED"}
+
+var componentInfoLabels = []string{
+	"device",
+	"type",
+	"description",
+	"part_no",
+	"serial_no",
+	"mfg_name",
+	"hardware_version",
+	"firmware_version",
+	"software_version",
+	"removable",
+}
+
+// stripModule removes the YANG module prefix from an identity reference.
+func stripModule(s string) string {
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
+
+func (ci componentInventory) infoLabels(name string) prometheus.Labels {
+	removable := ""
+	if ci.Removable != nil {
+		removable = strconv.FormatBool(*ci.Removable)
+	}
+	return prometheus.Labels{
+		"device":           name,
+		"type":             stripModule(ci.Type),
+		"description":      ci.Description,
+		"part_no":          ci.PartNo,
+		"serial_no":        ci.SerialNo,
+		"mfg_name":         ci.MfgName,
+		"hardware_version": ci.HardwareVersion,
+		"firmware_version": ci.FirmwareVersion,
+		"software_version": ci.SoftwareVersion,
+		"removable":        removable,
+	}
+}
+
+func (ci componentInventory) equal(o componentInventory) bool {
+	a, b := ci.Removable, o.Removable
+	ci.Removable, o.Removable = nil, nil
+	if ci != o {
+		return false
+	}
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// exportInventory exports the inventory of a component as info and
+// oper-status metrics, replacing what was exported before.
+func (m *metricRegistry) exportInventory(name string, ci componentInventory) {
+	m.componentInfo.DeletePartialMatch(prometheus.Labels{"device": name})
+	m.componentInfo.With(ci.infoLabels(name)).Set(1)
+
+	m.componentOperStatus.DeletePartialMatch(prometheus.Labels{"device": name})
+	if ci.OperStatus == "" {
+		return
+	}
+	status := stripModule(ci.OperStatus)
+	known := false
+	for _, s := range operStatuses {
+		v := 0.0
+		if s == status {
+			v = 1
+			known = true
+		}
+		m.componentOperStatus.With(prometheus.Labels{"device": name, "status": s}).Set(v)
+	}
+	if !known {
+		m.componentOperStatus.With(prometheus.Labels{"device": name, "status": status}).Set(1)
+	}
+}
+
+// partNumber returns the part number last reported for a component.
+func (m *metricRegistry) partNumber(name string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.inventory[name].PartNo
+}
+
+// chassis returns the inventory of the chassis component, if known.
+func (m *metricRegistry) chassis() (componentInventory, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, ci := range m.inventory {
+		if stripModule(ci.Type) == "CHASSIS" {
+			return ci, true
+		}
+	}
+	return componentInventory{}, false
+}
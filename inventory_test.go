@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestComponentInventory(t *testing.T) {
+	mr := NewMetricRegistry()
+	update := func(j string) {
+		t.Helper()
+		if err := mr.UpdateAt("/openconfig-platform:components/component[name=TRANSCEIVER-1-1-C1]/state", time.Now(), j); err != nil {
+			t.Fatalf("UpdateAt: %v", err)
+		}
+	}
+	names := []string{"dc908_component_info", "dc908_component_oper_status"}
+
+	// Updates without inventory do not export anything.
+	update(`{"temperature":{"instant":40.7}}`)
+	if err := testutil.GatherAndCompare(mr.PrometheusRegistry(), strings.NewReader(""), names...); err != nil {
+		t.Errorf("metric compare: err %v", err)
+	}
+
+	var tests = []struct {
+		name string
+		json string
+		em   string
+	}{
+		{"full state", `{"type":"openconfig-platform-types:TRANSCEIVER","description":"100G QSFP28","part-no":"34061234","serial-no":"ABC123","mfg-name":"HUAWEI","hardware-version":"A","firmware-version":"1.2","software-version":"","oper-status":"openconfig-platform-types:ACTIVE","removable":true,"temperature":{"instant":40.7}}`, `
+# HELP dc908_component_info Inventory information of a component.
+# TYPE dc908_component_info gauge
+dc908_component_info{description="100G QSFP28",device="TRANSCEIVER-1-1-C1",firmware_version="1.2",hardware_version="A",mfg_name="HUAWEI",part_no="34061234",removable="true",serial_no="ABC123",software_version="",type="TRANSCEIVER"} 1
+# HELP dc908_component_oper_status Operational status of a component, 1 for the current status.
+# TYPE dc908_component_oper_status gauge
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="ACTIVE"} 1
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="DISABLED"} 0
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="INACTIVE"} 0
+`},
+		{"partial update keeps the rest", `{"oper-status":"openconfig-platform-types:INACTIVE"}`, `
+# HELP dc908_component_info Inventory information of a component.
+# TYPE dc908_component_info gauge
+dc908_component_info{description="100G QSFP28",device="TRANSCEIVER-1-1-C1",firmware_version="1.2",hardware_version="A",mfg_name="HUAWEI",part_no="34061234",removable="true",serial_no="ABC123",software_version="",type="TRANSCEIVER"} 1
+# HELP dc908_component_oper_status Operational status of a component, 1 for the current status.
+# TYPE dc908_component_oper_status gauge
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="ACTIVE"} 0
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="DISABLED"} 0
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="INACTIVE"} 1
+`},
+		{"module swap replaces the info", `{"part-no":"34069999","serial-no":"XYZ789","firmware-version":"1.3","oper-status":"openconfig-platform-types:ACTIVE"}`, `
+# HELP dc908_component_info Inventory information of a component.
+# TYPE dc908_component_info gauge
+dc908_component_info{description="100G QSFP28",device="TRANSCEIVER-1-1-C1",firmware_version="1.3",hardware_version="A",mfg_name="HUAWEI",part_no="34069999",removable="true",serial_no="XYZ789",software_version="",type="TRANSCEIVER"} 1
+# HELP dc908_component_oper_status Operational status of a component, 1 for the current status.
+# TYPE dc908_component_oper_status gauge
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="ACTIVE"} 1
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="DISABLED"} 0
+dc908_component_oper_status{device="TRANSCEIVER-1-1-C1",status="INACTIVE"} 0
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update(tt.json)
+			if err := testutil.GatherAndCompare(mr.PrometheusRegistry(), strings.NewReader(tt.em), names...); err != nil {
+				t.Errorf("metric compare: err %v", err)
+			}
+		})
+	}
+}
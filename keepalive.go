@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	log "github.com/golang/glog"
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+)
+
+var (
+	gnmiKeepaliveTime     = flag.Duration("gnmi-keepalive-time", 30*time.Second, "how long a gNMI connection may be idle before it is pinged")
+	gnmiKeepaliveTimeout  = flag.Duration("gnmi-keepalive-timeout", 10*time.Second, "how long to wait for the answer to a ping before closing a gNMI connection")
+	gnmiKeepaliveMinTime  = flag.Duration("gnmi-keepalive-min-time", 10*time.Second, "minimum interval devices may send pings in, connections of devices pinging more often are closed")
+	gnmiMaxRecvMsgSize    = flag.Int("gnmi-max-recv-msg-size", 16*1024*1024, "maximum size of a gNMI message in bytes")
+	gnmiHeartbeatInterval = flag.Duration("gnmi-heartbeat-interval", 10*time.Second, "heartbeat interval configured on the devices")
+	gnmiIdleHeartbeats    = flag.Int("gnmi-idle-heartbeats", 0, "number of heartbeat intervals without any message after which a gNMI session is closed, 0 to never close idle sessions")
+)
+
+// keepaliveOptions returns the gRPC server options for keepalive enforcement
+// and message size configured on the command line.
+func keepaliveOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    *gnmiKeepaliveTime,
+			Timeout: *gnmiKeepaliveTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             *gnmiKeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+		grpc.MaxRecvMsgSize(*gnmiMaxRecvMsgSize),
+	}
+}
+
+// idleTimeoutFromFlags returns after how long without messages a session is
+// closed, or 0 if sessions are never closed for being idle.
+func idleTimeoutFromFlags() time.Duration {
+	if *gnmiIdleHeartbeats <= 0 {
+		return 0
+	}
+	return time.Duration(*gnmiIdleHeartbeats) * *gnmiHeartbeatInterval
+}
+
+// lastActivity returns when the client last sent a message, or connected if
+// it did not send any yet.
+func (c *Client) lastActivity() time.Time {
+	if lu := c.lastUpdate.Load(); lu != 0 {
+		return time.Unix(0, lu)
+	}
+	return c.connected
+}
+
+// runWithIdleTimeout runs the client until its stream ends, the server
+// drains or, if timeout is positive, it does not send any message for timeout.
+func (c *Client) runWithIdleTimeout(srv *Server, target string, stream pb.GNMIDialout_PublishServer, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(srv, target, stream) }()
+
+	var idleC <-chan time.Time
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.NewTimer(timeout)
+		defer timer.Stop()
+		idleC = timer.C
+	}
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-srv.drained:
+			// Returning ends the stream, which makes Run return as well.
+			c.stop()
+			return grpc.Errorf(codes.Unavailable, "server is shutting down")
+		case <-idleC:
+			idle := time.Since(c.lastActivity())
+			if idle >= timeout {
+				log.Warningf("No message from %q for %s, closing the gNMI session", target, idle.Round(time.Second))
+				// Returning ends the stream, which makes Run return as well.
+				c.stop()
+				return grpc.Errorf(codes.Unavailable, "no message received for %s", idle.Round(time.Second))
+			}
+			timer.Reset(timeout - idle)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	srv, err := NewServer(&Config{Port: 0, IdleTimeout: 300 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	start := time.Now()
+	// Messages keep the session alive beyond the idle timeout.
+	for i := 0; i < 4; i++ {
+		if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, probeSucceeds(srv, "127.0.0.1"))
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Greater(t, time.Since(start), 600*time.Millisecond)
+	assert.Eventually(t, func() bool { return !probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+
+	// The device can reconnect right away.
+	stream, _ = dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+}
+
+func TestStoppedClientIgnoresMessages(t *testing.T) {
+	mr := NewMetricRegistry()
+	c := NewClient(nil, mr)
+	c.stop()
+	assert.Error(t, c.handle(&Server{}, "127.0.0.1", readTestdata(t, "testdata/fan.textpb")))
+	assert.Zero(t, c.messages.Load())
+	samples, err := mr.Samples()
+	assert.NoError(t, err)
+	assert.Empty(t, samples)
+}
+
+func TestIdleTimeoutFromFlags(t *testing.T) {
+	defer func(hb time.Duration, n int) { *gnmiHeartbeatInterval, *gnmiIdleHeartbeats = hb, n }(*gnmiHeartbeatInterval, *gnmiIdleHeartbeats)
+	*gnmiHeartbeatInterval = 10 * time.Second
+	*gnmiIdleHeartbeats = 3
+	assert.Equal(t, 30*time.Second, idleTimeoutFromFlags())
+	*gnmiIdleHeartbeats = 0
+	assert.Equal(t, time.Duration(0), idleTimeoutFromFlags())
+}
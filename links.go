@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	linkConfig = flag.String("link-config", "", "path to a YAML file pairing line ports of DC908s to export span loss for on /links")
+)
+
+type LinkConfig struct {
+	Links []Link `yaml:"links"`
+}
+
+type LinkEndpoint struct {
+	Device string `yaml:"device"`
+	Port   string `yaml:"port"`
+}
+
+// Link is a fibre between the line ports of two DC908s.
+type Link struct {
+	Name string       `yaml:"name"`
+	A    LinkEndpoint `yaml:"a"`
+	B    LinkEndpoint `yaml:"b"`
+	// BaselineDB is the expected span loss in both directions, the per
+	// direction baselines take precedence.
+	BaselineDB     *float64 `yaml:"baseline_db"`
+	BaselineAToBDB *float64 `yaml:"baseline_a_to_b_db"`
+	BaselineBToADB *float64 `yaml:"baseline_b_to_a_db"`
+}
+
+// LoadLinkConfig reads a link configuration file.
+func LoadLinkConfig(fn string) (*LinkConfig, error) {
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &LinkConfig{}
+	if err := yaml.Unmarshal(d, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", fn, err)
+	}
+	names := make(map[string]bool)
+	for i := range cfg.Links {
+		l := &cfg.Links[i]
+		if l.Name == "" {
+			return nil, fmt.Errorf("link %d has no name", i)
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("duplicate link %s", l.Name)
+		}
+		names[l.Name] = true
+		for _, ep := range []*LinkEndpoint{&l.A, &l.B} {
+			if ep.Device == "" || ep.Port == "" {
+				return nil, fmt.Errorf("link %s: both ends need a device and a port", l.Name)
+			}
+			// Devices are looked up by the address their session is
+			// registered under.
+			ep.Device = normalizeTarget(ep.Device)
+		}
+	}
+	return cfg, nil
+}
+
+// linkDirection is one direction of a link, from the transmitting to the
+// receiving port.
+type linkDirection struct {
+	link      string
+	direction string
+	from, to  LinkEndpoint
+	baseline  *float64
+}
+
+func (l *Link) directions() []linkDirection {
+	pick := func(specific *float64) *float64 {
+		if specific != nil {
+			return specific
+		}
+		return l.BaselineDB
+	}
+	return []linkDirection{
+		{l.Name, "a_to_b", l.A, l.B, pick(l.BaselineAToBDB)},
+		{l.Name, "b_to_a", l.B, l.A, pick(l.BaselineBToADB)},
+	}
+}
+
+var (
+	linkLabels         = []string{"link", "direction", "from_device", "from_port", "to_device", "to_port"}
+	linkSpanLossDesc   = prometheus.NewDesc("dc908_link_span_loss_db", "Span loss between the transmitting and receiving line port", linkLabels, nil)
+	linkBaselineDesc   = prometheus.NewDesc("dc908_link_span_loss_baseline_db", "Configured expected span loss", linkLabels, nil)
+	linkDeviationDesc  = prometheus.NewDesc("dc908_link_span_loss_deviation_db", "Span loss above the configured baseline", linkLabels, nil)
+	linkPowerKnownDesc = prometheus.NewDesc("dc908_link_power_known", "Whether the power of both ends of the link direction is known", linkLabels, nil)
+)
+
+// LinkCollector derives the span loss of configured links from the laser
+// power reported by the connected devices at scrape time.
+type LinkCollector struct {
+	srv *Server
+	cfg *LinkConfig
+}
+
+func NewLinkCollector(srv *Server, cfg *LinkConfig) *LinkCollector {
+	return &LinkCollector{srv: srv, cfg: cfg}
+}
+
+func (lc *LinkCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- linkSpanLossDesc
+	ch <- linkBaselineDesc
+	ch <- linkDeviationDesc
+	ch <- linkPowerKnownDesc
+}
+
+// portPower returns the power of the given port of target as reported by
+// the metric named name.
+func portPower(samples map[string][]sample, target string, port string, name string) (float64, bool) {
+	for _, s := range samples[target] {
+		if s.Name == name && s.Labels["device"] == port && s.Labels["index"] == "" {
+			return s.Value, true
+		}
+	}
+	return 0, false
+}
+
+func (lc *LinkCollector) Collect(ch chan<- prometheus.Metric) {
+	regs := lc.srv.registries()
+	samples := make(map[string][]sample)
+	for target, mr := range regs {
+		s, err := mr.Samples()
+		if err != nil {
+			log.Warningf("Failed to gather samples of %q for links: %v", target, err)
+			continue
+		}
+		samples[target] = s
+	}
+
+	for i := range lc.cfg.Links {
+		for _, d := range lc.cfg.Links[i].directions() {
+			labels := []string{d.link, d.direction, d.from.Device, d.from.Port, d.to.Device, d.to.Port}
+			if d.baseline != nil {
+				ch <- prometheus.MustNewConstMetric(linkBaselineDesc, prometheus.GaugeValue, *d.baseline, labels...)
+			}
+			tx, txOK := portPower(samples, d.from.Device, d.from.Port, "dc908_laser_output_power_dbm")
+			rx, rxOK := portPower(samples, d.to.Device, d.to.Port, "dc908_laser_input_power_dbm")
+			if !txOK || !rxOK {
+				ch <- prometheus.MustNewConstMetric(linkPowerKnownDesc, prometheus.GaugeValue, 0, labels...)
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(linkPowerKnownDesc, prometheus.GaugeValue, 1, labels...)
+			loss := tx - rx
+			ch <- prometheus.MustNewConstMetric(linkSpanLossDesc, prometheus.GaugeValue, loss, labels...)
+			if d.baseline != nil {
+				ch <- prometheus.MustNewConstMetric(linkDeviationDesc, prometheus.GaugeValue, loss-*d.baseline, labels...)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func lineRegistry(t *testing.T, port string, in string, out string) *metricRegistry {
+	t.Helper()
+	mr := NewMetricRegistry()
+	if err := mr.UpdateAt("/openconfig-platform:components/component[name="+port+"]/openconfig-platform-transceiver:transceiver/state", time.Now(),
+		`{"input-power":{"instant":`+in+`},"output-power":{"instant":`+out+`}}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+	return mr
+}
+
+func TestLinkCollector(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "links.yaml")
+	if err := os.WriteFile(fn, []byte(`
+links:
+  - name: sto1-sto2
+    a: {device: 10.0.0.1, port: OCH-1-1-L1}
+    b: {device: "::ffff:10.0.0.2", port: OCH-1-1-L1}
+    baseline_db: 14
+    baseline_b_to_a_db: 15
+  - name: sto1-sto3
+    a: {device: 10.0.0.1, port: OCH-1-1-L2}
+    b: {device: 10.0.0.3, port: OCH-1-1-L1}
+`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg, err := LoadLinkConfig(fn)
+	if err != nil {
+		t.Fatalf("LoadLinkConfig: %v", err)
+	}
+
+	srv := &Server{clients: map[string]*Client{
+		"10.0.0.1": NewClient(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, lineRegistry(t, "OCH-1-1-L1", "-16.5", "0.5")),
+		"10.0.0.2": NewClient(&net.TCPAddr{IP: net.ParseIP("10.0.0.2")}, lineRegistry(t, "OCH-1-1-L1", "-14.5", "-1")),
+	}}
+
+	em := `
+# HELP dc908_link_power_known Whether the power of both ends of the link direction is known
+# TYPE dc908_link_power_known gauge
+dc908_link_power_known{direction="a_to_b",from_device="10.0.0.1",from_port="OCH-1-1-L1",link="sto1-sto2",to_device="10.0.0.2",to_port="OCH-1-1-L1"} 1
+dc908_link_power_known{direction="a_to_b",from_device="10.0.0.1",from_port="OCH-1-1-L2",link="sto1-sto3",to_device="10.0.0.3",to_port="OCH-1-1-L1"} 0
+dc908_link_power_known{direction="b_to_a",from_device="10.0.0.2",from_port="OCH-1-1-L1",link="sto1-sto2",to_device="10.0.0.1",to_port="OCH-1-1-L1"} 1
+dc908_link_power_known{direction="b_to_a",from_device="10.0.0.3",from_port="OCH-1-1-L1",link="sto1-sto3",to_device="10.0.0.1",to_port="OCH-1-1-L2"} 0
+# HELP dc908_link_span_loss_baseline_db Configured expected span loss
+# TYPE dc908_link_span_loss_baseline_db gauge
+dc908_link_span_loss_baseline_db{direction="a_to_b",from_device="10.0.0.1",from_port="OCH-1-1-L1",link="sto1-sto2",to_device="10.0.0.2",to_port="OCH-1-1-L1"} 14
+dc908_link_span_loss_baseline_db{direction="b_to_a",from_device="10.0.0.2",from_port="OCH-1-1-L1",link="sto1-sto2",to_device="10.0.0.1",to_port="OCH-1-1-L1"} 15
+# HELP dc908_link_span_loss_db Span loss between the transmitting and receiving line port
+# TYPE dc908_link_span_loss_db gauge
+dc908_link_span_loss_db{direction="a_to_b",from_device="10.0.0.1",from_port="OCH-1-1-L1",link="sto1-sto2",to_device="10.0.0.2",to_port="OCH-1-1-L1"} 15
+dc908_link_span_loss_db{direction="b_to_a",from_device="10.0.0.2",from_port="OCH-1-1-L1",link="sto1-sto2",to_device="10.0.0.1",to_port="OCH-1-1-L1"} 15.5
+# HELP dc908_link_span_loss_deviation_db Span loss above the configured baseline
+# TYPE dc908_link_span_loss_deviation_db gauge
+dc908_link_span_loss_deviation_db{direction="a_to_b",from_device="10.0.0.1",from_port="OCH-1-1-L1",link="sto1-sto2",to_device="10.0.0.2",to_port="OCH-1-1-L1"} 1
+dc908_link_span_loss_deviation_db{direction="b_to_a",from_device="10.0.0.2",from_port="OCH-1-1-L1",link="sto1-sto2",to_device="10.0.0.1",to_port="OCH-1-1-L1"} 0.5
+`
+	if err := testutil.CollectAndCompare(NewLinkCollector(srv, cfg), strings.NewReader(em)); err != nil {
+		t.Errorf("metric compare: err %v", err)
+	}
+}
+
+func TestLoadLinkConfigErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{"missing name", "links: [{a: {device: x, port: y}, b: {device: x, port: y}}]", "has no name"},
+		{"missing port", "links: [{name: l, a: {device: x}, b: {device: x, port: y}}]", "need a device and a port"},
+		{"duplicate name", "links: [{name: l, a: {device: x, port: y}, b: {device: x, port: z}}, {name: l, a: {device: x, port: z}, b: {device: x, port: y}}]", "duplicate link l"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "links.yaml")
+			if err := os.WriteFile(fn, []byte(tt.cfg), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			_, err := LoadLinkConfig(fn)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
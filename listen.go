@@ -0,0 +1,268 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	gnmiListenAddresses   = flag.String("gnmi-listen-addresses", "", "comma separated addresses to listen for gNMI connections on, e.g. 192.0.2.1,[2001:db8::1]:8888,unix:///run/dc908/gnmi.sock,systemd:gnmi, all addresses on -gnmi-port if empty")
+	metricListenAddresses = flag.String("metric-listen-addresses", "", "comma separated addresses to listen for HTTP requests on, all addresses on -metric-port if empty")
+)
+
+const (
+	// unixPrefix marks a listen address as the path of a unix domain socket.
+	unixPrefix = "unix://"
+	// systemdPrefix marks a listen address as the name of sockets passed by
+	// systemd socket activation, see sd_listen_fds(3).
+	systemdPrefix = "systemd:"
+)
+
+// listenAddresses parses a comma separated list of listen addresses, using
+// port for the entries without one. An empty list listens on all addresses.
+func listenAddresses(list string, port int) []string {
+	p := strconv.Itoa(port)
+	var res []string
+	for _, a := range strings.Split(list, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if strings.HasPrefix(a, unixPrefix) || strings.HasPrefix(a, systemdPrefix) {
+			res = append(res, a)
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(strings.Trim(a, "[]"), p)
+		}
+		res = append(res, a)
+	}
+	if len(res) == 0 {
+		res = []string{net.JoinHostPort("", p)}
+	}
+	return res
+}
+
+// listenAll listens on all addresses, closing the listeners already opened if
+// one of them fails.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	var res []net.Listener
+	for _, a := range addrs {
+		lis, err := listen(a)
+		if err != nil {
+			for _, l := range res {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %v", a, err)
+		}
+		res = append(res, lis...)
+	}
+	return res, nil
+}
+
+func listen(addr string) ([]net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		lis, err := listenUnix(path)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lis}, nil
+	}
+	if name, ok := strings.CutPrefix(addr, systemdPrefix); ok {
+		return systemdListeners(name)
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{lis}, nil
+}
+
+// listenUnix listens on a unix domain socket, replacing a socket left behind
+// by a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty unix socket path")
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+var activation struct {
+	once      sync.Once
+	lock      sync.Mutex
+	listeners map[string][]net.Listener
+	err       error
+}
+
+// systemdListeners returns the sockets passed by systemd with the given
+// FileDescriptorName. Each socket is only handed out once.
+func systemdListeners(name string) ([]net.Listener, error) {
+	activation.once.Do(func() {
+		activation.listeners, activation.err = activatedListeners(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), listenFdsStart)
+		// Do not pass the sockets on to child processes.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if activation.err != nil {
+		return nil, activation.err
+	}
+	activation.lock.Lock()
+	defer activation.lock.Unlock()
+	lis, ok := activation.listeners[name]
+	if !ok {
+		return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+	}
+	delete(activation.listeners, name)
+	return lis, nil
+}
+
+// activatedListeners turns the file descriptors passed by systemd into
+// listeners grouped by name, following the LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES protocol. Sockets without a name are named "unknown" like
+// sd_listen_fds_with_names(3) does.
+func activatedListeners(pid, fds, names string, start int) (map[string][]net.Listener, error) {
+	res := make(map[string][]net.Listener)
+	if pid == "" || fds == "" {
+		return res, nil
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		// The sockets are meant for another process.
+		return res, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(start+i), name)
+		lis, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ls := range res {
+				for _, l := range ls {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("socket %d (%s) passed by systemd: %v", start+i, name, err)
+		}
+		res[name] = append(res[name], lis)
+	}
+	return res, nil
+}
+
+// normalizeTarget returns the canonical form of a device address, so that
+// e.g. IPv4-mapped IPv6 addresses identify the same device as plain IPv4
+// addresses. Anything that is not an IP address is returned as is.
+func normalizeTarget(s string) string {
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return s
+	}
+	return a.Unmap().String()
+}
+
+// multiListener accepts connections from several listeners.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	c   net.Conn
+	err error
+}
+
+func newMultiListener(listeners []net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	ml := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ml.serve(l)
+	}
+	return ml
+}
+
+func (ml *multiListener) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		select {
+		case ml.accepted <- acceptResult{c, err}:
+		case <-ml.done:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.accepted:
+		return r.c, r.err
+	case <-ml.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *multiListener) Close() error {
+	var err error
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		for _, l := range ml.listeners {
+			if cerr := l.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all listeners.
+func (ml *multiListener) Addrs() []net.Addr {
+	res := make([]net.Addr, len(ml.listeners))
+	for i, l := range ml.listeners {
+		res[i] = l.Addr()
+	}
+	return res
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/openconfig/gnmi/proto/gnmi_ext"
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestListenAddresses(t *testing.T) {
+	var tests = []struct {
+		list string
+		want []string
+	}{
+		{"", []string{":8888"}},
+		{"192.0.2.1", []string{"192.0.2.1:8888"}},
+		{"192.0.2.1:9999, 2001:db8::1,[2001:db8::2]", []string{"192.0.2.1:9999", "[2001:db8::1]:8888", "[2001:db8::2]:8888"}},
+		{"[2001:db8::1]:9999,", []string{"[2001:db8::1]:9999"}},
+		{"unix:///run/gnmi.sock,systemd:gnmi", []string{"unix:///run/gnmi.sock", "systemd:gnmi"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, listenAddresses(tt.list, 8888), tt.list)
+	}
+}
+
+func TestNormalizeTarget(t *testing.T) {
+	var tests = []struct {
+		target string
+		want   string
+	}{
+		{"10.0.0.1", "10.0.0.1"},
+		{"::ffff:10.0.0.1", "10.0.0.1"},
+		{"2001:DB8::1", "2001:db8::1"},
+		{"dc908.example.com", "dc908.example.com"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, normalizeTarget(tt.target), tt.target)
+	}
+}
+
+// publishTo opens a Publish stream to addr from src and sends the fan test
+// data.
+func publishTo(t *testing.T, addr string, src string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := pb.NewGNMIDialoutClient(connTo(t, addr, src)).Publish(ctx)
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+func TestMultipleListenAddresses(t *testing.T) {
+	srv, err := NewServer(&Config{Addresses: []string{"127.0.0.1:0", "[::1]:0"}}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	addrs := srv.Addresses()
+	if !assert.Len(t, addrs, 2) {
+		return
+	}
+	publishTo(t, addrs[0], "127.0.0.1")
+	publishTo(t, addrs[1], "::1")
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") && probeSucceeds(srv, "::1") }, waitFor, tick)
+	assert.True(t, probeSucceeds(srv, "0:0:0:0:0:0:0:1"))
+	var targets []string
+	for _, s := range srv.Sessions() {
+		targets = append(targets, s.Target)
+	}
+	assert.ElementsMatch(t, []string{"127.0.0.1", "::1"}, targets)
+}
+
+func TestDualStackListener(t *testing.T) {
+	srv, err := NewServer(&Config{Addresses: []string{"[::]:0"}}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+
+	_, port, _ := net.SplitHostPort(srv.Address())
+	publishTo(t, net.JoinHostPort("127.0.0.1", port), "127.0.0.1")
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+	assert.True(t, probeSucceeds(srv, "::ffff:127.0.0.1"))
+	if s := srv.Sessions(); assert.Len(t, s, 1) {
+		assert.Equal(t, "127.0.0.1", s[0].Target)
+	}
+
+	// Another device reaching the same listener over IPv6 is told apart.
+	publishTo(t, net.JoinHostPort("::1", port), "::1")
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "::1") }, waitFor, tick)
+}
+
+// passFd returns a duplicate of the file descriptor of a new TCP listener, as
+// if it was passed by systemd.
+func passFd(t *testing.T) (int, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("Dup: %v", err)
+	}
+	return fd, l.Addr().String()
+}
+
+func TestActivatedListeners(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	lis, err := activatedListeners("1", "1", "gnmi", listenFdsStart)
+	assert.NoError(t, err)
+	assert.Empty(t, lis, "sockets of another process")
+
+	_, err = activatedListeners(pid, "x", "", listenFdsStart)
+	assert.Error(t, err)
+
+	fd, addr := passFd(t)
+	lis, err = activatedListeners(pid, "1", "gnmi", fd)
+	if assert.NoError(t, err) && assert.Len(t, lis["gnmi"], 1) {
+		assert.Equal(t, addr, lis["gnmi"][0].Addr().String())
+		lis["gnmi"][0].Close()
+	}
+
+	fd, _ = passFd(t)
+	lis, err = activatedListeners(pid, "1", "", fd)
+	if assert.NoError(t, err) && assert.Len(t, lis["unknown"], 1) {
+		lis["unknown"][0].Close()
+	}
+}
+
+// withIdentity replaces the device ID extension of m, removing it if addr is
+// empty.
+func withIdentity(m *gnmi.SubscribeResponse, addr string) *gnmi.SubscribeResponse {
+	m.Extension = nil
+	if addr != "" {
+		m.Extension = []*gnmi_ext.Extension{{Ext: &gnmi_ext.Extension_RegisteredExt{
+			RegisteredExt: &gnmi_ext.RegisteredExtension{Id: deviceIDExtension, Msg: []byte(addr)},
+		}}}
+	}
+	return m
+}
+
+// publishUnix opens a Publish stream on the unix domain socket at path.
+func publishUnix(t *testing.T, path string) pb.GNMIDialout_PublishClient {
+	t.Helper()
+	conn, err := grpc.NewClient("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := pb.NewGNMIDialoutClient(conn).Publish(ctx)
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	return stream
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gnmi.sock")
+	// A socket left behind by a previous run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv, err := NewServer(&Config{Addresses: []string{unixPrefix + path}}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+	assert.Equal(t, path, srv.Address())
+
+	stream := publishUnix(t, path)
+	if err := stream.Send(withIdentity(readTestdata(t, "testdata/fan.textpb"), "::ffff:192.0.2.7")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "192.0.2.7") }, waitFor, tick)
+	if s := srv.Sessions(); assert.Len(t, s, 1) {
+		assert.Equal(t, "192.0.2.7", s[0].Target)
+	}
+
+	// Without the extension the device is unknown.
+	stream = publishUnix(t, path)
+	if err := stream.Send(withIdentity(readTestdata(t, "testdata/fan.textpb"), "")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterVec exports counters maintained by the device, which are set to the
+// reported value rather than incremented.
+type counterVec struct {
+	name       string
+	desc       *prometheus.Desc
+	labelNames []string
+
+	lock   sync.Mutex
+	values map[string]counterValue
+}
+
+type counterValue struct {
+	labels []string
+	v      float64
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labelNames []string) *counterVec {
+	return &counterVec{
+		name:       opts.Name,
+		desc:       prometheus.NewDesc(opts.Name, opts.Help, labelNames, nil),
+		labelNames: labelNames,
+		values:     make(map[string]counterValue),
+	}
+}
+
+func (c *counterVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *counterVec) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, v := range c.values {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, v.v, v.labels...)
+	}
+}
+
+func (c *counterVec) set(labels prometheus.Labels, v float64) {
+	values := make([]string, len(c.labelNames))
+	for i, n := range c.labelNames {
+		values[i] = labels[n]
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[strings.Join(values, "\xff")] = counterValue{labels: values, v: v}
+}
+
+// setCounter exports the current value of a counter maintained by the device.
+func (m *metricRegistry) setCounter(c *counterVec, labels prometheus.Labels, v float64) {
+	c.set(labels, v)
+	if len(m.observers) == 0 {
+		return
+	}
+	m.pending = append(m.pending, decodedUpdate{
+		Metric:  c.name,
+		Labels:  labels,
+		Reading: reading{Instant: v},
+	})
+}
+
+// logicalChannelCounter maps a counter leaf of a logical channel to the
+// metric it is exported as.
+type logicalChannelCounter struct {
+	leaf string
+	help string
+}
+
+var (
+	ethernetCounters = []logicalChannelCounter{
+		{"in-pcs-bip-errors", "Received PCS BIP errors."},
+		{"out-pcs-bip-errors", "Transmitted PCS BIP errors."},
+		{"in-pcs-errored-seconds", "Seconds with received PCS errors."},
+		{"in-pcs-severely-errored-seconds", "Seconds with severe received PCS errors."},
+		{"in-pcs-unavailable-seconds", "Seconds the received PCS was unavailable."},
+		{"in-crc-errors", "Received frames with CRC errors."},
+		{"out-crc-errors", "Transmitted frames with CRC errors."},
+		{"in-block-errors", "Received 64b/66b block errors."},
+		{"out-block-errors", "Transmitted 64b/66b block errors."},
+	}
+	otnCounters = []logicalChannelCounter{
+		{"errored-seconds", "Seconds with OTN errors."},
+		{"severely-errored-seconds", "Seconds with severe OTN errors."},
+		{"unavailable-seconds", "Seconds the OTN signal was unavailable."},
+		{"code-violations", "OTN code violations."},
+		{"background-block-errors", "OTN background block errors."},
+		{"fec-corrected-bits", "Bits corrected by FEC."},
+		{"fec-uncorrectable-blocks", "Blocks FEC could not correct."},
+	}
+)
+
+func newLogicalChannelCounters(prefix string, counters []logicalChannelCounter) map[string]*counterVec {
+	res := make(map[string]*counterVec, len(counters))
+	for _, c := range counters {
+		res[c.leaf] = newCounterVec(prometheus.CounterOpts{
+			Name: prefix + strings.ReplaceAll(c.leaf, "-", "_") + "_total",
+			Help: c.help,
+		},
+			[]string{"logical_channel"})
+	}
+	return res
+}
+
+// setLogicalChannelCounters exports the counters of a logical channel present
+// in an update.
+func (m *metricRegistry) setLogicalChannelCounters(counters map[string]*counterVec, labels prometheus.Labels, leaves map[string]json.RawMessage) error {
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		raw, ok := leaves[k]
+		if !ok {
+			continue
+		}
+		var n json.Number
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		v, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		m.setCounter(counters[k], labels, v)
+	}
+	return nil
+}
+
+func handleLogicalChannelEthernet(m *metricRegistry, j string, groups []string) error {
+	labels := prometheus.Labels{"logical_channel": groups[0]}
+	var leaves map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(j), &leaves); err != nil {
+		return fmt.Errorf("failed to parse logical channel ethernet metric: %v", err)
+	}
+	log.V(2).Infof("New logical channel ethernet metric for %v: %s", labels, j)
+	return m.setLogicalChannelCounters(m.ethernetCounters, labels, leaves)
+}
+
+func handleLogicalChannelOTN(m *metricRegistry, j string, groups []string) error {
+	labels := prometheus.Labels{"logical_channel": groups[0]}
+	var leaves map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(j), &leaves); err != nil {
+		return fmt.Errorf("failed to parse logical channel OTN metric: %v", err)
+	}
+	log.V(2).Infof("New logical channel OTN metric for %v: %s", labels, j)
+	if err := m.setLogicalChannelCounters(m.otnCounters, labels, leaves); err != nil {
+		return err
+	}
+	for _, s := range []struct {
+		leaf string
+		sg   *statGauges
+	}{
+		{"pre-fec-ber", m.otnPreFECBER},
+		{"post-fec-ber", m.otnPostFECBER},
+		{"q-value", m.otnQValue},
+		{"esnr", m.otnESNR},
+	} {
+		raw, ok := leaves[s.leaf]
+		if !ok {
+			continue
+		}
+		var st statistic
+		if err := json.Unmarshal(raw, &st); err != nil {
+			return fmt.Errorf("%s: %w", s.leaf, err)
+		}
+		r, err := st.reading()
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.leaf, err)
+		}
+		m.setStats(s.sg, labels, r)
+	}
+	return nil
+}
+
+// logicalChannel is what is known about how a logical channel is connected.
+type logicalChannel struct {
+	// ingress is the client transceiver feeding the channel, if any.
+	ingress     string
+	assignments map[string]lcAssignment
+}
+
+type lcAssignment struct {
+	Type           string      `json:"assignment-type"`
+	LogicalChannel json.Number `json:"logical-channel"`
+	OpticalChannel string      `json:"optical-channel"`
+}
+
+func (m *metricRegistry) logicalChannel(index string) *logicalChannel {
+	lc, ok := m.logicalChannels[index]
+	if !ok {
+		lc = &logicalChannel{assignments: make(map[string]lcAssignment)}
+		m.logicalChannels[index] = lc
+	}
+	return lc
+}
+
+func handleLogicalChannelIngress(m *metricRegistry, j string, groups []string) error {
+	index := groups[0]
+	val := struct {
+		Transceiver *string `json:"transceiver"`
+	}{}
+	if err := json.Unmarshal([]byte(j), &val); err != nil {
+		return fmt.Errorf("failed to parse logical channel ingress: %v", err)
+	}
+	if val.Transceiver == nil {
+		return nil
+	}
+	lc := m.logicalChannel(index)
+	if lc.ingress == *val.Transceiver {
+		return nil
+	}
+	log.V(2).Infof("New ingress of logical channel %q: %q", index, *val.Transceiver)
+	lc.ingress = *val.Transceiver
+	m.exportAssignments()
+	return nil
+}
+
+func handleLogicalChannelAssignment(m *metricRegistry, j string, groups []string) error {
+	index, assignment := groups[0], groups[1]
+	lc := m.logicalChannel(index)
+	// Updates may only carry some of the leaves, so they are merged into
+	// what is already known.
+	old := lc.assignments[assignment]
+	val := old
+	if err := json.Unmarshal([]byte(j), &val); err != nil {
+		return fmt.Errorf("failed to parse logical channel assignment: %v", err)
+	}
+	if val == old {
+		return nil
+	}
+	log.V(2).Infof("New assignment %q of logical channel %q: %+v", assignment, index, val)
+	lc.assignments[assignment] = val
+	m.exportAssignments()
+	return nil
+}
+
+// opticalChannels returns the optical channels a logical channel is carried
+// on, following assignments to other logical channels.
+func (m *metricRegistry) opticalChannels(index string, visited map[string]bool) []string {
+	lc, ok := m.logicalChannels[index]
+	if !ok || visited[index] {
+		return nil
+	}
+	visited[index] = true
+	var res []string
+	for _, a := range lc.assignments {
+		switch stripModule(a.Type) {
+		case "OPTICAL_CHANNEL":
+			if a.OpticalChannel != "" {
+				res = append(res, a.OpticalChannel)
+			}
+		case "LOGICAL_CHANNEL":
+			if a.LogicalChannel != "" {
+				res = append(res, m.opticalChannels(a.LogicalChannel.String(), visited)...)
+			}
+		}
+	}
+	return res
+}
+
+// exportAssignments exports which optical channel every logical channel, and
+// thereby its client port, is carried on.
+func (m *metricRegistry) exportAssignments() {
+	m.logicalChannelAssignmentInfo.Reset()
+	for index, lc := range m.logicalChannels {
+		for _, och := range m.opticalChannels(index, make(map[string]bool)) {
+			m.logicalChannelAssignmentInfo.With(prometheus.Labels{
+				"logical_channel": index,
+				"client_port":     lc.ingress,
+				"optical_channel": och,
+			}).Set(1)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const logicalChannelPrefix = "/openconfig-terminal-device:terminal-device/logical-channels/channel"
+
+func TestLogicalChannelMetrics(t *testing.T) {
+	mr := NewMetricRegistry()
+	var tests = []struct {
+		path  string
+		json  string
+		names []string
+		em    string
+	}{
+		{"[index=100]/ethernet/state", `{"in-pcs-bip-errors":"12","out-pcs-bip-errors":"0","in-pcs-errored-seconds":"3","in-mac-pause-frames":"7"}`, []string{
+			"dc908_logical_channel_ethernet_in_pcs_bip_errors_total",
+			"dc908_logical_channel_ethernet_out_pcs_bip_errors_total",
+			"dc908_logical_channel_ethernet_in_pcs_errored_seconds_total",
+			"dc908_logical_channel_ethernet_in_crc_errors_total",
+		}, `
+# HELP dc908_logical_channel_ethernet_in_pcs_bip_errors_total Received PCS BIP errors.
+# TYPE dc908_logical_channel_ethernet_in_pcs_bip_errors_total counter
+dc908_logical_channel_ethernet_in_pcs_bip_errors_total{logical_channel="100"} 12
+# HELP dc908_logical_channel_ethernet_in_pcs_errored_seconds_total Seconds with received PCS errors.
+# TYPE dc908_logical_channel_ethernet_in_pcs_errored_seconds_total counter
+dc908_logical_channel_ethernet_in_pcs_errored_seconds_total{logical_channel="100"} 3
+# HELP dc908_logical_channel_ethernet_out_pcs_bip_errors_total Transmitted PCS BIP errors.
+# TYPE dc908_logical_channel_ethernet_out_pcs_bip_errors_total counter
+dc908_logical_channel_ethernet_out_pcs_bip_errors_total{logical_channel="100"} 0
+`},
+		{"[index=200]/otn/state", `{"errored-seconds":"5","fec-corrected-bits":"123456789","pre-fec-ber":{"instant":"0.00012","min":"0.0001","max":"0.0002","avg":"0.00015"},"post-fec-ber":{"instant":"0"},"q-value":{"instant":"9.5"},"esnr":{"instant":"17.25"}}`, []string{
+			"dc908_logical_channel_otn_errored_seconds_total",
+			"dc908_logical_channel_otn_fec_corrected_bits_total",
+			"dc908_logical_channel_otn_pre_fec_bit_error_ratio",
+			"dc908_logical_channel_otn_pre_fec_bit_error_max_ratio",
+			"dc908_logical_channel_otn_post_fec_bit_error_ratio",
+			"dc908_logical_channel_otn_q_value_db",
+			"dc908_logical_channel_otn_esnr_db",
+		}, `
+# HELP dc908_logical_channel_otn_errored_seconds_total Seconds with OTN errors.
+# TYPE dc908_logical_channel_otn_errored_seconds_total counter
+dc908_logical_channel_otn_errored_seconds_total{logical_channel="200"} 5
+# HELP dc908_logical_channel_otn_esnr_db Electrical signal to noise ratio of a logical channel in dB.
+# TYPE dc908_logical_channel_otn_esnr_db gauge
+dc908_logical_channel_otn_esnr_db{logical_channel="200"} 17.25
+# HELP dc908_logical_channel_otn_fec_corrected_bits_total Bits corrected by FEC.
+# TYPE dc908_logical_channel_otn_fec_corrected_bits_total counter
+dc908_logical_channel_otn_fec_corrected_bits_total{logical_channel="200"} 1.23456789e+08
+# HELP dc908_logical_channel_otn_post_fec_bit_error_ratio Bit error ratio of a logical channel after FEC.
+# TYPE dc908_logical_channel_otn_post_fec_bit_error_ratio gauge
+dc908_logical_channel_otn_post_fec_bit_error_ratio{logical_channel="200"} 0
+# HELP dc908_logical_channel_otn_pre_fec_bit_error_max_ratio Bit error ratio of a logical channel before FEC, maximum over the current interval.
+# TYPE dc908_logical_channel_otn_pre_fec_bit_error_max_ratio gauge
+dc908_logical_channel_otn_pre_fec_bit_error_max_ratio{logical_channel="200"} 0.0002
+# HELP dc908_logical_channel_otn_pre_fec_bit_error_ratio Bit error ratio of a logical channel before FEC.
+# TYPE dc908_logical_channel_otn_pre_fec_bit_error_ratio gauge
+dc908_logical_channel_otn_pre_fec_bit_error_ratio{logical_channel="200"} 0.00012
+# HELP dc908_logical_channel_otn_q_value_db Quality factor of a logical channel in dB.
+# TYPE dc908_logical_channel_otn_q_value_db gauge
+dc908_logical_channel_otn_q_value_db{logical_channel="200"} 9.5
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if err := mr.Update(logicalChannelPrefix+tt.path, tt.json); err != nil {
+				t.Fatalf("metric update: %v", err)
+			}
+			if err := testutil.GatherAndCompare(mr.PrometheusRegistry(), strings.NewReader(tt.em), tt.names...); err != nil {
+				t.Errorf("metric compare: err %v", err)
+			}
+		})
+	}
+}
+
+func TestLogicalChannelAssignments(t *testing.T) {
+	mr := NewMetricRegistry()
+	update := func(path, j string) {
+		t.Helper()
+		if err := mr.UpdateAt(logicalChannelPrefix+path, time.Now(), j); err != nil {
+			t.Fatalf("UpdateAt: %v", err)
+		}
+	}
+	compare := func(em string) {
+		t.Helper()
+		if err := testutil.GatherAndCompare(mr.PrometheusRegistry(), strings.NewReader(em), "dc908_logical_channel_assignment_info"); err != nil {
+			t.Errorf("metric compare: err %v", err)
+		}
+	}
+
+	// A client ethernet channel is mapped into an ODU, which is carried on
+	// the line OCH.
+	update("[index=100]/ingress/state", `{"transceiver":"TRANSCEIVER-1-1-C1"}`)
+	update("[index=100]/logical-channel-assignments/assignment[index=1]/state", `{"index":1,"assignment-type":"openconfig-transport-types:LOGICAL_CHANNEL","logical-channel":200,"allocation":"100"}`)
+	compare("")
+	update("[index=200]/logical-channel-assignments/assignment[index=1]/state", `{"index":1,"assignment-type":"openconfig-transport-types:OPTICAL_CHANNEL","optical-channel":"OCH-1-1-L1","allocation":"100"}`)
+	compare(`
+# HELP dc908_logical_channel_assignment_info Optical channel a logical channel and its client port are carried on.
+# TYPE dc908_logical_channel_assignment_info gauge
+dc908_logical_channel_assignment_info{client_port="TRANSCEIVER-1-1-C1",logical_channel="100",optical_channel="OCH-1-1-L1"} 1
+dc908_logical_channel_assignment_info{client_port="",logical_channel="200",optical_channel="OCH-1-1-L1"} 1
+`)
+
+	// Moving the ODU to another OCH moves the client channel along.
+	update("[index=200]/logical-channel-assignments/assignment[index=1]/state", `{"optical-channel":"OCH-1-1-L2"}`)
+	compare(`
+# HELP dc908_logical_channel_assignment_info Optical channel a logical channel and its client port are carried on.
+# TYPE dc908_logical_channel_assignment_info gauge
+dc908_logical_channel_assignment_info{client_port="TRANSCEIVER-1-1-C1",logical_channel="100",optical_channel="OCH-1-1-L2"} 1
+dc908_logical_channel_assignment_info{client_port="",logical_channel="200",optical_channel="OCH-1-1-L2"} 1
+`)
+}
+
+func TestLogicalChannelsAreNotComponents(t *testing.T) {
+	mr := NewMetricRegistry()
+	if err := mr.Update(logicalChannelPrefix+"[index=100]/ethernet/state", `{"in-pcs-bip-errors":"12"}`); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := mr.Update("/openconfig-platform:components/component[name=FAN-1-33]/fan/state", `{"speed":4500}`); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	comps, err := NewClient(nil, mr).components(nil)
+	if err != nil {
+		t.Fatalf("components: %v", err)
+	}
+	if len(comps) != 1 || comps[0].Name != "FAN-1-33" {
+		t.Errorf("components = %+v, want only FAN-1-33", comps)
+	}
+}
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/openconfig/gnmi/proto/gnmi"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	pb "github.com/sonix-network/dc908_exporter/proto"
 	"golang.org/x/net/netutil"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
@@ -25,20 +34,66 @@ var (
 	gnmiPort   = flag.Int("gnmi-port", 8888, "port to listen for gNMI connections on")
 	metricPort = flag.Int("metric-port", 9908, "port to listen for Prometheus scrapes on")
 	maxConns   = flag.Int("max-gnmi-connections", 100, "maximum number of concurrent gNMI connecitons")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for gNMI sessions to finish handling their current message and HTTP requests to drain on shutdown")
 )
 
 type Server struct {
-	s             *grpc.Server
-	lis           net.Listener
-	config        *Config
-	lock          sync.RWMutex
-	gnmiMetricMap map[string]*metricRegistry
+	s         *grpc.Server
+	lis       net.Listener
+	addrs     []net.Addr
+	config    *Config
+	lock      sync.RWMutex
+	clients   map[string]*Client
+	gnmiCache *GNMICache
+	guard     *Guard
+	cluster   *Cluster
+	state     *StateStore
+	publisher *Publisher
+	profiles  *ModuleCatalog
+	serving   atomic.Bool
+	draining  bool
+	// drained is closed once the server starts draining, which ends all
+	// sessions.
+	drained   chan struct{}
+	observers []UpdateObserver
 
 	pb.UnimplementedGNMIDialoutServer
 }
 
+// UpdateObserver is notified of every value decoded from any device.
+type UpdateObserver interface {
+	Observe(target string, u decodedUpdate)
+}
+
+// SessionObserver is an UpdateObserver that is also told when the session of
+// a device ends.
+type SessionObserver interface {
+	UpdateObserver
+	SessionEnded(target string)
+}
+
+// AddObserver registers o to receive the values decoded from all sessions
+// started after this call.
+func (srv *Server) AddObserver(o UpdateObserver) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.observers = append(srv.observers, o)
+}
+
 type Config struct {
 	Port int64
+	// Addresses are the addresses to listen on, all addresses on Port if
+	// empty.
+	Addresses []string
+	// Proxy takes the addresses of devices behind a load balancer from
+	// PROXY protocol headers, if set.
+	Proxy *ProxyConfig
+	// Guard limits who may connect and how much they may send, if set.
+	Guard *GuardConfig
+	// IdleTimeout closes sessions that did not send any message for this
+	// long, if set.
+	IdleTimeout time.Duration
 }
 
 func NewServer(config *Config, opts []grpc.ServerOption) (*Server, error) {
@@ -50,21 +105,37 @@ func NewServer(config *Config, opts []grpc.ServerOption) (*Server, error) {
 	reflection.Register(s)
 
 	srv := &Server{
-		s:             s,
-		config:        config,
-		gnmiMetricMap: make(map[string]*metricRegistry),
+		s:       s,
+		config:  config,
+		clients: make(map[string]*Client),
+		drained: make(chan struct{}),
 	}
 	var err error
 	if srv.config.Port < 0 {
 		srv.config.Port = 0
 	}
-	srv.lis, err = net.Listen("tcp", fmt.Sprintf(":%d", srv.config.Port))
+	addrs := srv.config.Addresses
+	if len(addrs) == 0 {
+		addrs = listenAddresses("", int(srv.config.Port))
+	}
+	listeners, err := listenAll(addrs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open listener port %d: %v", srv.config.Port, err)
+		return nil, err
+	}
+	for _, l := range listeners {
+		srv.addrs = append(srv.addrs, l.Addr())
+	}
+	srv.lis = newMultiListener(listeners)
+	if config.Proxy != nil {
+		srv.lis = config.Proxy.Listener(srv.lis)
+	}
+	if config.Guard != nil {
+		srv.guard = NewGuard(*config.Guard)
+		srv.lis = srv.guard.Listener(srv.lis)
 	}
 	srv.lis = netutil.LimitListener(srv.lis, *maxConns)
 	pb.RegisterGNMIDialoutServer(srv.s, srv)
-	log.V(1).Infof("Created server on %s with maximum gNMI connections set to %d", srv.Address(), *maxConns)
+	log.V(1).Infof("Created server on %s with maximum gNMI connections set to %d", strings.Join(srv.Addresses(), ", "), *maxConns)
 
 	return srv, nil
 }
@@ -74,6 +145,8 @@ func (srv *Server) Serve() error {
 	if s == nil {
 		return fmt.Errorf("Serve() failed: not initialized")
 	}
+	srv.serving.Store(true)
+	defer srv.serving.Store(false)
 	return srv.s.Serve(srv.lis)
 }
 
@@ -87,8 +160,50 @@ func (srv *Server) Stop() error {
 	return nil
 }
 
+// GracefulStop stops accepting new gNMI sessions and ends the existing ones
+// once they finished handling their current message, waiting up to timeout
+// before closing them forcefully. Devices never end dial-out sessions on
+// their own, so they are not waited for.
+func (srv *Server) GracefulStop(timeout time.Duration) error {
+	s := srv.s
+	if s == nil {
+		return fmt.Errorf("GracefulStop() failed: not initialized")
+	}
+	srv.lock.Lock()
+	if !srv.draining {
+		srv.draining = true
+		close(srv.drained)
+	}
+	srv.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warningf("gNMI sessions did not drain within %s, closing them", timeout)
+		s.Stop()
+		<-done
+	}
+	log.V(1).Infof("Server gracefully stopped on %s", srv.Address())
+	return nil
+}
+
+// Address returns the first address the server listens on.
 func (srv *Server) Address() string {
-	return srv.lis.Addr().String()
+	return srv.addrs[0].String()
+}
+
+// Addresses returns all addresses the server listens on.
+func (srv *Server) Addresses() []string {
+	res := make([]string, len(srv.addrs))
+	for i, a := range srv.addrs {
+		res[i] = a.String()
+	}
+	return res
 }
 
 func (srv *Server) Port() int64 {
@@ -106,38 +221,99 @@ func (srv *Server) Publish(stream pb.GNMIDialout_PublishServer) error {
 		return grpc.Errorf(codes.InvalidArgument, "failed to get peer address")
 	}
 
+	source := pr.Addr
+	addr, ok := addrOf(pr.Addr)
+	if !ok {
+		if !isUnixAddr(pr.Addr) {
+			return grpc.Errorf(codes.InvalidArgument, "failed to get peer IP address from %q", pr.Addr)
+		}
+		// Peers on a unix domain socket tell the device address in the
+		// first message.
+		var err error
+		addr, stream, err = streamIdentity(stream, srv.config.IdleTimeout)
+		if err != nil {
+			log.Infof("Rejecting gNMI session on %s: %v", pr.Addr.Network(), err)
+			return err
+		}
+		source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, 0))
+	}
+	// IPv4 devices connecting to a dual-stack listener are identified by
+	// their IPv4 address.
+	ip := addr.String()
+	if !srv.guard.admitSession(addr) {
+		log.Infof("Rejecting gNMI session from sender %q, it is backing off", ip)
+		return grpc.Errorf(codes.ResourceExhausted, "too many offenses, try again later")
+	}
 	mr := NewMetricRegistry()
-	ip := pr.Addr.(*net.TCPAddr).IP.String()
+	mr.profiles = srv.profiles
+	c := NewClient(source, mr)
+	c.limiter = srv.guard.sessionLimiter()
 	srv.lock.Lock()
-	if _, exists := srv.gnmiMetricMap[ip]; exists {
+	for _, o := range srv.observers {
+		o := o
+		mr.OnUpdate(func(u decodedUpdate) { o.Observe(ip, u) })
+	}
+	if srv.draining {
+		srv.lock.Unlock()
+		log.Infof("Rejecting gNMI session from sender %q, server is shutting down", ip)
+		return grpc.Errorf(codes.Unavailable, "server is shutting down")
+	}
+	if _, exists := srv.clients[ip]; exists {
 		srv.lock.Unlock()
 		log.Errorf("Duplicate gNMI session from sender %q, rejecting", ip)
 		return grpc.Errorf(codes.AlreadyExists, "gNMI session for this client already in progress")
 	}
-	srv.gnmiMetricMap[ip] = mr
+	srv.clients[ip] = c
 	srv.lock.Unlock()
 	log.Infof("New gNMI session registered for sender %q", ip)
+	if srv.gnmiCache != nil {
+		srv.gnmiCache.AddTarget(ip)
+	}
 
-	c := NewClient(pr.Addr, mr)
 	defer c.Close()
 	defer func() {
 		srv.lock.Lock()
-		defer srv.lock.Unlock()
-		delete(srv.gnmiMetricMap, ip)
+		delete(srv.clients, ip)
+		if srv.gnmiCache != nil {
+			srv.gnmiCache.RemoveTarget(ip)
+		}
+		observers := srv.observers
+		draining := srv.draining
+		srv.lock.Unlock()
 		log.Infof("gNMI session terminated for sender %q", ip)
+		// Sessions ending on shutdown do not mean the devices went away.
+		if draining {
+			return
+		}
+		for _, o := range observers {
+			if so, ok := o.(SessionObserver); ok {
+				so.SessionEnded(ip)
+			}
+		}
 	}()
-	return c.Run(srv, stream)
+	return c.runWithIdleTimeout(srv, ip, stream, srv.config.IdleTimeout)
 }
 
 type Client struct {
-	addr net.Addr
-	mr   *metricRegistry
+	addr      net.Addr
+	mr        *metricRegistry
+	connected time.Time
+	limiter   *rate.Limiter
+
+	messages    atomic.Int64
+	lastUpdate  atomic.Int64
+	parseErrors atomic.Int64
+
+	// stopLock is held while a message is handled, stopped is guarded by it.
+	stopLock sync.Mutex
+	stopped  bool
 }
 
 func NewClient(addr net.Addr, mr *metricRegistry) *Client {
 	return &Client{
-		addr: addr,
-		mr:   mr,
+		addr:      addr,
+		mr:        mr,
+		connected: time.Now(),
 	}
 }
 
@@ -145,7 +321,7 @@ func (c *Client) String() string {
 	return c.addr.String()
 }
 
-func (c *Client) Run(srv *Server, stream pb.GNMIDialout_PublishServer) (err error) {
+func (c *Client) Run(srv *Server, target string, stream pb.GNMIDialout_PublishServer) (err error) {
 	defer log.V(1).Infof("Client %s shutdown", c)
 
 	if stream == nil {
@@ -161,27 +337,106 @@ func (c *Client) Run(srv *Server, stream pb.GNMIDialout_PublishServer) (err erro
 			return grpc.Errorf(grpc.Code(err), "received error from client")
 		}
 
-		if log.V(4) {
-			log.V(4).Infof("Received SubscribeResponse: %s", prototext.Format(subscribeResponse))
+		if err := c.handle(srv, target, subscribeResponse); err != nil {
+			return err
 		}
+	}
+}
 
-		notif := subscribeResponse.GetUpdate()
-		WalkNotification(notif, func(fqn string, _ *time.Time, json string) {
-			// TODO: Verify that the timestamp is not too far off
-			if err := c.mr.Update(fqn, json); err != nil {
-				log.Warningf("Failed to parse metric update: %v", err)
-			}
-		}, nil)
+// handle applies a message received from the device, unless the client was
+// stopped.
+func (c *Client) handle(srv *Server, target string, subscribeResponse *gnmi.SubscribeResponse) error {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if c.stopped {
+		return grpc.Errorf(codes.Aborted, "session stopped")
+	}
+
+	if log.V(4) {
+		log.V(4).Infof("Received SubscribeResponse: %s", prototext.Format(subscribeResponse))
+	}
+
+	c.messages.Add(1)
+	c.lastUpdate.Store(time.Now().UnixNano())
+	if c.limiter != nil && !c.limiter.Allow() {
+		if addr, ok := addrOf(c.addr); ok {
+			srv.guard.rateLimited(addr)
+		}
+		return grpc.Errorf(codes.ResourceExhausted, "message rate exceeded")
+	}
+
+	if subscribeResponse.GetSyncResponse() {
+		// Sync responses carry no updates, they only end the initial
+		// set of updates.
+		if srv.gnmiCache != nil {
+			srv.gnmiCache.Sync(target)
+		}
+		return nil
+	}
+
+	notif := subscribeResponse.GetUpdate()
+	if notif == nil {
+		return nil
 	}
+	WalkNotification(notif, func(fqn string, ts *time.Time, json string) {
+		// TODO: Verify that the timestamp is not too far off
+		if err := c.mr.UpdateAt(fqn, *ts, json); err != nil {
+			c.parseErrors.Add(1)
+			log.Warningf("Failed to parse metric update: %v", err)
+		}
+	}, func(fqn string, _ *time.Time) {
+		c.mr.Delete(fqn)
+		srv.state.Delete(target, fqn)
+	})
+	if srv.publisher != nil {
+		srv.publisher.PublishNotification(target, subscribeResponse)
+	}
+
+	if srv.gnmiCache != nil {
+		srv.gnmiCache.Update(target, notif)
+	}
+	return nil
+}
+
+// stop makes the client ignore any further message. It waits for the message
+// being handled, if any, so the session can be torn down afterwards.
+func (c *Client) stop() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	c.stopped = true
 }
 
 func (c *Client) Close() {
 }
 
+// registries returns the metric registries of all connected devices keyed
+// by target.
+func (srv *Server) registries() map[string]*metricRegistry {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	res := make(map[string]*metricRegistry, len(srv.clients))
+	for target, c := range srv.clients {
+		res[target] = c.mr
+	}
+	return res
+}
+
+// sessionClients returns the clients of all connected devices keyed by
+// target.
+func (srv *Server) sessionClients() map[string]*Client {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	res := make(map[string]*Client, len(srv.clients))
+	for target, c := range srv.clients {
+		res[target] = c
+	}
+	return res
+}
+
 func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
 	paramMap := make(map[string]string)
-	target := params.Get("target")
+	target := normalizeTarget(params.Get("target"))
 	paramMap["target"] = params.Get("target")
 	if target == "" {
 		http.Error(w, "Target parameter missing or empty", http.StatusBadRequest)
@@ -194,19 +449,42 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	})
 
 	srv.lock.RLock()
-	mr, ok := srv.gnmiMetricMap[target]
+	c, ok := srv.clients[target]
 	srv.lock.RUnlock()
 
 	ireg := prometheus.NewPedanticRegistry()
 	ireg.MustRegister(probeSuccessGauge)
 
+	probeRestoredGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_restored",
+		Help: "Whether the probe includes values restored from the state file that were not received again since",
+	})
+	if srv.state != nil {
+		ireg.MustRegister(probeRestoredGauge)
+	}
+
 	regs := prometheus.Gatherers{ireg}
 	if ok {
 		probeSuccessGauge.Set(1)
 		log.V(1).Infof("Probe of %q succeeded", target)
 		// Assuming the Prometheus Registry object is multi-thread safe this should
 		// be fine without locking
-		regs = append(regs, mr.PrometheusRegistry())
+		var g prometheus.Gatherer = c.mr.PrometheusRegistry()
+		if srv.state != nil {
+			var n int
+			if g, n = srv.state.Merge(target, g); n > 0 {
+				probeRestoredGauge.Set(1)
+			}
+		}
+		regs = append(regs, g)
+	} else if g, peer, ok := srv.cluster.Snapshot(target); ok {
+		probeSuccessGauge.Set(1)
+		log.V(1).Infof("Probe of %q succeeded from the snapshot of replica %s", target, peer)
+		regs = append(regs, g)
+	} else if g, ok := srv.state.Restored(target); ok {
+		probeRestoredGauge.Set(1)
+		log.Infof("Probe of %q failed, serving its restored state", target)
+		regs = append(regs, g)
 	} else {
 		log.Infof("Probe of %q failed, no gNMI data available at this time", target)
 	}
@@ -218,20 +496,241 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func main() {
 	flag.Parse()
 
-	opts := []grpc.ServerOption{}
+	opts := keepaliveOptions()
+	if *gnmiAuthConfig != "" {
+		authCfg, err := LoadAuthConfig(*gnmiAuthConfig)
+		if err != nil {
+			log.Fatalf("Failed to load gNMI auth config: %v", err)
+		}
+		opts = append(opts, grpc.ChainStreamInterceptor(authCfg.StreamInterceptor))
+	}
 	cfg := &Config{}
 	cfg.Port = int64(*gnmiPort)
+	cfg.Addresses = listenAddresses(*gnmiListenAddresses, *gnmiPort)
+	proxyCfg, err := ProxyConfigFromFlags()
+	if err != nil {
+		log.Fatalf("Invalid PROXY protocol configuration: %v", err)
+	}
+	cfg.Proxy = proxyCfg
+	guardCfg, err := GuardConfigFromFlags()
+	if err != nil {
+		log.Fatalf("Invalid gNMI limits: %v", err)
+	}
+	cfg.Guard = guardCfg
+	cfg.IdleTimeout = idleTimeoutFromFlags()
 	s, err := NewServer(cfg, opts)
 	if err != nil {
 		log.Fatalf("Failed to create gNMI server: %v", err)
 	}
 
+	if *moduleProfiles != "" {
+		s.profiles, err = LoadModuleCatalog(*moduleProfiles)
+		if err != nil {
+			log.Fatalf("Failed to load module profiles: %v", err)
+		}
+	}
+
+	if *gnmiServerPort != 0 {
+		s.gnmiCache, err = NewGNMICache(*gnmiServerPort, nil)
+		if err != nil {
+			log.Fatalf("Failed to create gNMI cache server: %v", err)
+		}
+		go func() {
+			log.V(1).Infof("Starting gNMI cache server on address: %s", s.gnmiCache.Address())
+			if err := s.gnmiCache.Serve(); err != nil {
+				log.Errorf("gNMI cache server failed: %v", err)
+			}
+		}()
+	}
+
+	if *stateFile != "" {
+		if *stateInterval <= 0 {
+			log.Fatalf("-state-interval must be positive, got %v", *stateInterval)
+		}
+		s.state, err = NewStateStore(s, *stateFile, *stateInterval, *stateMaxAge)
+		if err != nil {
+			log.Fatalf("Failed to restore state: %v", err)
+		}
+		s.state.Start()
+	}
+
+	clusterCfg, err := ClusterConfigFromFlags()
+	if err != nil {
+		log.Fatalf("Invalid cluster configuration: %v", err)
+	}
+	if clusterCfg != nil {
+		s.cluster = NewCluster(*clusterCfg)
+		s.cluster.Start()
+	}
+
+	var rw *RemoteWriter
+	if *remoteWriteConfig != "" {
+		rwCfg, err := LoadRemoteWriteConfig(*remoteWriteConfig)
+		if err != nil {
+			log.Fatalf("Failed to load remote-write config: %v", err)
+		}
+		rw = NewRemoteWriter(s, rwCfg, *remoteWriteInterval)
+	}
+
+	var otlp *OTLPExporter
+	if *otlpEndpoint != "" {
+		headers, err := ParseOTLPHeaders(*otlpHeaders)
+		if err != nil {
+			log.Fatalf("Failed to parse OTLP headers: %v", err)
+		}
+		otlp, err = NewOTLPExporter(context.Background(), s, *otlpProtocol, *otlpEndpoint, headers, *otlpInterval)
+		if err != nil {
+			log.Fatalf("Failed to create OTLP exporter: %v", err)
+		}
+	}
+
+	var influx *InfluxWriter
+	if *influxURL != "" || *influxFile != "" {
+		influx, err = NewInfluxWriter(InfluxConfig{
+			URL:           *influxURL,
+			Org:           *influxOrg,
+			Bucket:        *influxBucket,
+			Token:         *influxToken,
+			File:          *influxFile,
+			FlushInterval: *influxFlushInterval,
+			BatchSize:     *influxBatchSize,
+			BufferSize:    *influxBufferSize,
+			MaxRetries:    *influxMaxRetries,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create InfluxDB writer: %v", err)
+		}
+		s.AddObserver(influx)
+	}
+
+	if *busURL != "" {
+		s.publisher, err = DialPublisher(*busURL, *busFormat, *busSubjectPrefix, *busRaw, *busDecoded)
+		if err != nil {
+			log.Fatalf("Failed to create message bus publisher: %v", err)
+		}
+		s.AddObserver(s.publisher)
+	}
+
+	var alerts *AlertEngine
+	if *alertRules != "" {
+		alertCfg, err := LoadAlertConfig(*alertRules)
+		if err != nil {
+			log.Fatalf("Failed to load alert rules: %v", err)
+		}
+		alerts = NewAlertEngine(alertCfg, *alertResendInterval, *alertSessionGrace)
+		s.AddObserver(alerts)
+	}
+
+	if *linkConfig != "" {
+		linkCfg, err := LoadLinkConfig(*linkConfig)
+		if err != nil {
+			log.Fatalf("Failed to load link config: %v", err)
+		}
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(NewLinkCollector(s, linkCfg))
+		http.Handle("/links", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	}
+
 	http.Handle("/probe", s)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", s.serveHealthz)
+	http.HandleFunc("/readyz", s.serveReadyz)
+	http.HandleFunc("/status", s.serveStatus)
+	http.Handle("/api/v1/", s.apiHandler())
+	http.HandleFunc("/api/alarms", s.serveAPIAlarms)
+	http.HandleFunc("/api/cluster/snapshots", s.serveClusterSnapshots)
+	httpListeners, err := listenAll(listenAddresses(*metricListenAddresses, *metricPort))
+	if err != nil {
+		log.Fatalf("Failed to create HTTP listeners: %v", err)
+	}
+	httpSrv := &http.Server{}
+	if *webConfigFile != "" {
+		webCfg, err := LoadWebConfig(*webConfigFile)
+		if err != nil {
+			log.Fatalf("Failed to load web config: %v", err)
+		}
+		if err := webCfg.Configure(httpSrv); err != nil {
+			log.Fatalf("Failed to configure HTTP server: %v", err)
+		}
+	}
+	for _, lis := range httpListeners {
+		lis := lis
+		log.V(1).Infof("Starting HTTP server on address: %s", lis.Addr())
+		go func() {
+			var err error
+			if httpSrv.TLSConfig != nil {
+				err = httpSrv.ServeTLS(lis, "", "")
+			} else {
+				err = httpSrv.Serve(lis)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	serveErr := make(chan error, 1)
 	go func() {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *metricPort), nil))
+		log.V(1).Infof("Starting RPC server on addresses: %s", strings.Join(s.Addresses(), ", "))
+		serveErr <- s.Serve()
 	}()
 
-	log.V(1).Infof("Starting RPC server on address: %s", s.Address())
-	s.Serve()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	var v os.Signal
+	select {
+	case err := <-serveErr:
+		log.Errorf("RPC server failed: %v", err)
+	case v = <-sig:
+		log.Infof("Received %v, shutting down", v)
+	}
+	// Save the state while the devices are still connected.
+	if s.state != nil {
+		if err := s.state.Close(); err != nil {
+			log.Warningf("Failed to write state file: %v", err)
+		}
+	}
+	if v != nil {
+		s.GracefulStop(*shutdownTimeout)
+	}
+	if s.gnmiCache != nil {
+		s.gnmiCache.GracefulStop(*shutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := httpSrv.Shutdown(ctx); err != nil {
+		log.Warningf("HTTP server shutdown: %v", err)
+	}
+	if s.cluster != nil {
+		if err := s.cluster.Close(ctx); err != nil {
+			log.Warningf("Cluster shutdown: %v", err)
+		}
+	}
+	if rw != nil {
+		if err := rw.Close(ctx); err != nil {
+			log.Warningf("Remote-write shutdown: %v", err)
+		}
+	}
+	if otlp != nil {
+		if err := otlp.Close(ctx); err != nil {
+			log.Warningf("OTLP exporter shutdown: %v", err)
+		}
+	}
+	if influx != nil {
+		if err := influx.Close(ctx); err != nil {
+			log.Warningf("InfluxDB writer shutdown: %v", err)
+		}
+	}
+	if alerts != nil {
+		if err := alerts.Close(ctx); err != nil {
+			log.Warningf("Alert engine shutdown: %v", err)
+		}
+	}
+	if s.publisher != nil {
+		if err := s.publisher.Close(); err != nil {
+			log.Warningf("Message bus publisher shutdown: %v", err)
+		}
+	}
 	log.Flush()
 }
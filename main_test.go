@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+const (
+	waitFor = 5 * time.Second
+	tick    = 10 * time.Millisecond
+)
+
+func startServer(t *testing.T) *Server {
+	t.Helper()
+	srv, err := NewServer(&Config{Port: 0}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+	return srv
+}
+
+// connFrom creates a client connection to srv using the given loopback
+// address as source, which lets a single test pretend to be several devices.
+func connFrom(t *testing.T, srv *Server, src string) *grpc.ClientConn {
+	t.Helper()
+	_, port, err := net.SplitHostPort(srv.Address())
+	if err != nil {
+		t.Fatalf("SplitHostPort: %v", err)
+	}
+	return connTo(t, net.JoinHostPort("127.0.0.1", port), src)
+}
+
+// connTo creates a client connection to addr using src as source address.
+func connTo(t *testing.T, addr string, src string) *grpc.ClientConn {
+	t.Helper()
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(src)}}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// dialFrom opens a Publish stream to srv from src. The returned function
+// tears down the stream and its connection.
+func dialFrom(t *testing.T, srv *Server, src string) (pb.GNMIDialout_PublishClient, func()) {
+	t.Helper()
+	conn := connFrom(t, srv, src)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := pb.NewGNMIDialoutClient(conn).Publish(ctx)
+	if err != nil {
+		cancel()
+		t.Fatalf("Publish: %v", err)
+	}
+	closer := func() {
+		cancel()
+		conn.Close()
+	}
+	t.Cleanup(closer)
+	return stream, closer
+}
+
+func readTestdata(t *testing.T, fn string) *gnmi.SubscribeResponse {
+	t.Helper()
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	m := &gnmi.SubscribeResponse{}
+	if err := prototext.Unmarshal(d, m); err != nil {
+		t.Fatalf("Unmarshal %s: %v", fn, err)
+	}
+	return m
+}
+
+func probe(srv *Server, target string) string {
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?target="+target, nil))
+	return rec.Body.String()
+}
+
+func probeSucceeds(srv *Server, target string) bool {
+	return strings.Contains(probe(srv, target), "probe_success 1")
+}
+
+func TestProbeMissingTarget(t *testing.T) {
+	srv := startServer(t)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestPublishAndProbe(t *testing.T) {
+	assert := assert.New(t)
+	srv := startServer(t)
+
+	assert.Contains(probe(srv, "127.0.0.1"), "probe_success 0")
+
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	assert.Eventually(func() bool {
+		return strings.Contains(probe(srv, "127.0.0.1"), `dc908_fan_rpm{device="FAN-1-33"} 4500`)
+	}, waitFor, tick)
+	assert.Contains(probe(srv, "127.0.0.1"), "probe_success 1")
+	assert.Contains(probe(srv, "127.0.0.2"), "probe_success 0")
+}
+
+func TestDuplicateSessionRejected(t *testing.T) {
+	srv := startServer(t)
+
+	first, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := first.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+
+	second, _ := dialFrom(t, srv, "127.0.0.1")
+	_, err := second.Recv()
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	// The original session must be left untouched.
+	assert.True(t, probeSucceeds(srv, "127.0.0.1"))
+}
+
+func TestSessionTeardown(t *testing.T) {
+	srv := startServer(t)
+
+	stream, closer := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+
+	closer()
+	assert.Eventually(t, func() bool { return !probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+
+	// After teardown the same device must be able to reconnect.
+	stream, _ = dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+}
+
+func TestMaxConnections(t *testing.T) {
+	old := *maxConns
+	*maxConns = 1
+	defer func() { *maxConns = old }()
+	srv := startServer(t)
+
+	first, closer := dialFrom(t, srv, "127.0.0.1")
+	if err := first.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+
+	// The second device is parked in the kernel accept queue and its
+	// updates must not show up while the first connection holds the slot.
+	msg := readTestdata(t, "testdata/fan.textpb")
+	conn := connFrom(t, srv, "127.0.0.2")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		stream, err := pb.NewGNMIDialoutClient(conn).Publish(ctx)
+		if err != nil {
+			return
+		}
+		stream.Send(msg)
+	}()
+	assert.Never(t, func() bool { return probeSucceeds(srv, "127.0.0.2") }, 500*time.Millisecond, tick)
+
+	closer()
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.2") }, waitFor, tick)
+}
+
+func TestConcurrentScrapes(t *testing.T) {
+	srv := startServer(t)
+
+	devices := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+	var msgs []*gnmi.SubscribeResponse
+	for _, fn := range []string{"testdata/fan.textpb", "testdata/psu.textpb", "testdata/mcu.textpb", "testdata/optics.textpb", "testdata/panel.textpb"} {
+		msgs = append(msgs, readTestdata(t, fn))
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		stream, _ := dialFrom(t, srv, d)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := stream.Send(msgs[i%len(msgs)]); err != nil {
+					t.Errorf("Send from %s: %v", d, err)
+					return
+				}
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	var scrapers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		scrapers.Add(1)
+		go func(i int) {
+			defer scrapers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if body := probe(srv, devices[i%len(devices)]); !strings.Contains(body, "probe_success") {
+					t.Errorf("unexpected probe output: %s", body)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	for _, d := range devices {
+		assert.Eventually(t, func() bool {
+			return strings.Contains(probe(srv, d), `dc908_temperature_celsius{device="PSU-1-22"}`)
+		}, waitFor, tick)
+	}
+	close(stop)
+	scrapers.Wait()
+}
+
+func TestGracefulStop(t *testing.T) {
+	srv := startServer(t)
+
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+
+	// Devices never end their sessions, so they are closed right away
+	// instead of waiting for the drain timeout.
+	start := time.Now()
+	assert.NoError(t, srv.GracefulStop(time.Minute))
+	assert.Less(t, time.Since(start), waitFor)
+
+	_, err := stream.Recv()
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool { return !probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+}
+
+func TestGracefulStopWithoutSessions(t *testing.T) {
+	srv := startServer(t)
+
+	start := time.Now()
+	assert.NoError(t, srv.GracefulStop(waitFor))
+	assert.Less(t, time.Since(start), waitFor)
+}
@@ -8,6 +8,9 @@ import (
 	"math"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,6 +18,9 @@ import (
 
 type MetricCallback func(m *metricRegistry, json string, groups []string) error
 
+// MetricDeleteCallback handles the deletion of a path matched by a delete matcher.
+type MetricDeleteCallback func(m *metricRegistry, groups []string)
+
 var (
 	matchers = []struct {
 		re *regexp.Regexp
@@ -23,115 +29,279 @@ var (
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/fan/state`), handleFan},
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/state`), handleTemperature},
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/state`), handleMemory},
+		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/state`), handleComponentState},
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/cpu/openconfig-platform-cpu:utilization`), handleCPUUtilization},
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/power-supply/state`), handlePowerSupply},
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/openconfig-platform-transceiver:transceiver/physical-channels/channel\[index=([^,\]]+)\]/state`), handleGeneralLaser},
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/openconfig-platform-transceiver:transceiver/state`), handleGeneralLaser},
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/openconfig-terminal-device:optical-channel/state`), handleGeneralLaser},
+		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/openconfig-terminal-device:optical-channel/state`), handleOpticalChannel},
 		{regexp.MustCompile(`/openconfig-platform:components/component\[name=([^,\]]+)\]/openconfig-terminal-device:optical-channel/state`), handleTerminalLaser},
+		{regexp.MustCompile(`/openconfig-terminal-device:terminal-device/logical-channels/channel\[index=([^,\]]+)\]/ethernet/state`), handleLogicalChannelEthernet},
+		{regexp.MustCompile(`/openconfig-terminal-device:terminal-device/logical-channels/channel\[index=([^,\]]+)\]/otn/state`), handleLogicalChannelOTN},
+		{regexp.MustCompile(`/openconfig-terminal-device:terminal-device/logical-channels/channel\[index=([^,\]]+)\]/ingress/state`), handleLogicalChannelIngress},
+		{regexp.MustCompile(`/openconfig-terminal-device:terminal-device/logical-channels/channel\[index=([^,\]]+)\]/logical-channel-assignments/assignment\[index=([^,\]]+)\]/state`), handleLogicalChannelAssignment},
+		{regexp.MustCompile(`/openconfig-system:system/alarms/alarm\[id=([^,\]]+)\]/state`), handleAlarm},
+	}
+
+	deleteMatchers = []struct {
+		re *regexp.Regexp
+		cb MetricDeleteCallback
+	}{
+		{regexp.MustCompile(`/openconfig-system:system/alarms(?:/alarm\[id=([^,\]]+)\])?(?:/state)?$`), clearAlarm},
 	}
+
+	// componentPath matches the paths of a component and captures its name.
+	componentPath = regexp.MustCompile(`^/openconfig-platform:components/component\[name=([^,\]]+)\]`)
 )
 
 type metricRegistry struct {
 	r *prometheus.Registry
 
-	fanRPM                          *prometheus.GaugeVec
-	temperature                     *prometheus.GaugeVec
-	memoryUtilized                  *prometheus.GaugeVec
-	cpuUtilization                  *prometheus.GaugeVec
-	powerSupplyInputCurrent         *prometheus.GaugeVec
-	powerSupplyInputVoltage         *prometheus.GaugeVec
-	powerSupplyOutputCurrent        *prometheus.GaugeVec
-	powerSupplyOutputVoltage        *prometheus.GaugeVec
-	laserInputPower                 *prometheus.GaugeVec
-	laserBiasCurrent                *prometheus.GaugeVec
-	laserOutputPower                *prometheus.GaugeVec
-	laserChromaticDispersion        *prometheus.GaugeVec
-	laserPolarizationDependetLoss   *prometheus.GaugeVec
-	laserPolarizationModeDispersion *prometheus.GaugeVec
-	laserFrequencyOffset            *prometheus.GaugeVec
+	lock sync.Mutex
+	// updated holds when every component was last updated, keyed by the
+	// component name, and is guarded by lock.
+	updated   map[string]time.Time
+	pending   []decodedUpdate
+	observers []func(decodedUpdate)
+
+	// inventory holds the last reported inventory of every component and is
+	// guarded by lock.
+	inventory map[string]componentInventory
+
+	// profiles is the module catalog margins are exported against, keyed by
+	// the part numbers reported in component state.
+	profiles  *ModuleCatalog
+	profileOf map[string]string
+
+	// logicalChannels holds how the logical channels of the terminal device
+	// are connected, keyed by their index.
+	logicalChannels map[string]*logicalChannel
+
+	// opticalChannelInfos holds the last reported operational mode and line
+	// port of every optical channel, keyed by component name.
+	opticalChannelInfos map[string]opticalChannelInfo
+
+	// alarms holds the alarms currently raised by the device keyed by id
+	// and is guarded by lock.
+	alarms map[string]deviceAlarm
+
+	fanRPM                          *gaugeVec
+	temperature                     *gaugeVec
+	memoryUtilized                  *gaugeVec
+	cpuUtilization                  *gaugeVec
+	powerSupplyInputCurrent         *gaugeVec
+	powerSupplyInputVoltage         *gaugeVec
+	powerSupplyOutputCurrent        *gaugeVec
+	powerSupplyOutputVoltage        *gaugeVec
+	laserInputPower                 *gaugeVec
+	laserBiasCurrent                *gaugeVec
+	laserOutputPower                *gaugeVec
+	laserChromaticDispersion        *gaugeVec
+	laserPolarizationDependetLoss   *gaugeVec
+	laserPolarizationModeDispersion *gaugeVec
+	laserFrequencyOffset            *gaugeVec
+	laserRxMargin                   *gaugeVec
+	laserRxOverloadMargin           *gaugeVec
+	laserTxLowMargin                *gaugeVec
+	laserTxHighMargin               *gaugeVec
+	laserBiasLowMargin              *gaugeVec
+	laserBiasHighMargin             *gaugeVec
+	moduleProfileInfo               *gaugeVec
+	componentInfo                   *gaugeVec
+	componentOperStatus             *gaugeVec
+	opticalChannelFrequency         *gaugeVec
+	opticalChannelTargetOutputPower *gaugeVec
+	opticalChannelInfo              *gaugeVec
+	opticalChannelOSNR              *statGauges
+	opticalChannelQValue            *statGauges
+	ethernetCounters                map[string]*counterVec
+	otnCounters                     map[string]*counterVec
+	otnPreFECBER                    *statGauges
+	otnPostFECBER                   *statGauges
+	otnQValue                       *statGauges
+	otnESNR                         *statGauges
+	logicalChannelAssignmentInfo    *gaugeVec
+	alarmActive                     *gaugeVec
 }
 
 func NewMetricRegistry() *metricRegistry {
 	m := &metricRegistry{
-		r: prometheus.NewPedanticRegistry(),
-		fanRPM: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		r:         prometheus.NewPedanticRegistry(),
+		updated:   make(map[string]time.Time),
+		inventory: make(map[string]componentInventory),
+		profileOf: make(map[string]string),
+
+		logicalChannels:     make(map[string]*logicalChannel),
+		opticalChannelInfos: make(map[string]opticalChannelInfo),
+		alarms:              make(map[string]deviceAlarm),
+		fanRPM: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_fan_rpm",
 			Help: "Current fan speed in RPM.",
 		},
 			[]string{"device"}),
-		temperature: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		temperature: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_temperature_celsius",
 			Help: "Current temperature of components.",
 		},
 			[]string{"device"}),
-		memoryUtilized: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		memoryUtilized: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_memory_utilized_bytes",
 			Help: "The number of bytes of memory currently in use by processes running on the component, not considering reserved memory that is not available for use.",
 		},
 			[]string{"device"}),
-		cpuUtilization: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		cpuUtilization: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_cpu_utilization_ratio",
 			Help: "Ratio (0.0 - 1.0) of CPU utilization.",
 		},
 			[]string{"device"}),
-		powerSupplyInputCurrent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		powerSupplyInputCurrent: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_power_supply_input_current_ampere",
 			Help: "Current input current on a power supply.",
 		},
 			[]string{"device"}),
-		powerSupplyInputVoltage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		powerSupplyInputVoltage: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_power_supply_input_voltage",
 			Help: "Current input current on a power supply.",
 		},
 			[]string{"device"}),
-		powerSupplyOutputCurrent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		powerSupplyOutputCurrent: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_power_supply_output_current_ampere",
 			Help: "Current output current on a power supply.",
 		},
 			[]string{"device"}),
-		powerSupplyOutputVoltage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		powerSupplyOutputVoltage: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_power_supply_output_voltage",
 			Help: "Current output voltage on a power supply.",
 		},
 			[]string{"device"}),
 
-		laserInputPower: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		laserInputPower: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_laser_input_power_dbm",
 			Help: "The input optical power of a physical channel in dBm.",
 		},
 			[]string{"device", "index"}),
-		laserBiasCurrent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		laserBiasCurrent: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_laser_bias_current_amepere",
 			Help: "The current applied by the system to the transmit laser to achieve the output power.",
 		},
 			[]string{"device", "index"}),
-		laserOutputPower: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		laserOutputPower: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_laser_output_power_dbm",
 			Help: "The output optical power of a physical channel in dBm.",
 		},
 			[]string{"device", "index"}),
-		laserChromaticDispersion: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		laserChromaticDispersion: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_laser_chromatic_dispersion_ps_nm",
 			Help: "Chromatic Dispersion of an optical channel in picoseconds / nanometer (ps/nm).",
 		},
 			[]string{"device"}),
-		laserPolarizationDependetLoss: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		laserPolarizationDependetLoss: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_laser_polarization_dependent_loss_db",
 			Help: "Polarization Dependent Loss of an optical channel in dB.",
 		},
 			[]string{"device"}),
-		laserPolarizationModeDispersion: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		laserPolarizationModeDispersion: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_laser_polarization_mode_dispersion_ps",
 			Help: "Polarization Mode Dispersion of an optical channel in picoseconds (ps).",
 		},
 			[]string{"device"}),
 		// TODO: If we figure out what this really is, improve the help string.
-		laserFrequencyOffset: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		laserFrequencyOffset: newGaugeVec(prometheus.GaugeOpts{
 			Name: "dc908_laser_frequency_offset_hertz",
 			Help: "Frequency offset from reference frequency.",
 		},
 			[]string{"device"}),
+		laserRxMargin: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_laser_rx_margin_db",
+			Help: "Input power above the receiver sensitivity of the module profile in dB.",
+		},
+			[]string{"device", "index"}),
+		laserRxOverloadMargin: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_laser_rx_overload_margin_db",
+			Help: "Input power below the receiver overload of the module profile in dB.",
+		},
+			[]string{"device", "index"}),
+		laserTxLowMargin: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_laser_tx_low_margin_db",
+			Help: "Output power above the minimum output power of the module profile in dB.",
+		},
+			[]string{"device", "index"}),
+		laserTxHighMargin: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_laser_tx_high_margin_db",
+			Help: "Output power below the maximum output power of the module profile in dB.",
+		},
+			[]string{"device", "index"}),
+		laserBiasLowMargin: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_laser_bias_current_low_margin_ampere",
+			Help: "Laser bias current above the minimum bias current of the module profile.",
+		},
+			[]string{"device", "index"}),
+		laserBiasHighMargin: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_laser_bias_current_high_margin_ampere",
+			Help: "Laser bias current below the maximum bias current of the module profile.",
+		},
+			[]string{"device", "index"}),
+		moduleProfileInfo: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_module_profile_info",
+			Help: "The module profile margins of a component are exported against.",
+		},
+			[]string{"device", "profile"}),
+		componentInfo: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_component_info",
+			Help: "Inventory information of a component.",
+		},
+			componentInfoLabels),
+		componentOperStatus: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_component_oper_status",
+			Help: "Operational status of a component, 1 for the current status.",
+		},
+			[]string{"device", "status"}),
+		opticalChannelFrequency: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_optical_channel_frequency_hertz",
+			Help: "Frequency of an optical channel.",
+		},
+			[]string{"device"}),
+		opticalChannelTargetOutputPower: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_optical_channel_target_output_power_dbm",
+			Help: "Target output optical power of an optical channel in dBm.",
+		},
+			[]string{"device"}),
+		opticalChannelInfo: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_optical_channel_info",
+			Help: "Operational mode and line port of an optical channel.",
+		},
+			[]string{"device", "operational_mode", "line_port"}),
+		opticalChannelOSNR: newStatGauges("dc908_optical_channel_osnr", "_db",
+			"Optical signal to noise ratio of an optical channel in dB",
+			[]string{"device"}),
+		opticalChannelQValue: newStatGauges("dc908_optical_channel_q_value", "_db",
+			"Quality factor of an optical channel in dB",
+			[]string{"device"}),
+		ethernetCounters: newLogicalChannelCounters("dc908_logical_channel_ethernet_", ethernetCounters),
+		otnCounters:      newLogicalChannelCounters("dc908_logical_channel_otn_", otnCounters),
+		otnPreFECBER: newStatGauges("dc908_logical_channel_otn_pre_fec_bit_error", "_ratio",
+			"Bit error ratio of a logical channel before FEC",
+			[]string{"logical_channel"}),
+		otnPostFECBER: newStatGauges("dc908_logical_channel_otn_post_fec_bit_error", "_ratio",
+			"Bit error ratio of a logical channel after FEC",
+			[]string{"logical_channel"}),
+		otnQValue: newStatGauges("dc908_logical_channel_otn_q_value", "_db",
+			"Quality factor of a logical channel in dB",
+			[]string{"logical_channel"}),
+		otnESNR: newStatGauges("dc908_logical_channel_otn_esnr", "_db",
+			"Electrical signal to noise ratio of a logical channel in dB",
+			[]string{"logical_channel"}),
+		logicalChannelAssignmentInfo: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_logical_channel_assignment_info",
+			Help: "Optical channel a logical channel and its client port are carried on.",
+		},
+			[]string{"logical_channel", "client_port", "optical_channel"}),
+		alarmActive: newGaugeVec(prometheus.GaugeOpts{
+			Name: "dc908_alarm_active",
+			Help: "Alarms currently raised by the device.",
+		},
+			[]string{"id", "resource", "severity", "type"}),
 	}
 	m.r.MustRegister(m.fanRPM)
 	m.r.MustRegister(m.temperature)
@@ -148,27 +318,311 @@ func NewMetricRegistry() *metricRegistry {
 	m.r.MustRegister(m.laserPolarizationDependetLoss)
 	m.r.MustRegister(m.laserPolarizationModeDispersion)
 	m.r.MustRegister(m.laserFrequencyOffset)
+	m.r.MustRegister(m.laserRxMargin)
+	m.r.MustRegister(m.laserRxOverloadMargin)
+	m.r.MustRegister(m.laserTxLowMargin)
+	m.r.MustRegister(m.laserTxHighMargin)
+	m.r.MustRegister(m.laserBiasLowMargin)
+	m.r.MustRegister(m.laserBiasHighMargin)
+	m.r.MustRegister(m.moduleProfileInfo)
+	m.r.MustRegister(m.componentInfo)
+	m.r.MustRegister(m.componentOperStatus)
+	m.r.MustRegister(m.opticalChannelFrequency)
+	m.r.MustRegister(m.opticalChannelTargetOutputPower)
+	m.r.MustRegister(m.opticalChannelInfo)
+	m.opticalChannelOSNR.register(m.r)
+	m.opticalChannelQValue.register(m.r)
+	for _, cs := range []map[string]*counterVec{m.ethernetCounters, m.otnCounters} {
+		for _, c := range cs {
+			m.r.MustRegister(c)
+		}
+	}
+	m.otnPreFECBER.register(m.r)
+	m.otnPostFECBER.register(m.r)
+	m.otnQValue.register(m.r)
+	m.otnESNR.register(m.r)
+	m.r.MustRegister(m.logicalChannelAssignmentInfo)
+	m.r.MustRegister(m.alarmActive)
 	return m
 }
 
+// gaugeVec is a prometheus.GaugeVec that remembers its name, so decoded
+// values can be reported to observers under their metric family.
+type gaugeVec struct {
+	*prometheus.GaugeVec
+	name string
+}
+
+func newGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *gaugeVec {
+	return &gaugeVec{
+		GaugeVec: prometheus.NewGaugeVec(opts, labelNames),
+		name:     opts.Name,
+	}
+}
+
+// statGauges exports a value along with the statistics of the current PM
+// interval as separate gauges.
+type statGauges struct {
+	instant, min, max, avg *gaugeVec
+}
+
+// newStatGauges creates the gauges <prefix><unit> and <prefix>_{min,max,avg}<unit>.
+func newStatGauges(prefix, unit, help string, labelNames []string) *statGauges {
+	g := func(stat, desc string) *gaugeVec {
+		return newGaugeVec(prometheus.GaugeOpts{
+			Name: prefix + stat + unit,
+			Help: help + desc,
+		}, labelNames)
+	}
+	return &statGauges{
+		instant: g("", "."),
+		min:     g("_min", ", minimum over the current interval."),
+		max:     g("_max", ", maximum over the current interval."),
+		avg:     g("_avg", ", average over the current interval."),
+	}
+}
+
+func (sg *statGauges) register(r *prometheus.Registry) {
+	r.MustRegister(sg.instant, sg.min, sg.max, sg.avg)
+}
+
+// setStats exports r with all its statistics.
+func (m *metricRegistry) setStats(sg *statGauges, labels prometheus.Labels, r reading) {
+	m.set(sg.instant, labels, r)
+	for _, s := range []struct {
+		g *gaugeVec
+		v *float64
+	}{{sg.min, r.Min}, {sg.max, r.Max}, {sg.avg, r.Avg}} {
+		if s.v != nil {
+			s.g.With(labels).Set(*s.v)
+		}
+	}
+}
+
+// reading is a decoded value along with the statistics the DC908 reports for
+// the current PM interval, where available.
+type reading struct {
+	Instant float64
+	Min     *float64
+	Max     *float64
+	Avg     *float64
+}
+
+// apply returns r with f applied to the value and all statistics.
+func (r reading) apply(f func(float64) float64) reading {
+	res := reading{Instant: f(r.Instant)}
+	for _, p := range []struct{ src, dst **float64 }{{&r.Min, &res.Min}, {&r.Max, &res.Max}, {&r.Avg, &res.Avg}} {
+		if *p.src != nil {
+			v := f(**p.src)
+			*p.dst = &v
+		}
+	}
+	return res
+}
+
+// below returns how far r is below limit. The statistics are adjusted so
+// that Min is still the smallest value.
+func (r reading) below(limit float64) reading {
+	res := r.apply(func(v float64) float64 { return limit - v })
+	res.Min, res.Max = res.Max, res.Min
+	return res
+}
+
+// statistic is the JSON encoding of an OpenConfig stat container such as
+// input-power or temperature.
+type statistic struct {
+	Instant json.Number
+	Min     json.Number
+	Max     json.Number
+	Avg     json.Number
+}
+
+func (st *statistic) reading() (reading, error) {
+	v, err := st.Instant.Float64()
+	if err != nil {
+		return reading{}, err
+	}
+	r := reading{Instant: v}
+	for _, p := range []struct {
+		src json.Number
+		dst **float64
+	}{{st.Min, &r.Min}, {st.Max, &r.Max}, {st.Avg, &r.Avg}} {
+		if p.src == "" {
+			continue
+		}
+		if v, err := p.src.Float64(); err == nil {
+			*p.dst = &v
+		}
+	}
+	return r, nil
+}
+
+// decodedUpdate is a single value decoded from a device update.
+type decodedUpdate struct {
+	Metric    string
+	Labels    map[string]string
+	Reading   reading
+	Timestamp time.Time
+}
+
+// OnUpdate registers fn to be called with every value decoded by Update.
+// It must be called before the first update is processed.
+func (m *metricRegistry) OnUpdate(fn func(decodedUpdate)) {
+	m.observers = append(m.observers, fn)
+}
+
+// set exports the instant value of r in g and queues it for observers.
+func (m *metricRegistry) set(g *gaugeVec, labels prometheus.Labels, r reading) {
+	g.With(labels).Set(r.Instant)
+	if len(m.observers) == 0 {
+		return
+	}
+	m.pending = append(m.pending, decodedUpdate{
+		Metric:  g.name,
+		Labels:  labels,
+		Reading: r,
+	})
+}
+
 func (m *metricRegistry) PrometheusRegistry() *prometheus.Registry {
 	return m.r
 }
 
 func (m *metricRegistry) Update(name string, json string) error {
+	return m.UpdateAt(name, time.Now(), json)
+}
+
+// UpdateAt is like Update but records ts as the time the affected component
+// was last updated, normally the timestamp reported by the device.
+func (m *metricRegistry) UpdateAt(name string, ts time.Time, json string) error {
 	log.V(3).Infof("New raw metric for %q: %s", name, json)
+	// Devices that do not know the time report 0, the update is then
+	// stamped with the time it was received.
+	if ts.Unix() <= 0 {
+		ts = time.Now()
+	}
+	component := ""
+	if match := componentPath.FindStringSubmatch(name); match != nil {
+		component = match[1]
+	}
 	for _, mm := range matchers {
 		match := mm.re.FindStringSubmatch(name)
 		if match == nil {
 			continue
 		}
-		if err := mm.cb(m, json, match[1:]); err != nil {
+		err := mm.cb(m, json, match[1:])
+		pending := m.pending
+		m.pending = nil
+		if err != nil {
 			return err
 		}
+		if component != "" {
+			m.lock.Lock()
+			m.updated[component] = ts
+			m.lock.Unlock()
+		}
+		for _, u := range pending {
+			u.Timestamp = ts
+			for _, fn := range m.observers {
+				fn(u)
+			}
+		}
 	}
 	return nil
 }
 
+// Delete handles the deletion of name reported by the device.
+func (m *metricRegistry) Delete(name string) {
+	log.V(3).Infof("Deleted path %q", name)
+	for _, dm := range deleteMatchers {
+		if match := dm.re.FindStringSubmatch(name); match != nil {
+			dm.cb(m, match[1:])
+		}
+	}
+}
+
+// sample is a single decoded value currently exported by a metricRegistry.
+type sample struct {
+	Name      string
+	Help      string
+	Counter   bool
+	Labels    map[string]string
+	Value     float64
+	Timestamp time.Time
+}
+
+// Samples returns the latest decoded values sorted by metric name, each
+// stamped with the last update time of the component it belongs to.
+func (m *metricRegistry) Samples() ([]sample, error) {
+	mfs, err := m.r.Gather()
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var res []sample
+	for _, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			s := sample{
+				Name:   mf.GetName(),
+				Help:   mf.GetHelp(),
+				Labels: make(map[string]string),
+			}
+			for _, lp := range metric.GetLabel() {
+				s.Labels[lp.GetName()] = lp.GetValue()
+			}
+			switch {
+			case metric.GetGauge() != nil:
+				s.Value = metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				s.Value = metric.GetCounter().GetValue()
+				s.Counter = true
+			default:
+				continue
+			}
+			s.Timestamp = m.updated[s.Labels["device"]]
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+var unitSuffixes = []struct {
+	suffix string
+	unit   string
+}{
+	{"_dbm", "dBm"},
+	{"_db", "dB"},
+	{"_celsius", "Cel"},
+	{"_ampere", "A"},
+	{"_amepere", "A"},
+	{"_voltage", "V"},
+	{"_bytes", "By"},
+	{"_ratio", "1"},
+	{"_rpm", "{rpm}"},
+	{"_hertz", "Hz"},
+	{"_ps_nm", "ps/nm"},
+	{"_ps", "ps"},
+}
+
+// metricUnit returns the UCUM unit of a metric exported by metricRegistry
+// based on its name, or an empty string if it is unitless.
+func metricUnit(name string) string {
+	for _, us := range unitSuffixes {
+		if strings.HasSuffix(name, us.suffix) {
+			return us.unit
+		}
+	}
+	return ""
+}
+
+// componentType returns the component type encoded in a DC908 component
+// name, e.g. "TRANSCEIVER" for "TRANSCEIVER-1-1-C1".
+func componentType(name string) string {
+	t, _, _ := strings.Cut(name, "-")
+	return t
+}
+
 func handleFan(m *metricRegistry, j string, groups []string) error {
 	name := groups[0]
 	val := struct {
@@ -179,27 +633,28 @@ func handleFan(m *metricRegistry, j string, groups []string) error {
 		return fmt.Errorf("failed to parse fan metric: %v", err)
 	}
 	log.V(2).Infof("New fan metric for %q: %+v", name, val)
-	m.fanRPM.With(prometheus.Labels{"device": name}).Set(float64(val.Speed))
+	m.set(m.fanRPM, prometheus.Labels{"device": name}, reading{Instant: float64(val.Speed)})
 	return nil
 }
 
 func handleTemperature(m *metricRegistry, j string, groups []string) error {
 	name := groups[0]
 	val := struct {
-		Temperature struct {
-			Instant json.Number
-		}
+		Temperature *statistic
 	}{}
 
 	if err := json.Unmarshal([]byte(j), &val); err != nil {
 		return fmt.Errorf("failed to parse temperature metric: %v", err)
 	}
+	if val.Temperature == nil {
+		return nil
+	}
 	log.V(2).Infof("New temperature metric for %q: %+v", name, val)
-	t, err := val.Temperature.Instant.Float64()
+	t, err := val.Temperature.reading()
 	if err != nil {
 		return err
 	}
-	m.temperature.With(prometheus.Labels{"device": name}).Set(t)
+	m.set(m.temperature, prometheus.Labels{"device": name}, t)
 	return nil
 }
 
@@ -222,27 +677,57 @@ func handleMemory(m *metricRegistry, j string, groups []string) error {
 	if err != nil {
 		return err
 	}
-	m.memoryUtilized.With(prometheus.Labels{"device": name}).Set(float64(memUtil))
+	m.set(m.memoryUtilized, prometheus.Labels{"device": name}, reading{Instant: float64(memUtil)})
+	return nil
+}
+
+func handleComponentState(m *metricRegistry, j string, groups []string) error {
+	name := groups[0]
+	m.lock.Lock()
+	old := m.inventory[name]
+	m.lock.Unlock()
+
+	// Updates may only carry some of the leaves, so they are merged into
+	// what is already known.
+	val := old
+	val.Removable = nil
+	if err := json.Unmarshal([]byte(j), &val); err != nil {
+		return fmt.Errorf("failed to parse component state: %v", err)
+	}
+	if val.Removable == nil {
+		val.Removable = old.Removable
+	}
+	if val.equal(old) {
+		return nil
+	}
+	log.V(2).Infof("New inventory for %q: %+v", name, val)
+	m.lock.Lock()
+	m.inventory[name] = val
+	m.lock.Unlock()
+	m.exportInventory(name, val)
+	if val.PartNo != old.PartNo {
+		// The module may now match another profile, or none at all, so
+		// margins are only exported again with the next laser update.
+		m.forgetMargins(name)
+	}
 	return nil
 }
 
 func handleCPUUtilization(m *metricRegistry, j string, groups []string) error {
 	name := groups[0]
 	val := struct {
-		State struct {
-			Instant json.Number
-		}
+		State statistic
 	}{}
 
 	if err := json.Unmarshal([]byte(j), &val); err != nil {
 		return fmt.Errorf("failed to parse cpu utilization metric: %v", err)
 	}
 	log.V(2).Infof("New CPU utilization metric for %q: %+v", name, val)
-	cpu, err := val.State.Instant.Float64()
+	cpu, err := val.State.reading()
 	if err != nil {
 		return err
 	}
-	m.cpuUtilization.With(prometheus.Labels{"device": name}).Set(cpu / 100.0)
+	m.set(m.cpuUtilization, prometheus.Labels{"device": name}, cpu.apply(func(v float64) float64 { return v / 100.0 }))
 	return nil
 }
 
@@ -282,10 +767,10 @@ func handlePowerSupply(m *metricRegistry, j string, groups []string) error {
 	}
 
 	log.V(2).Infof("New power supply metric for %q: %+v", name, val)
-	m.powerSupplyInputCurrent.With(prometheus.Labels{"device": name}).Set(val.InputCurrent)
-	m.powerSupplyInputVoltage.With(prometheus.Labels{"device": name}).Set(val.InputVoltage)
-	m.powerSupplyOutputCurrent.With(prometheus.Labels{"device": name}).Set(val.OutputCurrent)
-	m.powerSupplyOutputVoltage.With(prometheus.Labels{"device": name}).Set(val.OutputVoltage)
+	m.set(m.powerSupplyInputCurrent, prometheus.Labels{"device": name}, reading{Instant: val.InputCurrent})
+	m.set(m.powerSupplyInputVoltage, prometheus.Labels{"device": name}, reading{Instant: val.InputVoltage})
+	m.set(m.powerSupplyOutputCurrent, prometheus.Labels{"device": name}, reading{Instant: val.OutputCurrent})
+	m.set(m.powerSupplyOutputVoltage, prometheus.Labels{"device": name}, reading{Instant: val.OutputVoltage})
 	return nil
 }
 
@@ -297,59 +782,128 @@ func handleGeneralLaser(m *metricRegistry, j string, groups []string) error {
 		labels = prometheus.Labels{"device": name, "index": index}
 	}
 	val := struct {
-		InputPower *struct {
-			Instant json.Number
-		} `json:"input-power"`
-		LaserBiasCurrent *struct {
-			Instant json.Number
-		} `json:"laser-bias-current"`
-		OutputPower *struct {
-			Instant json.Number
-		} `json:"output-power"`
+		InputPower       *statistic `json:"input-power"`
+		LaserBiasCurrent *statistic `json:"laser-bias-current"`
+		OutputPower      *statistic `json:"output-power"`
 	}{}
 
 	if err := json.Unmarshal([]byte(j), &val); err != nil {
 		return fmt.Errorf("failed to parse general laser metric: %v", err)
 	}
 	log.V(2).Infof("New general laser metric for %v, %+v", labels, val)
+	var in, biasMA, out *reading
 	if val.InputPower != nil {
-		v, err := val.InputPower.Instant.Float64()
+		v, err := val.InputPower.reading()
 		if err != nil {
 			return fmt.Errorf("input-power: %w", err)
 		}
-		m.laserInputPower.With(labels).Set(v)
+		m.set(m.laserInputPower, labels, v)
+		in = &v
 	}
 	if val.LaserBiasCurrent != nil {
-		v, err := val.LaserBiasCurrent.Instant.Float64()
+		v, err := val.LaserBiasCurrent.reading()
 		if err != nil {
 			return fmt.Errorf("laser-bias-current: %w", err)
 		}
-		m.laserBiasCurrent.With(labels).Set(v / 1000.0)
+		m.set(m.laserBiasCurrent, labels, v.apply(func(v float64) float64 { return v / 1000.0 }))
+		biasMA = &v
 	}
 	if val.OutputPower != nil {
-		v, err := val.OutputPower.Instant.Float64()
+		v, err := val.OutputPower.reading()
 		if err != nil {
 			return fmt.Errorf("output-power: %w", err)
 		}
-		m.laserOutputPower.With(labels).Set(v)
+		m.set(m.laserOutputPower, labels, v)
+		out = &v
 	}
+	m.setMargins(labels, in, out, biasMA)
 	return nil
 }
 
+func handleOpticalChannel(m *metricRegistry, j string, groups []string) error {
+	name := groups[0]
+	labels := prometheus.Labels{"device": name}
+	val := struct {
+		Frequency         *json.Number `json:"frequency"`
+		TargetOutputPower *json.Number `json:"target-output-power"`
+		OperationalMode   *json.Number `json:"operational-mode"`
+		LinePort          *string      `json:"line-port"`
+		OSNR              *statistic   `json:"osnr"`
+		QValue            *statistic   `json:"q-value"`
+	}{}
+
+	if err := json.Unmarshal([]byte(j), &val); err != nil {
+		return fmt.Errorf("failed to parse optical channel metric: %v", err)
+	}
+	log.V(2).Infof("New optical channel metric for %v, %+v", labels, val)
+
+	if val.Frequency != nil {
+		// The frequency is reported in MHz.
+		f, err := val.Frequency.Float64()
+		if err != nil {
+			return fmt.Errorf("frequency: %w", err)
+		}
+		m.set(m.opticalChannelFrequency, labels, reading{Instant: f * 1000 * 1000})
+	}
+	if val.TargetOutputPower != nil {
+		p, err := val.TargetOutputPower.Float64()
+		if err != nil {
+			return fmt.Errorf("target-output-power: %w", err)
+		}
+		m.set(m.opticalChannelTargetOutputPower, labels, reading{Instant: p})
+	}
+	if val.OperationalMode != nil || val.LinePort != nil {
+		// Updates may only carry one of the leaves, so they are merged into
+		// what is already known.
+		info := m.opticalChannelInfos[name]
+		if val.OperationalMode != nil {
+			info.OperationalMode = val.OperationalMode.String()
+		}
+		if val.LinePort != nil {
+			info.LinePort = *val.LinePort
+		}
+		m.opticalChannelInfos[name] = info
+		m.opticalChannelInfo.DeletePartialMatch(labels)
+		m.opticalChannelInfo.With(prometheus.Labels{
+			"device":           name,
+			"operational_mode": info.OperationalMode,
+			"line_port":        info.LinePort,
+		}).Set(1)
+	}
+	if val.OSNR != nil {
+		r, err := val.OSNR.reading()
+		if err != nil {
+			return fmt.Errorf("osnr: %w", err)
+		}
+		m.setStats(m.opticalChannelOSNR, labels, r)
+	}
+	if val.QValue != nil {
+		r, err := val.QValue.reading()
+		if err != nil {
+			return fmt.Errorf("q-value: %w", err)
+		}
+		m.setStats(m.opticalChannelQValue, labels, r)
+	}
+	return nil
+}
+
+// opticalChannelInfo is the last reported operational mode and line port of
+// an optical channel, leaves that were not reported yet are empty.
+type opticalChannelInfo struct {
+	OperationalMode string
+	LinePort        string
+}
+
 func handleTerminalLaser(m *metricRegistry, j string, groups []string) error {
 	name := groups[0]
 	labels := prometheus.Labels{"device": name}
+	// Updates may only carry some of the leaves, the others keep their
+	// last value.
 	val := struct {
-		ChromaticDispersion struct {
-			Instant json.Number
-		} `json:"chromatic-dispersion"`
-		PolarizationDependentLoss struct {
-			Instant json.Number
-		} `json:"polarization-dependent-loss"`
-		PolarizationModeDispersion struct {
-			Instant json.Number
-		} `json:"polarization-mode-dispersion"`
-		LaserFrequencyOffset json.Number `json:"laser-freq-offset"`
+		ChromaticDispersion        statistic   `json:"chromatic-dispersion"`
+		PolarizationDependentLoss  statistic   `json:"polarization-dependent-loss"`
+		PolarizationModeDispersion statistic   `json:"polarization-mode-dispersion"`
+		LaserFrequencyOffset       json.Number `json:"laser-freq-offset"`
 	}{}
 
 	if err := json.Unmarshal([]byte(j), &val); err != nil {
@@ -357,25 +911,30 @@ func handleTerminalLaser(m *metricRegistry, j string, groups []string) error {
 	}
 	log.V(2).Infof("New terminal laser metric for %v, %+v", labels, val)
 
-	freqOff, err := val.LaserFrequencyOffset.Float64()
-	if err != nil {
-		return fmt.Errorf("laser-freq-offset: %w", err)
-	}
-	cd, err := val.ChromaticDispersion.Instant.Float64()
-	if err != nil {
-		return fmt.Errorf("chromatic-dispersion: %w", err)
-	}
-	pdl, err := val.PolarizationDependentLoss.Instant.Float64()
-	if err != nil {
-		return fmt.Errorf("polarization-dependent-loss: %w", err)
+	for _, s := range []struct {
+		leaf string
+		st   statistic
+		g    *gaugeVec
+	}{
+		{"chromatic-dispersion", val.ChromaticDispersion, m.laserChromaticDispersion},
+		{"polarization-dependent-loss", val.PolarizationDependentLoss, m.laserPolarizationDependetLoss},
+		{"polarization-mode-dispersion", val.PolarizationModeDispersion, m.laserPolarizationModeDispersion},
+	} {
+		if s.st.Instant == "" {
+			continue
+		}
+		r, err := s.st.reading()
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.leaf, err)
+		}
+		m.set(s.g, labels, r)
 	}
-	pmd, err := val.PolarizationModeDispersion.Instant.Float64()
-	if err != nil {
-		return fmt.Errorf("polarization-mode-dispersion: %w", err)
+	if val.LaserFrequencyOffset != "" {
+		freqOff, err := val.LaserFrequencyOffset.Float64()
+		if err != nil {
+			return fmt.Errorf("laser-freq-offset: %w", err)
+		}
+		m.set(m.laserFrequencyOffset, labels, reading{Instant: freqOff * 1000 * 1000})
 	}
-	m.laserChromaticDispersion.With(labels).Set(cd)
-	m.laserPolarizationDependetLoss.With(labels).Set(pdl)
-	m.laserPolarizationModeDispersion.With(labels).Set(pmd)
-	m.laserFrequencyOffset.With(labels).Set(freqOff * 1000 * 1000)
 	return nil
 }
@@ -179,3 +179,288 @@ dc908_temperature_celsius{device="TRANSCEIVER-1-1-L2"} 50
 		})
 	}
 }
+
+func TestMetricUnit(t *testing.T) {
+	var tests = []struct {
+		name string
+		unit string
+	}{
+		{"dc908_laser_input_power_dbm", "dBm"},
+		{"dc908_laser_polarization_dependent_loss_db", "dB"},
+		{"dc908_temperature_celsius", "Cel"},
+		{"dc908_power_supply_input_current_ampere", "A"},
+		{"dc908_laser_bias_current_amepere", "A"},
+		{"dc908_power_supply_output_voltage", "V"},
+		{"dc908_memory_utilized_bytes", "By"},
+		{"dc908_laser_chromatic_dispersion_ps_nm", "ps/nm"},
+		{"dc908_laser_polarization_mode_dispersion_ps", "ps"},
+		{"probe_success", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metricUnit(tt.name); got != tt.unit {
+				t.Errorf("metricUnit(%q) = %q, want %q", tt.name, got, tt.unit)
+			}
+		})
+	}
+}
+
+func TestOpticalChannelMetrics(t *testing.T) {
+	mr := NewMetricRegistry()
+	names := []string{
+		"dc908_optical_channel_frequency_hertz",
+		"dc908_optical_channel_target_output_power_dbm",
+		"dc908_optical_channel_info",
+		"dc908_optical_channel_osnr_db",
+		"dc908_optical_channel_osnr_min_db",
+		"dc908_optical_channel_osnr_max_db",
+		"dc908_optical_channel_osnr_avg_db",
+		"dc908_optical_channel_q_value_db",
+		"dc908_optical_channel_q_value_min_db",
+		"dc908_optical_channel_q_value_max_db",
+		"dc908_optical_channel_q_value_avg_db",
+	}
+	const base = `"chromatic-dispersion":{"instant":"-3"},"polarization-dependent-loss":{"instant":"0.5"},"polarization-mode-dispersion":{"instant":"1"},"laser-freq-offset":"880"`
+
+	var tests = []struct {
+		name string
+		json string
+		em   string
+	}{
+		{"full state", `{` + base + `,"frequency":"193100000","target-output-power":"-2.5","operational-mode":3,"line-port":"PORT-1-1-L1","osnr":{"instant":"30.5","min":"30","max":"31.5","avg":"30.75"},"q-value":{"instant":"11.25","min":"11","max":"12","avg":"11.5"}}`, `
+# HELP dc908_optical_channel_frequency_hertz Frequency of an optical channel.
+# TYPE dc908_optical_channel_frequency_hertz gauge
+dc908_optical_channel_frequency_hertz{device="OCH-1-1-L1"} 1.931e+14
+# HELP dc908_optical_channel_info Operational mode and line port of an optical channel.
+# TYPE dc908_optical_channel_info gauge
+dc908_optical_channel_info{device="OCH-1-1-L1",line_port="PORT-1-1-L1",operational_mode="3"} 1
+# HELP dc908_optical_channel_osnr_avg_db Optical signal to noise ratio of an optical channel in dB, average over the current interval.
+# TYPE dc908_optical_channel_osnr_avg_db gauge
+dc908_optical_channel_osnr_avg_db{device="OCH-1-1-L1"} 30.75
+# HELP dc908_optical_channel_osnr_db Optical signal to noise ratio of an optical channel in dB.
+# TYPE dc908_optical_channel_osnr_db gauge
+dc908_optical_channel_osnr_db{device="OCH-1-1-L1"} 30.5
+# HELP dc908_optical_channel_osnr_max_db Optical signal to noise ratio of an optical channel in dB, maximum over the current interval.
+# TYPE dc908_optical_channel_osnr_max_db gauge
+dc908_optical_channel_osnr_max_db{device="OCH-1-1-L1"} 31.5
+# HELP dc908_optical_channel_osnr_min_db Optical signal to noise ratio of an optical channel in dB, minimum over the current interval.
+# TYPE dc908_optical_channel_osnr_min_db gauge
+dc908_optical_channel_osnr_min_db{device="OCH-1-1-L1"} 30
+# HELP dc908_optical_channel_q_value_avg_db Quality factor of an optical channel in dB, average over the current interval.
+# TYPE dc908_optical_channel_q_value_avg_db gauge
+dc908_optical_channel_q_value_avg_db{device="OCH-1-1-L1"} 11.5
+# HELP dc908_optical_channel_q_value_db Quality factor of an optical channel in dB.
+# TYPE dc908_optical_channel_q_value_db gauge
+dc908_optical_channel_q_value_db{device="OCH-1-1-L1"} 11.25
+# HELP dc908_optical_channel_q_value_max_db Quality factor of an optical channel in dB, maximum over the current interval.
+# TYPE dc908_optical_channel_q_value_max_db gauge
+dc908_optical_channel_q_value_max_db{device="OCH-1-1-L1"} 12
+# HELP dc908_optical_channel_q_value_min_db Quality factor of an optical channel in dB, minimum over the current interval.
+# TYPE dc908_optical_channel_q_value_min_db gauge
+dc908_optical_channel_q_value_min_db{device="OCH-1-1-L1"} 11
+# HELP dc908_optical_channel_target_output_power_dbm Target output optical power of an optical channel in dBm.
+# TYPE dc908_optical_channel_target_output_power_dbm gauge
+dc908_optical_channel_target_output_power_dbm{device="OCH-1-1-L1"} -2.5
+`},
+		{"mode change replaces the info", `{` + base + `,"frequency":"193150000","operational-mode":5,"line-port":"PORT-1-1-L1","osnr":{"instant":"29"},"q-value":{"instant":"10.5"}}`, `
+# HELP dc908_optical_channel_frequency_hertz Frequency of an optical channel.
+# TYPE dc908_optical_channel_frequency_hertz gauge
+dc908_optical_channel_frequency_hertz{device="OCH-1-1-L1"} 1.9315e+14
+# HELP dc908_optical_channel_info Operational mode and line port of an optical channel.
+# TYPE dc908_optical_channel_info gauge
+dc908_optical_channel_info{device="OCH-1-1-L1",line_port="PORT-1-1-L1",operational_mode="5"} 1
+# HELP dc908_optical_channel_osnr_avg_db Optical signal to noise ratio of an optical channel in dB, average over the current interval.
+# TYPE dc908_optical_channel_osnr_avg_db gauge
+dc908_optical_channel_osnr_avg_db{device="OCH-1-1-L1"} 30.75
+# HELP dc908_optical_channel_osnr_db Optical signal to noise ratio of an optical channel in dB.
+# TYPE dc908_optical_channel_osnr_db gauge
+dc908_optical_channel_osnr_db{device="OCH-1-1-L1"} 29
+# HELP dc908_optical_channel_osnr_max_db Optical signal to noise ratio of an optical channel in dB, maximum over the current interval.
+# TYPE dc908_optical_channel_osnr_max_db gauge
+dc908_optical_channel_osnr_max_db{device="OCH-1-1-L1"} 31.5
+# HELP dc908_optical_channel_osnr_min_db Optical signal to noise ratio of an optical channel in dB, minimum over the current interval.
+# TYPE dc908_optical_channel_osnr_min_db gauge
+dc908_optical_channel_osnr_min_db{device="OCH-1-1-L1"} 30
+# HELP dc908_optical_channel_q_value_avg_db Quality factor of an optical channel in dB, average over the current interval.
+# TYPE dc908_optical_channel_q_value_avg_db gauge
+dc908_optical_channel_q_value_avg_db{device="OCH-1-1-L1"} 11.5
+# HELP dc908_optical_channel_q_value_db Quality factor of an optical channel in dB.
+# TYPE dc908_optical_channel_q_value_db gauge
+dc908_optical_channel_q_value_db{device="OCH-1-1-L1"} 10.5
+# HELP dc908_optical_channel_q_value_max_db Quality factor of an optical channel in dB, maximum over the current interval.
+# TYPE dc908_optical_channel_q_value_max_db gauge
+dc908_optical_channel_q_value_max_db{device="OCH-1-1-L1"} 12
+# HELP dc908_optical_channel_q_value_min_db Quality factor of an optical channel in dB, minimum over the current interval.
+# TYPE dc908_optical_channel_q_value_min_db gauge
+dc908_optical_channel_q_value_min_db{device="OCH-1-1-L1"} 11
+# HELP dc908_optical_channel_target_output_power_dbm Target output optical power of an optical channel in dBm.
+# TYPE dc908_optical_channel_target_output_power_dbm gauge
+dc908_optical_channel_target_output_power_dbm{device="OCH-1-1-L1"} -2.5
+`},
+		{"partial update keeps the mode", `{"line-port":"PORT-1-1-L2"}`, `
+# HELP dc908_optical_channel_frequency_hertz Frequency of an optical channel.
+# TYPE dc908_optical_channel_frequency_hertz gauge
+dc908_optical_channel_frequency_hertz{device="OCH-1-1-L1"} 1.9315e+14
+# HELP dc908_optical_channel_info Operational mode and line port of an optical channel.
+# TYPE dc908_optical_channel_info gauge
+dc908_optical_channel_info{device="OCH-1-1-L1",line_port="PORT-1-1-L2",operational_mode="5"} 1
+# HELP dc908_optical_channel_osnr_avg_db Optical signal to noise ratio of an optical channel in dB, average over the current interval.
+# TYPE dc908_optical_channel_osnr_avg_db gauge
+dc908_optical_channel_osnr_avg_db{device="OCH-1-1-L1"} 30.75
+# HELP dc908_optical_channel_osnr_db Optical signal to noise ratio of an optical channel in dB.
+# TYPE dc908_optical_channel_osnr_db gauge
+dc908_optical_channel_osnr_db{device="OCH-1-1-L1"} 29
+# HELP dc908_optical_channel_osnr_max_db Optical signal to noise ratio of an optical channel in dB, maximum over the current interval.
+# TYPE dc908_optical_channel_osnr_max_db gauge
+dc908_optical_channel_osnr_max_db{device="OCH-1-1-L1"} 31.5
+# HELP dc908_optical_channel_osnr_min_db Optical signal to noise ratio of an optical channel in dB, minimum over the current interval.
+# TYPE dc908_optical_channel_osnr_min_db gauge
+dc908_optical_channel_osnr_min_db{device="OCH-1-1-L1"} 30
+# HELP dc908_optical_channel_q_value_avg_db Quality factor of an optical channel in dB, average over the current interval.
+# TYPE dc908_optical_channel_q_value_avg_db gauge
+dc908_optical_channel_q_value_avg_db{device="OCH-1-1-L1"} 11.5
+# HELP dc908_optical_channel_q_value_db Quality factor of an optical channel in dB.
+# TYPE dc908_optical_channel_q_value_db gauge
+dc908_optical_channel_q_value_db{device="OCH-1-1-L1"} 10.5
+# HELP dc908_optical_channel_q_value_max_db Quality factor of an optical channel in dB, maximum over the current interval.
+# TYPE dc908_optical_channel_q_value_max_db gauge
+dc908_optical_channel_q_value_max_db{device="OCH-1-1-L1"} 12
+# HELP dc908_optical_channel_q_value_min_db Quality factor of an optical channel in dB, minimum over the current interval.
+# TYPE dc908_optical_channel_q_value_min_db gauge
+dc908_optical_channel_q_value_min_db{device="OCH-1-1-L1"} 11
+# HELP dc908_optical_channel_target_output_power_dbm Target output optical power of an optical channel in dBm.
+# TYPE dc908_optical_channel_target_output_power_dbm gauge
+dc908_optical_channel_target_output_power_dbm{device="OCH-1-1-L1"} -2.5
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := mr.Update("/openconfig-platform:components/component[name=OCH-1-1-L1]/openconfig-terminal-device:optical-channel/state", tt.json); err != nil {
+				t.Fatalf("metric update: %v", err)
+			}
+			if err := testutil.GatherAndCompare(mr.PrometheusRegistry(), strings.NewReader(tt.em), names...); err != nil {
+				t.Errorf("metric compare: err %v", err)
+			}
+		})
+	}
+}
+
+func TestTerminalLaserPartialUpdates(t *testing.T) {
+	mr := NewMetricRegistry()
+	names := []string{
+		"dc908_laser_chromatic_dispersion_ps_nm",
+		"dc908_laser_polarization_mode_dispersion_ps",
+		"dc908_laser_frequency_offset_hertz",
+	}
+	var tests = []struct {
+		name string
+		json string
+		em   string
+	}{
+		{"single leaf", `{"chromatic-dispersion":{"instant":"-3","min":"-4"}}`, `
+# HELP dc908_laser_chromatic_dispersion_ps_nm Chromatic Dispersion of an optical channel in picoseconds / nanometer (ps/nm).
+# TYPE dc908_laser_chromatic_dispersion_ps_nm gauge
+dc908_laser_chromatic_dispersion_ps_nm{device="OCH-1-1-L1"} -3
+`},
+		{"other leaves are kept", `{"polarization-mode-dispersion":{"instant":"1"},"laser-freq-offset":"880"}`, `
+# HELP dc908_laser_chromatic_dispersion_ps_nm Chromatic Dispersion of an optical channel in picoseconds / nanometer (ps/nm).
+# TYPE dc908_laser_chromatic_dispersion_ps_nm gauge
+dc908_laser_chromatic_dispersion_ps_nm{device="OCH-1-1-L1"} -3
+# HELP dc908_laser_frequency_offset_hertz Frequency offset from reference frequency.
+# TYPE dc908_laser_frequency_offset_hertz gauge
+dc908_laser_frequency_offset_hertz{device="OCH-1-1-L1"} 8.8e+08
+# HELP dc908_laser_polarization_mode_dispersion_ps Polarization Mode Dispersion of an optical channel in picoseconds (ps).
+# TYPE dc908_laser_polarization_mode_dispersion_ps gauge
+dc908_laser_polarization_mode_dispersion_ps{device="OCH-1-1-L1"} 1
+`},
+		{"statistics are replaced", `{"chromatic-dispersion":{"instant":"-2"}}`, `
+# HELP dc908_laser_chromatic_dispersion_ps_nm Chromatic Dispersion of an optical channel in picoseconds / nanometer (ps/nm).
+# TYPE dc908_laser_chromatic_dispersion_ps_nm gauge
+dc908_laser_chromatic_dispersion_ps_nm{device="OCH-1-1-L1"} -2
+# HELP dc908_laser_frequency_offset_hertz Frequency offset from reference frequency.
+# TYPE dc908_laser_frequency_offset_hertz gauge
+dc908_laser_frequency_offset_hertz{device="OCH-1-1-L1"} 8.8e+08
+# HELP dc908_laser_polarization_mode_dispersion_ps Polarization Mode Dispersion of an optical channel in picoseconds (ps).
+# TYPE dc908_laser_polarization_mode_dispersion_ps gauge
+dc908_laser_polarization_mode_dispersion_ps{device="OCH-1-1-L1"} 1
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := mr.Update("/openconfig-platform:components/component[name=OCH-1-1-L1]/openconfig-terminal-device:optical-channel/state", tt.json); err != nil {
+				t.Fatalf("metric update: %v", err)
+			}
+			if err := testutil.GatherAndCompare(mr.PrometheusRegistry(), strings.NewReader(tt.em), names...); err != nil {
+				t.Errorf("metric compare: err %v", err)
+			}
+		})
+	}
+
+	// Observers only get the leaves of the update, without earlier statistics.
+	var got []decodedUpdate
+	mr.OnUpdate(func(u decodedUpdate) { got = append(got, u) })
+	if err := mr.Update("/openconfig-platform:components/component[name=OCH-1-1-L1]/openconfig-terminal-device:optical-channel/state", `{"chromatic-dispersion":{"instant":"-1"}}`); err != nil {
+		t.Fatalf("metric update: %v", err)
+	}
+	if len(got) != 1 || got[0].Metric != "dc908_laser_chromatic_dispersion_ps_nm" || got[0].Reading.Instant != -1 || got[0].Reading.Min != nil {
+		t.Errorf("observed %+v, want only chromatic-dispersion -1 without min", got)
+	}
+}
+
+func TestComponentUpdateTimes(t *testing.T) {
+	mr := NewMetricRegistry()
+	const fan = "/openconfig-platform:components/component[name=FAN-1-33]"
+	const alarm = "/openconfig-system:system/alarms/alarm[id=1]/state"
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := mr.UpdateAt(fan+"/fan/state", ts, `{"speed":4500}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+	// Alarms and logical channels are not components.
+	if err := mr.UpdateAt(alarm, ts, `{"resource":"FAN-1-33","severity":"MAJOR"}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+	if err := mr.UpdateAt(logicalChannelPrefix+"[index=100]/ethernet/state", ts, `{"in-pcs-bip-errors":"12"}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+	samples, err := mr.Samples()
+	if err != nil {
+		t.Fatalf("Samples: %v", err)
+	}
+	for _, s := range samples {
+		if s.Labels["device"] == "" {
+			continue
+		}
+		if !s.Timestamp.Equal(ts) {
+			t.Errorf("%s%v updated at %v, want %v", s.Name, s.Labels, s.Timestamp, ts)
+		}
+	}
+	if len(mr.updated) != 1 {
+		t.Errorf("updated = %v, want only FAN-1-33", mr.updated)
+	}
+
+	// Updates of a device without a clock are stamped when received.
+	start := time.Now()
+	if err := mr.UpdateAt(fan+"/fan/state", time.UnixMicro(0), `{"speed":4600}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+	if got := mr.updated["FAN-1-33"]; got.Before(start) {
+		t.Errorf("FAN-1-33 updated at %v, want the receive time", got)
+	}
+}
+
+func TestObserversGetReceiveTimeWithoutDeviceClock(t *testing.T) {
+	mr := NewMetricRegistry()
+	var got []time.Time
+	mr.OnUpdate(func(u decodedUpdate) { got = append(got, u.Timestamp) })
+	start := time.Now()
+	if err := mr.UpdateAt("/openconfig-platform:components/component[name=FAN-1-33]/fan/state", time.UnixMicro(0), `{"speed":4500}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+	if len(got) != 1 || got[0].Before(start) {
+		t.Errorf("observed timestamps %v, want the receive time", got)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+var (
+	otlpEndpoint = flag.String("otlp-endpoint", "", "URL of an OpenTelemetry collector to export metrics to, e.g. http://localhost:4317")
+	otlpProtocol = flag.String("otlp-protocol", "grpc", "OTLP transport to use, either grpc or http/protobuf")
+	otlpHeaders  = flag.String("otlp-headers", "", "comma separated list of key=value headers to send with every OTLP export")
+	otlpInterval = flag.Duration("otlp-interval", 30*time.Second, "how often to export metrics over OTLP")
+)
+
+const otlpScope = "github.com/sonix-network/dc908_exporter"
+
+// OTLPExporter periodically exports the decoded samples of all connected
+// devices over OTLP, with every device as its own resource.
+type OTLPExporter struct {
+	srv      *Server
+	exp      sdkmetric.Exporter
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// ParseOTLPHeaders parses a comma separated list of key=value pairs.
+func ParseOTLPHeaders(s string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected key=value", kv)
+		}
+		res[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return res, nil
+}
+
+func NewOTLPExporter(ctx context.Context, srv *Server, protocol string, endpoint string, headers map[string]string, interval time.Duration) (*OTLPExporter, error) {
+	var exp sdkmetric.Exporter
+	var err error
+	switch protocol {
+	case "grpc":
+		exp, err = otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(endpoint), otlpmetricgrpc.WithHeaders(headers))
+	case "http/protobuf", "http":
+		exp, err = otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(endpoint), otlpmetrichttp.WithHeaders(headers))
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	o := &OTLPExporter{
+		srv:      srv,
+		exp:      exp,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go o.run()
+	return o, nil
+}
+
+func (o *OTLPExporter) run() {
+	defer close(o.done)
+	t := time.NewTicker(o.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), o.interval)
+			o.export(ctx)
+			cancel()
+		}
+	}
+}
+
+func (o *OTLPExporter) export(ctx context.Context) {
+	now := time.Now()
+	for target, c := range o.srv.sessionClients() {
+		rm, err := o.resourceMetrics(target, c, now)
+		if err != nil {
+			log.Warningf("Failed to gather samples of %q for OTLP: %v", target, err)
+			continue
+		}
+		if err := o.exp.Export(ctx, rm); err != nil {
+			log.Warningf("Failed to export metrics of %q over OTLP: %v", target, err)
+		}
+	}
+}
+
+// deviceResource returns the OTel resource describing a DC908, including the
+// inventory of its chassis if known.
+func deviceResource(target string, mr *metricRegistry) *resource.Resource {
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", "dc908"),
+		attribute.String("host.name", target),
+		attribute.String("net.peer.ip", target),
+	}
+	if ci, ok := mr.chassis(); ok {
+		for _, a := range []struct {
+			key, value string
+		}{
+			{"device.manufacturer", ci.MfgName},
+			{"device.model.identifier", ci.PartNo},
+			{"device.id", ci.SerialNo},
+			{"dc908.hardware_version", ci.HardwareVersion},
+			{"dc908.firmware_version", ci.FirmwareVersion},
+			{"dc908.software_version", ci.SoftwareVersion},
+		} {
+			if a.value != "" {
+				attrs = append(attrs, attribute.String(a.key, a.value))
+			}
+		}
+	}
+	return resource.NewSchemaless(attrs...)
+}
+
+// resourceMetrics returns the samples of the device connected as c. Counters
+// start with the session, as they are reset on reconnect, and samples without
+// a device timestamp are stamped with the collection time now.
+func (o *OTLPExporter) resourceMetrics(target string, c *Client, now time.Time) (*metricdata.ResourceMetrics, error) {
+	mr := c.mr
+	samples, err := mr.Samples()
+	if err != nil {
+		return nil, err
+	}
+	sm := metricdata.ScopeMetrics{Scope: instrumentation.Scope{Name: otlpScope}}
+	// Samples are sorted by name, so each run of equal names is one metric.
+	for i := 0; i < len(samples); {
+		j := i
+		for j < len(samples) && samples[j].Name == samples[i].Name {
+			j++
+		}
+		group := samples[i:j]
+		i = j
+
+		dps := make([]metricdata.DataPoint[float64], 0, len(group))
+		for _, s := range group {
+			ts := s.Timestamp
+			if ts.IsZero() {
+				ts = now
+			}
+			dps = append(dps, metricdata.DataPoint[float64]{
+				Attributes: labelSet(s.Labels),
+				StartTime:  c.connected,
+				Time:       ts,
+				Value:      s.Value,
+			})
+		}
+		m := metricdata.Metrics{
+			Name:        group[0].Name,
+			Description: group[0].Help,
+			Unit:        metricUnit(group[0].Name),
+		}
+		if group[0].Counter {
+			m.Data = metricdata.Sum[float64]{
+				DataPoints:  dps,
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			}
+		} else {
+			m.Data = metricdata.Gauge[float64]{DataPoints: dps}
+		}
+		sm.Metrics = append(sm.Metrics, m)
+	}
+	return &metricdata.ResourceMetrics{
+		Resource:     deviceResource(target, mr),
+		ScopeMetrics: []metricdata.ScopeMetrics{sm},
+	}, nil
+}
+
+func labelSet(labels map[string]string) attribute.Set {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]attribute.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, attribute.String(k, labels[k]))
+	}
+	return attribute.NewSet(kvs...)
+}
+
+// Close exports the current state one last time and shuts down the exporter.
+func (o *OTLPExporter) Close(ctx context.Context) error {
+	close(o.stop)
+	<-o.done
+	o.export(ctx)
+	return o.exp.Shutdown(ctx)
+}
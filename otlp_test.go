@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver is a stand-in OpenTelemetry collector for both OTLP/gRPC and
+// OTLP/HTTP.
+type otlpReceiver struct {
+	lock sync.Mutex
+	rms  []*metricspb.ResourceMetrics
+
+	colmetricspb.UnimplementedMetricsServiceServer
+}
+
+func (or *otlpReceiver) Export(_ context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	or.lock.Lock()
+	defer or.lock.Unlock()
+	or.rms = append(or.rms, req.GetResourceMetrics()...)
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func (or *otlpReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, _ := or.Export(r.Context(), req)
+	b, _ := proto.Marshal(resp)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(b)
+}
+
+func (or *otlpReceiver) received() []*metricspb.ResourceMetrics {
+	or.lock.Lock()
+	defer or.lock.Unlock()
+	return append([]*metricspb.ResourceMetrics{}, or.rms...)
+}
+
+func TestOTLPExport(t *testing.T) {
+	var tests = []struct {
+		protocol string
+		start    func(t *testing.T, or *otlpReceiver) string
+	}{
+		{"grpc", func(t *testing.T, or *otlpReceiver) string {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			s := grpc.NewServer()
+			colmetricspb.RegisterMetricsServiceServer(s, or)
+			go s.Serve(lis)
+			t.Cleanup(s.Stop)
+			return "http://" + lis.Addr().String()
+		}},
+		{"http/protobuf", func(t *testing.T, or *otlpReceiver) string {
+			hs := httptest.NewServer(or)
+			t.Cleanup(hs.Close)
+			return hs.URL + "/v1/metrics"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			assert := assert.New(t)
+			or := &otlpReceiver{}
+			endpoint := tt.start(t, or)
+
+			mr := NewMetricRegistry()
+			ts := time.Date(2024, 7, 7, 19, 59, 6, 0, time.UTC)
+			for _, u := range []struct{ path, json string }{
+				{"/openconfig-platform:components/component[name=TRANSCEIVER-1-1-L1]/openconfig-platform-transceiver:transceiver/state", `{"input-power":{"instant":-14.3}}`},
+				{"/openconfig-platform:components/component[name=TRANSCEIVER-1-1-L1]/state", `{"temperature":{"instant":50}}`},
+				{"/openconfig-platform:components/component[name=CHASSIS-1]/state", `{"type":"openconfig-platform-types:CHASSIS","mfg-name":"Huawei","serial-no":"2102351234","software-version":"V100R021C00"}`},
+			} {
+				if err := mr.UpdateAt(u.path, ts, u.json); err != nil {
+					t.Fatalf("UpdateAt: %v", err)
+				}
+			}
+			// Logical channels carry no device timestamp.
+			if err := mr.Update(logicalChannelPrefix+"[index=100]/ethernet/state", `{"in-pcs-bip-errors":"12"}`); err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+
+			srv := testServerWith("10.0.0.1", mr)
+			connected := srv.clients["10.0.0.1"].connected
+			start := time.Now()
+			o, err := NewOTLPExporter(context.Background(), srv, tt.protocol, endpoint, map[string]string{"x-tenant": "optics"}, time.Hour)
+			if err != nil {
+				t.Fatalf("NewOTLPExporter: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), waitFor)
+			defer cancel()
+			assert.NoError(o.Close(ctx))
+
+			rms := or.received()
+			if !assert.Len(rms, 1) {
+				return
+			}
+			attrs := make(map[string]string)
+			for _, kv := range rms[0].GetResource().GetAttributes() {
+				attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+			}
+			assert.Equal("10.0.0.1", attrs["host.name"])
+			assert.Equal("10.0.0.1", attrs["net.peer.ip"])
+			assert.Equal("Huawei", attrs["device.manufacturer"])
+			assert.Equal("2102351234", attrs["device.id"])
+			assert.Equal("V100R021C00", attrs["dc908.software_version"])
+			assert.NotContains(attrs, "dc908.hardware_version")
+
+			metrics := make(map[string]*metricspb.Metric)
+			for _, m := range rms[0].GetScopeMetrics()[0].GetMetrics() {
+				metrics[m.GetName()] = m
+			}
+			temp := metrics["dc908_temperature_celsius"]
+			if assert.NotNil(temp) {
+				assert.Equal("Cel", temp.GetUnit())
+				dp := temp.GetGauge().GetDataPoints()[0]
+				assert.EqualValues(50, dp.GetAsDouble())
+				assert.EqualValues(ts.UnixNano(), dp.GetTimeUnixNano())
+			}
+			power := metrics["dc908_laser_input_power_dbm"]
+			if assert.NotNil(power) {
+				assert.Equal("dBm", power.GetUnit())
+				dp := power.GetGauge().GetDataPoints()[0]
+				assert.EqualValues(-14.3, dp.GetAsDouble())
+				labels := make(map[string]string)
+				for _, kv := range dp.GetAttributes() {
+					labels[kv.GetKey()] = kv.GetValue().GetStringValue()
+				}
+				assert.Equal(map[string]string{"device": "TRANSCEIVER-1-1-L1", "index": ""}, labels)
+			}
+			bip := metrics["dc908_logical_channel_ethernet_in_pcs_bip_errors_total"]
+			if assert.NotNil(bip) {
+				dp := bip.GetSum().GetDataPoints()[0]
+				assert.EqualValues(12, dp.GetAsDouble())
+				// Counters restart with the session.
+				assert.EqualValues(connected.UnixNano(), dp.GetStartTimeUnixNano())
+				assert.GreaterOrEqual(dp.GetTimeUnixNano(), uint64(start.UnixNano()))
+			}
+		})
+	}
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+	h, err := ParseOTLPHeaders("authorization=Bearer abc, x-tenant=optics")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"authorization": "Bearer abc", "x-tenant": "optics"}, h)
+
+	_, err = ParseOTLPHeaders("broken")
+	assert.Error(t, err)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	moduleProfiles = flag.String("module-profiles", "", "path to a YAML catalog of optical module profiles to export margins against")
+)
+
+type ModuleCatalog struct {
+	Profiles []ModuleProfile `yaml:"profiles"`
+}
+
+// ModuleProfile describes the operating range of an optical module. It
+// applies to components whose reported part number matches one of
+// PartNumbers, or failing that, whose name matches one of Components.
+type ModuleProfile struct {
+	Name        string   `yaml:"name"`
+	PartNumbers []string `yaml:"part_numbers"`
+	Components  []string `yaml:"components"`
+
+	RxSensitivityDBM *float64 `yaml:"rx_sensitivity_dbm"`
+	RxOverloadDBM    *float64 `yaml:"rx_overload_dbm"`
+	TxMinDBM         *float64 `yaml:"tx_min_dbm"`
+	TxMaxDBM         *float64 `yaml:"tx_max_dbm"`
+	BiasMinMA        *float64 `yaml:"bias_min_ma"`
+	BiasMaxMA        *float64 `yaml:"bias_max_ma"`
+}
+
+// LoadModuleCatalog reads a module profile catalog.
+func LoadModuleCatalog(fn string) (*ModuleCatalog, error) {
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	mc := &ModuleCatalog{}
+	if err := yaml.Unmarshal(d, mc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", fn, err)
+	}
+	for i, p := range mc.Profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("profile %d has no name", i)
+		}
+		if len(p.PartNumbers) == 0 && len(p.Components) == 0 {
+			return nil, fmt.Errorf("profile %s matches neither part numbers nor components", p.Name)
+		}
+		for _, g := range append(append([]string{}, p.PartNumbers...), p.Components...) {
+			if _, err := path.Match(g, ""); err != nil {
+				return nil, fmt.Errorf("profile %s: invalid glob %q: %v", p.Name, g, err)
+			}
+		}
+	}
+	return mc, nil
+}
+
+func matchAny(globs []string, s string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the profile of a component, preferring a match on the part
+// number over one on the component name.
+func (mc *ModuleCatalog) lookup(component string, partNumber string) *ModuleProfile {
+	if mc == nil {
+		return nil
+	}
+	if partNumber != "" {
+		for i := range mc.Profiles {
+			if matchAny(mc.Profiles[i].PartNumbers, partNumber) {
+				return &mc.Profiles[i]
+			}
+		}
+	}
+	for i := range mc.Profiles {
+		if matchAny(mc.Profiles[i].Components, component) {
+			return &mc.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// setMargins exports the margins of a laser against the profile of its
+// module, if there is one. The bias current is given in mA as reported by the
+// device.
+func (m *metricRegistry) setMargins(labels prometheus.Labels, in, out, biasMA *reading) {
+	name := labels["device"]
+	p := m.profiles.lookup(name, m.partNumber(name))
+	if p == nil {
+		return
+	}
+	if m.profileOf[name] != p.Name {
+		m.moduleProfileInfo.DeletePartialMatch(prometheus.Labels{"device": name})
+		m.profileOf[name] = p.Name
+	}
+	m.moduleProfileInfo.With(prometheus.Labels{"device": name, "profile": p.Name}).Set(1)
+
+	above := func(g *gaugeVec, r *reading, limit *float64, scale float64) {
+		if r != nil && limit != nil {
+			m.set(g, labels, r.apply(func(v float64) float64 { return (v - *limit) / scale }))
+		}
+	}
+	below := func(g *gaugeVec, r *reading, limit *float64, scale float64) {
+		if r != nil && limit != nil {
+			m.set(g, labels, r.below(*limit).apply(func(v float64) float64 { return v / scale }))
+		}
+	}
+	above(m.laserRxMargin, in, p.RxSensitivityDBM, 1)
+	below(m.laserRxOverloadMargin, in, p.RxOverloadDBM, 1)
+	above(m.laserTxLowMargin, out, p.TxMinDBM, 1)
+	below(m.laserTxHighMargin, out, p.TxMaxDBM, 1)
+	// Bias current limits are given in mA like on data sheets, but exported
+	// in A like the bias current itself.
+	above(m.laserBiasLowMargin, biasMA, p.BiasMinMA, 1000)
+	below(m.laserBiasHighMargin, biasMA, p.BiasMaxMA, 1000)
+}
+
+// forgetMargins drops all margins of a component, e.g. when its module was
+// replaced by one with a different part number.
+func (m *metricRegistry) forgetMargins(name string) {
+	for _, g := range []*gaugeVec{
+		m.laserRxMargin,
+		m.laserRxOverloadMargin,
+		m.laserTxLowMargin,
+		m.laserTxHighMargin,
+		m.laserBiasLowMargin,
+		m.laserBiasHighMargin,
+		m.moduleProfileInfo,
+	} {
+		g.DeletePartialMatch(prometheus.Labels{"device": name})
+	}
+	delete(m.profileOf, name)
+}
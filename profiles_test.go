@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestCatalog(t *testing.T) *ModuleCatalog {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "profiles.yaml")
+	if err := os.WriteFile(fn, []byte(`
+profiles:
+  - name: 100G-LR4
+    components: [TRANSCEIVER-*-C*]
+    rx_sensitivity_dbm: -10.6
+    rx_overload_dbm: 4.5
+    tx_min_dbm: -4.3
+    tx_max_dbm: 4.5
+    bias_min_ma: 20
+    bias_max_ma: 80
+  - name: 100G-ER4
+    part_numbers: [ER4-*]
+    rx_sensitivity_dbm: -20.5
+  - name: CFP2-DCO
+    components: [OCH-*]
+    rx_sensitivity_dbm: -22
+`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	mc, err := LoadModuleCatalog(fn)
+	if err != nil {
+		t.Fatalf("LoadModuleCatalog: %v", err)
+	}
+	return mc
+}
+
+func TestModuleCatalogLookup(t *testing.T) {
+	mc := loadTestCatalog(t)
+	var tests = []struct {
+		component  string
+		partNumber string
+		want       string
+	}{
+		{"TRANSCEIVER-1-1-C1", "", "100G-LR4"},
+		{"TRANSCEIVER-1-1-C1", "ER4-0001", "100G-ER4"},
+		{"TRANSCEIVER-1-1-C1", "LR4-0001", "100G-LR4"},
+		{"OCH-1-1-L1", "", "CFP2-DCO"},
+		{"TRANSCEIVER-1-1-L1", "", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if p := mc.lookup(tt.component, tt.partNumber); p != nil {
+			got = p.Name
+		}
+		assert.Equal(t, tt.want, got, "%+v", tt)
+	}
+	var nilCatalog *ModuleCatalog
+	assert.Nil(t, nilCatalog.lookup("OCH-1-1-L1", ""))
+}
+
+func TestMarginMetrics(t *testing.T) {
+	mr := NewMetricRegistry()
+	mr.profiles = loadTestCatalog(t)
+	update := func(path string, j string) {
+		t.Helper()
+		if err := mr.UpdateAt("/openconfig-platform:components/component[name=TRANSCEIVER-1-1-C1]"+path, time.Now(), j); err != nil {
+			t.Fatalf("UpdateAt: %v", err)
+		}
+	}
+	update("/openconfig-platform-transceiver:transceiver/physical-channels/channel[index=1]/state",
+		`{"input-power":{"instant":-0.5},"laser-bias-current":{"instant":55.5},"output-power":{"instant":0.5}}`)
+
+	names := []string{
+		"dc908_laser_rx_margin_db",
+		"dc908_laser_rx_overload_margin_db",
+		"dc908_laser_tx_low_margin_db",
+		"dc908_laser_tx_high_margin_db",
+		"dc908_laser_bias_current_low_margin_ampere",
+		"dc908_laser_bias_current_high_margin_ampere",
+		"dc908_module_profile_info",
+	}
+	em := `
+# HELP dc908_laser_bias_current_high_margin_ampere Laser bias current below the maximum bias current of the module profile.
+# TYPE dc908_laser_bias_current_high_margin_ampere gauge
+dc908_laser_bias_current_high_margin_ampere{device="TRANSCEIVER-1-1-C1",index="1"} 0.0245
+# HELP dc908_laser_bias_current_low_margin_ampere Laser bias current above the minimum bias current of the module profile.
+# TYPE dc908_laser_bias_current_low_margin_ampere gauge
+dc908_laser_bias_current_low_margin_ampere{device="TRANSCEIVER-1-1-C1",index="1"} 0.0355
+# HELP dc908_laser_rx_margin_db Input power above the receiver sensitivity of the module profile in dB.
+# TYPE dc908_laser_rx_margin_db gauge
+dc908_laser_rx_margin_db{device="TRANSCEIVER-1-1-C1",index="1"} 10.1
+# HELP dc908_laser_rx_overload_margin_db Input power below the receiver overload of the module profile in dB.
+# TYPE dc908_laser_rx_overload_margin_db gauge
+dc908_laser_rx_overload_margin_db{device="TRANSCEIVER-1-1-C1",index="1"} 5
+# HELP dc908_laser_tx_high_margin_db Output power below the maximum output power of the module profile in dB.
+# TYPE dc908_laser_tx_high_margin_db gauge
+dc908_laser_tx_high_margin_db{device="TRANSCEIVER-1-1-C1",index="1"} 4
+# HELP dc908_laser_tx_low_margin_db Output power above the minimum output power of the module profile in dB.
+# TYPE dc908_laser_tx_low_margin_db gauge
+dc908_laser_tx_low_margin_db{device="TRANSCEIVER-1-1-C1",index="1"} 4.8
+# HELP dc908_module_profile_info The module profile margins of a component are exported against.
+# TYPE dc908_module_profile_info gauge
+dc908_module_profile_info{device="TRANSCEIVER-1-1-C1",profile="100G-LR4"} 1
+`
+	if err := testutil.GatherAndCompare(mr.PrometheusRegistry(), strings.NewReader(em), names...); err != nil {
+		t.Errorf("metric compare: err %v", err)
+	}
+
+	// A module with a part number of a different profile replaces all
+	// margins of the old one.
+	update("/state", `{"part-no":"ER4-0001"}`)
+	update("/openconfig-platform-transceiver:transceiver/physical-channels/channel[index=1]/state",
+		`{"input-power":{"instant":-0.5}}`)
+	em = `
+# HELP dc908_laser_rx_margin_db Input power above the receiver sensitivity of the module profile in dB.
+# TYPE dc908_laser_rx_margin_db gauge
+dc908_laser_rx_margin_db{device="TRANSCEIVER-1-1-C1",index="1"} 20
+# HELP dc908_module_profile_info The module profile margins of a component are exported against.
+# TYPE dc908_module_profile_info gauge
+dc908_module_profile_info{device="TRANSCEIVER-1-1-C1",profile="100G-ER4"} 1
+`
+	if err := testutil.GatherAndCompare(mr.PrometheusRegistry(), strings.NewReader(em), names...); err != nil {
+		t.Errorf("metric compare: err %v", err)
+	}
+}
+
+func TestReadingBelow(t *testing.T) {
+	r := reading{Instant: -1, Min: fp(-3), Max: fp(1)}.below(4)
+	assert.Equal(t, reading{Instant: 5, Min: fp(3), Max: fp(7)}, r)
+}
+
+func TestLoadModuleCatalogErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{"missing name", "profiles: [{components: [OCH-*]}]", "has no name"},
+		{"no match", "profiles: [{name: x}]", "matches neither"},
+		{"bad glob", "profiles: [{name: x, part_numbers: ['[']}]", "invalid glob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "profiles.yaml")
+			if err := os.WriteFile(fn, []byte(tt.cfg), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			_, err := LoadModuleCatalog(fn)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
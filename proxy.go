@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gnmiProxyProtocol      = flag.Bool("gnmi-proxy-protocol", false, "accept PROXY protocol v1 and v2 headers on the gNMI port from trusted proxies")
+	gnmiTrustedProxies     = flag.String("gnmi-trusted-proxies", "", "comma separated addresses or CIDR prefixes of the proxies allowed to send a PROXY protocol header, peers on unix domain sockets are always trusted")
+	gnmiProxyHeaderTimeout = flag.Duration("gnmi-proxy-header-timeout", 5*time.Second, "how long to wait for the PROXY protocol header of a new gNMI connection")
+
+	gnmiProxyHeaders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dc908_exporter_gnmi_proxy_headers_total",
+		Help: "gNMI connections from trusted proxies by the outcome of reading their PROXY protocol header.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(gnmiProxyHeaders)
+}
+
+// ProxyConfig enables the PROXY protocol on the gNMI port.
+type ProxyConfig struct {
+	// Trusted are the proxies whose PROXY protocol headers are used. Peers
+	// on unix domain sockets are always trusted.
+	Trusted       []netip.Prefix
+	HeaderTimeout time.Duration
+}
+
+// ProxyConfigFromFlags returns the PROXY protocol configuration set on the
+// command line, or nil if it is disabled.
+func ProxyConfigFromFlags() (*ProxyConfig, error) {
+	if !*gnmiProxyProtocol {
+		return nil, nil
+	}
+	trusted, err := parsePrefixList(*gnmiTrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("-gnmi-trusted-proxies: %v", err)
+	}
+	if len(trusted) == 0 {
+		log.Warningf("PROXY protocol enabled without -gnmi-trusted-proxies, only peers on unix domain sockets may send a header")
+	}
+	return &ProxyConfig{
+		Trusted:       trusted,
+		HeaderTimeout: *gnmiProxyHeaderTimeout,
+	}, nil
+}
+
+func (cfg *ProxyConfig) trusted(a net.Addr) bool {
+	if isUnixAddr(a) {
+		return true
+	}
+	addr, ok := addrOf(a)
+	return ok && containsAddr(cfg.Trusted, addr)
+}
+
+// Listener wraps l to take the addresses of connections from trusted proxies
+// from their PROXY protocol header. Headers are read in the background, so
+// that a slow proxy does not hold up other connections.
+func (cfg *ProxyConfig) Listener(l net.Listener) net.Listener {
+	pl := &proxyListener{
+		Listener: l,
+		cfg:      cfg,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go pl.serve()
+	return pl
+}
+
+type proxyListener struct {
+	net.Listener
+	cfg       *ProxyConfig
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (pl *proxyListener) serve() {
+	for {
+		c, err := pl.Listener.Accept()
+		if err != nil {
+			select {
+			case pl.accepted <- acceptResult{nil, err}:
+			case <-pl.done:
+				return
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+			continue
+		}
+		if !pl.cfg.trusted(c.RemoteAddr()) {
+			// A header sent anyway is not valid gRPC, which fails the
+			// connection.
+			pl.deliver(c)
+			continue
+		}
+		go func() {
+			pc, err := pl.cfg.readHeader(c)
+			if err != nil {
+				log.V(1).Infof("Dropping gNMI connection from proxy %s: %v", c.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+			pl.deliver(pc)
+		}()
+	}
+}
+
+func (pl *proxyListener) deliver(c net.Conn) {
+	select {
+	case pl.accepted <- acceptResult{c, nil}:
+	case <-pl.done:
+		c.Close()
+	}
+}
+
+// readHeader reads the PROXY protocol header of a connection from a trusted
+// proxy. Connections without a header and LOCAL connections, e.g. health
+// checks of the proxy, keep the address of the proxy.
+func (cfg *ProxyConfig) readHeader(c net.Conn) (net.Conn, error) {
+	if cfg.HeaderTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(cfg.HeaderTimeout)); err != nil {
+			return nil, err
+		}
+	}
+	r := bufio.NewReader(c)
+	h, err := proxyproto.Read(r)
+	if cfg.HeaderTimeout > 0 {
+		if err := c.SetReadDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	pc := &proxyConn{Conn: c, r: r, remote: c.RemoteAddr()}
+	switch {
+	case errors.Is(err, proxyproto.ErrNoProxyProtocol):
+		gnmiProxyHeaders.WithLabelValues("missing").Inc()
+		return pc, nil
+	case err != nil:
+		gnmiProxyHeaders.WithLabelValues("invalid").Inc()
+		return nil, err
+	case h.Command.IsLocal() || h.SourceAddr == nil:
+		gnmiProxyHeaders.WithLabelValues("local").Inc()
+		return pc, nil
+	}
+	gnmiProxyHeaders.WithLabelValues("used").Inc()
+	pc.remote = h.SourceAddr
+	log.V(2).Infof("gNMI connection from %s via proxy %s", pc.remote, c.RemoteAddr())
+	return pc, nil
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-pl.accepted:
+		return r.c, r.err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *proxyListener) Close() error {
+	var err error
+	pl.closeOnce.Do(func() {
+		close(pl.done)
+		err = pl.Listener.Close()
+	})
+	return err
+}
+
+// proxyConn is a connection whose peer address was taken from a PROXY
+// protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
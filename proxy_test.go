@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	pb "github.com/sonix-network/dc908_exporter/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func startProxyServer(t *testing.T, cfg ProxyConfig, guard *GuardConfig) *Server {
+	t.Helper()
+	srv, err := NewServer(&Config{Port: 0, Proxy: &cfg, Guard: guard}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+	return srv
+}
+
+// publishViaProxy opens a Publish stream to srv from the loopback address src,
+// sending a PROXY protocol header claiming device as source first if set, and
+// sends the fan test data.
+func publishViaProxy(t *testing.T, srv *Server, src string, version byte, device string) {
+	t.Helper()
+	if err := tryPublishViaProxy(t, srv, src, version, device); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+}
+
+// tryPublishViaProxy is publishViaProxy returning an error if the session
+// fails.
+func tryPublishViaProxy(t *testing.T, srv *Server, src string, version byte, device string) error {
+	t.Helper()
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(src)}}
+	conn, err := grpc.NewClient(srv.Address(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			c, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil || device == "" {
+				return c, err
+			}
+			h := proxyproto.HeaderProxyFromAddrs(version,
+				net.TCPAddrFromAddrPort(netip.MustParseAddrPort(net.JoinHostPort(device, "50000"))),
+				c.RemoteAddr())
+			if _, err := h.WriteTo(c); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		}))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := pb.NewGNMIDialoutClient(conn).Publish(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		return err
+	}
+	// Successful sessions do not answer, give rejected ones time to fail.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := stream.Recv()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func sessionTargets(srv *Server) []string {
+	var res []string
+	for _, s := range srv.Sessions() {
+		res = append(res, s.Target)
+	}
+	return res
+}
+
+func TestProxyProtocol(t *testing.T) {
+	srv := startProxyServer(t, ProxyConfig{
+		Trusted:       []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+		HeaderTimeout: time.Second,
+	}, nil)
+
+	// A proxy that does not send anything does not hold up others.
+	idle, err := net.Dial("tcp", srv.Address())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer idle.Close()
+
+	publishViaProxy(t, srv, "127.0.0.1", 1, "192.0.2.10")
+	publishViaProxy(t, srv, "127.0.0.1", 2, "2001:db8::11")
+	assert.Eventually(t, func() bool {
+		return probeSucceeds(srv, "192.0.2.10") && probeSucceeds(srv, "2001:db8::11")
+	}, waitFor, tick)
+
+	// Without a header the proxy itself is the device.
+	publishViaProxy(t, srv, "127.0.0.1", 0, "")
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+	assert.ElementsMatch(t, []string{"127.0.0.1", "192.0.2.10", "2001:db8::11"}, sessionTargets(srv))
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	srv := startProxyServer(t, ProxyConfig{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")},
+	}, nil)
+
+	assert.Error(t, tryPublishViaProxy(t, srv, "127.0.0.1", 2, "192.0.2.10"))
+
+	publishViaProxy(t, srv, "127.0.0.3", 0, "")
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "127.0.0.3") }, waitFor, tick)
+	assert.Equal(t, []string{"127.0.0.3"}, sessionTargets(srv))
+}
+
+func TestProxyProtocolGuard(t *testing.T) {
+	srv := startProxyServer(t, ProxyConfig{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	}, &GuardConfig{
+		Deny: []netip.Prefix{netip.MustParsePrefix("192.0.2.66/32")},
+	})
+
+	// The guard sees the devices, not the proxy.
+	assert.Error(t, tryPublishViaProxy(t, srv, "127.0.0.1", 2, "192.0.2.66"))
+
+	publishViaProxy(t, srv, "127.0.0.1", 2, "192.0.2.67")
+	assert.Eventually(t, func() bool { return probeSucceeds(srv, "192.0.2.67") }, waitFor, tick)
+	assert.Equal(t, []string{"192.0.2.67"}, sessionTargets(srv))
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/nats-io/nats.go"
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	busURL           = flag.String("bus-url", "", "URL of a message bus to publish telemetry to, e.g. nats://localhost:4222")
+	busFormat        = flag.String("bus-format", "json", "encoding of published messages, either json or protobuf")
+	busSubjectPrefix = flag.String("bus-subject-prefix", "dc908", "prefix of the subjects telemetry is published on")
+	busRaw           = flag.Bool("bus-raw", true, "publish every received update as is on <prefix>.raw.<device>")
+	busDecoded       = flag.Bool("bus-decoded", true, "publish every decoded value on <prefix>.decoded.<device>")
+)
+
+// deviceIDExtension is the registered gNMI extension the DC908 uses to send
+// its own address along with every response.
+const deviceIDExtension = 103
+
+// BusTransport delivers messages to a message bus.
+type BusTransport interface {
+	Publish(subject string, payload []byte) error
+	Close() error
+}
+
+// busTransports maps URL schemes to the transports serving them.
+var busTransports = map[string]func(u *url.URL) (BusTransport, error){
+	"nats": dialNATS,
+	"tls":  dialNATS,
+}
+
+type natsTransport struct {
+	nc *nats.Conn
+}
+
+func dialNATS(u *url.URL) (BusTransport, error) {
+	nc, err := nats.Connect(u.String(),
+		nats.Name("dc908_exporter"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warningf("Disconnected from NATS: %v", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Infof("Reconnected to NATS at %s", nc.ConnectedUrlRedacted())
+		}))
+	if err != nil {
+		return nil, err
+	}
+	return &natsTransport{nc: nc}, nil
+}
+
+func (t *natsTransport) Publish(subject string, payload []byte) error {
+	return t.nc.Publish(subject, payload)
+}
+
+func (t *natsTransport) Close() error {
+	err := t.nc.FlushTimeout(5 * time.Second)
+	t.nc.Close()
+	return err
+}
+
+// busMessage is the JSON envelope of a published update.
+type busMessage struct {
+	Device    string            `json:"device"`
+	DeviceID  string            `json:"device_id,omitempty"`
+	Path      string            `json:"path,omitempty"`
+	Metric    string            `json:"metric,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Value     any               `json:"value"`
+	Deleted   bool              `json:"deleted,omitempty"`
+	Min       *float64          `json:"min,omitempty"`
+	Max       *float64          `json:"max,omitempty"`
+	Avg       *float64          `json:"avg,omitempty"`
+}
+
+// Publisher publishes the telemetry received from all devices to a message
+// bus, both as received and as decoded by the metric registry.
+type Publisher struct {
+	t       BusTransport
+	format  string
+	prefix  string
+	raw     bool
+	decoded bool
+}
+
+func NewPublisher(t BusTransport, format string, prefix string, raw bool, decoded bool) (*Publisher, error) {
+	switch format {
+	case "json", "protobuf":
+	default:
+		return nil, fmt.Errorf("unsupported message format %q", format)
+	}
+	return &Publisher{
+		t:       t,
+		format:  format,
+		prefix:  prefix,
+		raw:     raw,
+		decoded: decoded,
+	}, nil
+}
+
+// DialPublisher connects to the message bus at rawURL using the transport
+// registered for its scheme.
+func DialPublisher(rawURL string, format string, prefix string, raw bool, decoded bool) (*Publisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message bus URL: %v", err)
+	}
+	dial, ok := busTransports[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported message bus %q", u.Scheme)
+	}
+	t, err := dial(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", u.Redacted(), err)
+	}
+	return NewPublisher(t, format, prefix, raw, decoded)
+}
+
+// subject returns the subject for messages of the given kind from target.
+// Dots and colons separate tokens in NATS, so they are replaced in target.
+func (p *Publisher) subject(kind string, target string) string {
+	return p.prefix + "." + kind + "." + strings.NewReplacer(".", "_", ":", "_").Replace(target)
+}
+
+func (p *Publisher) publish(subject string, payload []byte, err error) {
+	if err != nil {
+		log.Warningf("Failed to encode message for %s: %v", subject, err)
+		return
+	}
+	if err := p.t.Publish(subject, payload); err != nil {
+		log.Warningf("Failed to publish message on %s: %v", subject, err)
+	}
+}
+
+// deviceID returns the address the device reports for itself, if any.
+func deviceID(resp *gnmi.SubscribeResponse) string {
+	for _, ext := range resp.GetExtension() {
+		if re := ext.GetRegisteredExt(); re != nil && re.GetId() == deviceIDExtension {
+			return string(re.GetMsg())
+		}
+	}
+	return ""
+}
+
+// PublishNotification publishes every update in resp received from target,
+// one message per update. Deleted paths are published on both the raw and the
+// decoded subject, as they also end the values decoded from them.
+func (p *Publisher) PublishNotification(target string, resp *gnmi.SubscribeResponse) {
+	notif := resp.GetUpdate()
+	if notif == nil {
+		return
+	}
+	if p.decoded {
+		p.publishDeletes(p.subject("decoded", target), target, notif, nil)
+	}
+	if !p.raw {
+		return
+	}
+	subject := p.subject("raw", target)
+	p.publishDeletes(subject, target, notif, resp)
+	if p.format == "protobuf" {
+		for _, u := range notif.GetUpdate() {
+			b, err := proto.Marshal(&gnmi.SubscribeResponse{
+				Response: &gnmi.SubscribeResponse_Update{Update: &gnmi.Notification{
+					Timestamp: notif.GetTimestamp(),
+					Prefix:    targetPrefix(notif, target),
+					Update:    []*gnmi.Update{u},
+				}},
+				Extension: resp.GetExtension(),
+			})
+			p.publish(subject, b, err)
+		}
+		return
+	}
+	id := deviceID(resp)
+	WalkNotification(notif, func(fqn string, ts *time.Time, val string) {
+		var v any = val
+		if json.Valid([]byte(val)) {
+			v = json.RawMessage(val)
+		}
+		b, err := json.Marshal(busMessage{
+			Device:    target,
+			DeviceID:  id,
+			Path:      fqn,
+			Timestamp: *ts,
+			Value:     v,
+		})
+		p.publish(subject, b, err)
+	}, nil)
+}
+
+// publishDeletes publishes the paths deleted in notif on subject, in a single
+// message for protobuf and one message per path for JSON. If resp is set, the
+// device address it carries is published along.
+func (p *Publisher) publishDeletes(subject string, target string, notif *gnmi.Notification, resp *gnmi.SubscribeResponse) {
+	if len(notif.GetDelete()) == 0 {
+		return
+	}
+	if p.format == "protobuf" {
+		b, err := proto.Marshal(&gnmi.SubscribeResponse{
+			Response: &gnmi.SubscribeResponse_Update{Update: &gnmi.Notification{
+				Timestamp: notif.GetTimestamp(),
+				Prefix:    targetPrefix(notif, target),
+				Delete:    notif.GetDelete(),
+			}},
+			Extension: resp.GetExtension(),
+		})
+		p.publish(subject, b, err)
+		return
+	}
+	id := deviceID(resp)
+	WalkNotification(notif, nil, func(fqn string, ts *time.Time) {
+		b, err := json.Marshal(busMessage{
+			Device:    target,
+			DeviceID:  id,
+			Path:      fqn,
+			Timestamp: *ts,
+			Deleted:   true,
+		})
+		p.publish(subject, b, err)
+	})
+}
+
+// targetPrefix returns the prefix of notif with its target set to target.
+func targetPrefix(notif *gnmi.Notification, target string) *gnmi.Path {
+	prefix := &gnmi.Path{}
+	if notif.GetPrefix() != nil {
+		prefix = proto.Clone(notif.GetPrefix()).(*gnmi.Path)
+	}
+	prefix.Target = target
+	return prefix
+}
+
+// finite returns v, or nil if it is NaN or infinite. The device reports
+// missing readings as NaN, which JSON cannot represent.
+func finite(v *float64) *float64 {
+	if v == nil || math.IsNaN(*v) || math.IsInf(*v, 0) {
+		return nil
+	}
+	return v
+}
+
+// Observe publishes a value decoded from target.
+func (p *Publisher) Observe(target string, u decodedUpdate) {
+	if !p.decoded {
+		return
+	}
+	subject := p.subject("decoded", target)
+	if p.format == "protobuf" {
+		key := make(map[string]string)
+		for k, v := range u.Labels {
+			if v != "" {
+				key[k] = v
+			}
+		}
+		n := &gnmi.Notification{
+			Timestamp: u.Timestamp.UnixNano(),
+			Prefix: &gnmi.Path{
+				Target: target,
+				Elem:   []*gnmi.PathElem{{Name: u.Metric, Key: key}},
+			},
+		}
+		for _, f := range []struct {
+			name string
+			v    *float64
+		}{
+			{"instant", finite(&u.Reading.Instant)},
+			{"min", finite(u.Reading.Min)},
+			{"max", finite(u.Reading.Max)},
+			{"avg", finite(u.Reading.Avg)},
+		} {
+			if f.v == nil {
+				continue
+			}
+			n.Update = append(n.Update, &gnmi.Update{
+				Path: &gnmi.Path{Elem: []*gnmi.PathElem{{Name: f.name}}},
+				Val:  &gnmi.TypedValue{Value: &gnmi.TypedValue_DoubleVal{DoubleVal: *f.v}},
+			})
+		}
+		b, err := proto.Marshal(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: n}})
+		p.publish(subject, b, err)
+		return
+	}
+	msg := busMessage{
+		Device:    target,
+		Metric:    u.Metric,
+		Labels:    u.Labels,
+		Timestamp: u.Timestamp,
+		Min:       finite(u.Reading.Min),
+		Max:       finite(u.Reading.Max),
+		Avg:       finite(u.Reading.Avg),
+	}
+	// A missing reading is published as null.
+	if v := finite(&u.Reading.Instant); v != nil {
+		msg.Value = *v
+	}
+	b, err := json.Marshal(msg)
+	p.publish(subject, b, err)
+}
+
+// Close flushes outstanding messages and disconnects from the bus.
+func (p *Publisher) Close() error {
+	return p.t.Close()
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+type busReceived struct {
+	subject string
+	payload []byte
+}
+
+// natsBroker is a minimal in-process stand-in for a NATS server that accepts
+// publishers and records every published message.
+type natsBroker struct {
+	t    *testing.T
+	lis  net.Listener
+	lock sync.Mutex
+	msgs []busReceived
+}
+
+func startNATSBroker(t *testing.T) *natsBroker {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	b := &natsBroker{t: t, lis: lis}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { lis.Close() })
+	return b
+}
+
+func (b *natsBroker) URL() string {
+	return "nats://" + b.lis.Addr().String()
+}
+
+func (b *natsBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"stand-in\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "PUB":
+			n, err := strconv.Atoi(f[len(f)-1])
+			if err != nil {
+				b.t.Errorf("invalid PUB %q", line)
+				return
+			}
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			b.lock.Lock()
+			b.msgs = append(b.msgs, busReceived{subject: f[1], payload: payload[:n]})
+			b.lock.Unlock()
+		}
+	}
+}
+
+func (b *natsBroker) received(subject string) []busReceived {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var res []busReceived
+	for _, m := range b.msgs {
+		if m.subject == subject {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// recordingTransport keeps published messages in memory.
+type recordingTransport struct {
+	msgs []busReceived
+}
+
+func (rt *recordingTransport) Publish(subject string, payload []byte) error {
+	rt.msgs = append(rt.msgs, busReceived{subject, payload})
+	return nil
+}
+
+func (rt *recordingTransport) Close() error {
+	return nil
+}
+
+func TestPublisherOverNATS(t *testing.T) {
+	assert := assert.New(t)
+	b := startNATSBroker(t)
+	p, err := DialPublisher(b.URL(), "json", "dc908", true, true)
+	if err != nil {
+		t.Fatalf("DialPublisher: %v", err)
+	}
+	defer p.Close()
+
+	srv := startServer(t)
+	srv.publisher = p
+	srv.AddObserver(p)
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	assert.Eventually(func() bool {
+		return len(b.received("dc908.raw.127_0_0_1")) == 1 && len(b.received("dc908.decoded.127_0_0_1")) == 1
+	}, waitFor, tick)
+
+	var raw map[string]any
+	assert.NoError(json.Unmarshal(b.received("dc908.raw.127_0_0_1")[0].payload, &raw))
+	assert.Equal("127.0.0.1", raw["device"])
+	assert.Equal("10.99.99.31", raw["device_id"])
+	assert.Equal("/openconfig-platform:components/component[name=FAN-1-33]/fan/state", raw["path"])
+	assert.Equal(map[string]any{"speed": float64(4500)}, raw["value"])
+	assert.NotEmpty(raw["timestamp"])
+
+	var dec map[string]any
+	assert.NoError(json.Unmarshal(b.received("dc908.decoded.127_0_0_1")[0].payload, &dec))
+	assert.Equal("dc908_fan_rpm", dec["metric"])
+	assert.Equal(map[string]any{"device": "FAN-1-33"}, dec["labels"])
+	assert.Equal(float64(4500), dec["value"])
+}
+
+func TestPublisherProtobuf(t *testing.T) {
+	assert := assert.New(t)
+	rt := &recordingTransport{}
+	p, err := NewPublisher(rt, "protobuf", "dc908", true, true)
+	if err != nil {
+		t.Fatalf("NewPublisher: %v", err)
+	}
+
+	resp := readTestdata(t, "testdata/mcu.textpb")
+	p.PublishNotification("10.0.0.1", resp)
+	// Every update is published as its own message.
+	if assert.Len(rt.msgs, len(resp.GetUpdate().GetUpdate())) {
+		for i, m := range rt.msgs {
+			assert.Equal("dc908.raw.10_0_0_1", m.subject)
+			got := &gnmi.SubscribeResponse{}
+			assert.NoError(proto.Unmarshal(m.payload, got))
+			assert.Equal("10.0.0.1", got.GetUpdate().GetPrefix().GetTarget())
+			assert.Equal(resp.GetUpdate().GetTimestamp(), got.GetUpdate().GetTimestamp())
+			if assert.Len(got.GetUpdate().GetUpdate(), 1) {
+				assert.Equal(resp.GetUpdate().GetUpdate()[i].GetVal().GetJsonIetfVal(), got.GetUpdate().GetUpdate()[0].GetVal().GetJsonIetfVal())
+			}
+			assert.Equal("10.99.99.32", deviceID(got))
+		}
+	}
+
+	rt.msgs = nil
+	ts := time.Unix(1720382350, 0)
+	p.Observe("10.0.0.1", decodedUpdate{
+		Metric:    "dc908_laser_input_power_dbm",
+		Labels:    map[string]string{"device": "TRANSCEIVER-1-1-C1", "index": ""},
+		Reading:   reading{Instant: -0.5, Min: fp(-0.6)},
+		Timestamp: ts,
+	})
+	if assert.Len(rt.msgs, 1) {
+		assert.Equal("dc908.decoded.10_0_0_1", rt.msgs[0].subject)
+		got := &gnmi.SubscribeResponse{}
+		assert.NoError(proto.Unmarshal(rt.msgs[0].payload, got))
+		n := got.GetUpdate()
+		assert.Equal(ts.UnixNano(), n.GetTimestamp())
+		assert.Equal("dc908_laser_input_power_dbm", n.GetPrefix().GetElem()[0].GetName())
+		assert.Equal(map[string]string{"device": "TRANSCEIVER-1-1-C1"}, n.GetPrefix().GetElem()[0].GetKey())
+		if assert.Len(n.GetUpdate(), 2) {
+			assert.Equal("instant", n.GetUpdate()[0].GetPath().GetElem()[0].GetName())
+			assert.Equal(-0.5, n.GetUpdate()[0].GetVal().GetDoubleVal())
+			assert.Equal("min", n.GetUpdate()[1].GetPath().GetElem()[0].GetName())
+			assert.Equal(-0.6, n.GetUpdate()[1].GetVal().GetDoubleVal())
+		}
+	}
+}
+
+func TestPublisherMissingReading(t *testing.T) {
+	var tests = []struct {
+		format string
+		check  func(*testing.T, []byte)
+	}{
+		{"json", func(t *testing.T, payload []byte) {
+			var got map[string]any
+			assert.NoError(t, json.Unmarshal(payload, &got))
+			assert.Contains(t, got, "value")
+			assert.Nil(t, got["value"])
+			assert.NotContains(t, got, "min")
+			assert.Equal(t, float64(1), got["max"])
+		}},
+		{"protobuf", func(t *testing.T, payload []byte) {
+			got := &gnmi.SubscribeResponse{}
+			assert.NoError(t, proto.Unmarshal(payload, got))
+			if assert.Len(t, got.GetUpdate().GetUpdate(), 1) {
+				assert.Equal(t, "max", got.GetUpdate().GetUpdate()[0].GetPath().GetElem()[0].GetName())
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			rt := &recordingTransport{}
+			p, err := NewPublisher(rt, tt.format, "dc908", true, true)
+			if err != nil {
+				t.Fatalf("NewPublisher: %v", err)
+			}
+			p.Observe("10.0.0.1", decodedUpdate{
+				Metric:  "dc908_psu_input_voltage",
+				Reading: reading{Instant: math.NaN(), Min: fp(math.Inf(-1)), Max: fp(1)},
+			})
+			if assert.Len(t, rt.msgs, 1) {
+				tt.check(t, rt.msgs[0].payload)
+			}
+		})
+	}
+}
+
+func TestPublisherDeletes(t *testing.T) {
+	del := &gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: &gnmi.Notification{
+		Timestamp: 1720382350000000000,
+		Prefix:    &gnmi.Path{Elem: []*gnmi.PathElem{{Name: "openconfig-platform:components"}}},
+		Delete: []*gnmi.Path{
+			{Elem: []*gnmi.PathElem{{Name: "component", Key: map[string]string{"name": "FAN-1-33"}}}},
+			{Elem: []*gnmi.PathElem{{Name: "component", Key: map[string]string{"name": "FAN-1-34"}}}},
+		},
+	}}}
+
+	t.Run("json", func(t *testing.T) {
+		rt := &recordingTransport{}
+		p, err := NewPublisher(rt, "json", "dc908", true, true)
+		if err != nil {
+			t.Fatalf("NewPublisher: %v", err)
+		}
+		p.PublishNotification("10.0.0.1", del)
+		var subjects []string
+		for _, m := range rt.msgs {
+			subjects = append(subjects, m.subject)
+			var got map[string]any
+			assert.NoError(t, json.Unmarshal(m.payload, &got))
+			assert.Equal(t, true, got["deleted"])
+			assert.Nil(t, got["value"])
+			assert.Contains(t, got["path"], "/openconfig-platform:components/component[name=FAN-1-3")
+		}
+		assert.Equal(t, []string{"dc908.decoded.10_0_0_1", "dc908.decoded.10_0_0_1", "dc908.raw.10_0_0_1", "dc908.raw.10_0_0_1"}, subjects)
+	})
+
+	t.Run("protobuf", func(t *testing.T) {
+		rt := &recordingTransport{}
+		p, err := NewPublisher(rt, "protobuf", "dc908", false, true)
+		if err != nil {
+			t.Fatalf("NewPublisher: %v", err)
+		}
+		p.PublishNotification("10.0.0.1", del)
+		if assert.Len(t, rt.msgs, 1) {
+			assert.Equal(t, "dc908.decoded.10_0_0_1", rt.msgs[0].subject)
+			got := &gnmi.SubscribeResponse{}
+			assert.NoError(t, proto.Unmarshal(rt.msgs[0].payload, got))
+			assert.Equal(t, "10.0.0.1", got.GetUpdate().GetPrefix().GetTarget())
+			assert.Len(t, got.GetUpdate().GetDelete(), 2)
+			assert.Empty(t, got.GetUpdate().GetUpdate())
+		}
+	})
+}
+
+func TestPublisherSelection(t *testing.T) {
+	var tests = []struct {
+		name    string
+		raw     bool
+		decoded bool
+		want    []string
+	}{
+		{"raw only", true, false, []string{"dc908.raw.10_0_0_1"}},
+		{"decoded only", false, true, []string{"dc908.decoded.10_0_0_1"}},
+		{"both", true, true, []string{"dc908.raw.10_0_0_1", "dc908.decoded.10_0_0_1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &recordingTransport{}
+			p, err := NewPublisher(rt, "json", "dc908", tt.raw, tt.decoded)
+			if err != nil {
+				t.Fatalf("NewPublisher: %v", err)
+			}
+			p.PublishNotification("10.0.0.1", readTestdata(t, "testdata/fan.textpb"))
+			p.Observe("10.0.0.1", decodedUpdate{Metric: "dc908_fan_rpm", Reading: reading{Instant: 4500}})
+			var got []string
+			for _, m := range rt.msgs {
+				got = append(got, m.subject)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDialPublisherErrors(t *testing.T) {
+	_, err := DialPublisher("kafka://localhost:9092", "json", "dc908", true, true)
+	assert.ErrorContains(t, err, "unsupported message bus")
+	_, err = NewPublisher(&recordingTransport{}, "xml", "dc908", true, true)
+	assert.ErrorContains(t, err, "unsupported message format")
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	remoteWriteConfig   = flag.String("remote-write-config", "", "path to a YAML file listing Prometheus remote-write endpoints to push samples to")
+	remoteWriteInterval = flag.Duration("remote-write-interval", 15*time.Second, "how often to collect new samples for remote-write")
+)
+
+type RemoteWriteConfig struct {
+	Endpoints []RemoteWriteEndpoint `yaml:"endpoints"`
+}
+
+type RemoteWriteEndpoint struct {
+	URL            string            `yaml:"url"`
+	Headers        map[string]string `yaml:"headers"`
+	BearerToken    string            `yaml:"bearer_token"`
+	BasicAuth      *BasicAuth        `yaml:"basic_auth"`
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	QueueSize      int               `yaml:"queue_size"`
+	BatchSize      int               `yaml:"batch_size"`
+	MaxRetries     int               `yaml:"max_retries"`
+	MinBackoff     time.Duration     `yaml:"min_backoff"`
+	MaxBackoff     time.Duration     `yaml:"max_backoff"`
+}
+
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// LoadRemoteWriteConfig reads a remote-write configuration file and fills in
+// defaults for everything left unset.
+func LoadRemoteWriteConfig(fn string) (*RemoteWriteConfig, error) {
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &RemoteWriteConfig{}
+	if err := yaml.Unmarshal(d, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", fn, err)
+	}
+	for i := range cfg.Endpoints {
+		ep := &cfg.Endpoints[i]
+		if ep.URL == "" {
+			return nil, fmt.Errorf("remote-write endpoint %d has no url", i)
+		}
+		if ep.Timeout == 0 {
+			ep.Timeout = 30 * time.Second
+		}
+		if ep.QueueSize == 0 {
+			ep.QueueSize = 10000
+		}
+		if ep.BatchSize == 0 {
+			ep.BatchSize = 500
+		}
+		if ep.MaxRetries == 0 {
+			ep.MaxRetries = 5
+		}
+		if ep.MinBackoff == 0 {
+			ep.MinBackoff = 30 * time.Millisecond
+		}
+		if ep.MaxBackoff == 0 {
+			ep.MaxBackoff = 5 * time.Second
+		}
+	}
+	return cfg, nil
+}
+
+type rwLabel struct {
+	name, value string
+}
+
+type rwTimeSeries struct {
+	labels    []rwLabel
+	value     float64
+	timestamp int64
+}
+
+// RemoteWriter periodically collects the decoded samples of all connected
+// devices and pushes those that changed to Prometheus remote-write endpoints.
+type RemoteWriter struct {
+	srv       *Server
+	interval  time.Duration
+	endpoints []*remoteWriteQueue
+
+	// Timestamp in milliseconds of the last collected sample per series.
+	last map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type remoteWriteQueue struct {
+	cfg    RemoteWriteEndpoint
+	client *http.Client
+	queue  chan rwTimeSeries
+	wg     sync.WaitGroup
+}
+
+func NewRemoteWriter(srv *Server, cfg *RemoteWriteConfig, interval time.Duration) *RemoteWriter {
+	rw := &RemoteWriter{
+		srv:      srv,
+		interval: interval,
+		last:     make(map[string]int64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, ep := range cfg.Endpoints {
+		q := &remoteWriteQueue{
+			cfg:    ep,
+			client: &http.Client{Timeout: ep.Timeout},
+			queue:  make(chan rwTimeSeries, ep.QueueSize),
+		}
+		q.wg.Add(1)
+		go q.run()
+		rw.endpoints = append(rw.endpoints, q)
+	}
+	go rw.run()
+	return rw
+}
+
+func (rw *RemoteWriter) run() {
+	defer close(rw.done)
+	t := time.NewTicker(rw.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-rw.stop:
+			rw.collect()
+			return
+		case <-t.C:
+			rw.collect()
+		}
+	}
+}
+
+// collect enqueues every sample that has a newer device timestamp than the
+// last time it was collected. Samples without a device timestamp, e.g. of
+// alarms or of devices without a clock, are stamped with the collection time.
+func (rw *RemoteWriter) collect() {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for target, mr := range rw.srv.registries() {
+		samples, err := mr.Samples()
+		if err != nil {
+			log.Warningf("Failed to gather samples of %q for remote-write: %v", target, err)
+			continue
+		}
+		for _, s := range samples {
+			if s.Timestamp.IsZero() {
+				s.Timestamp = now
+			}
+			ts := rwTimeSeries{
+				labels:    sampleLabels(s, target),
+				value:     s.Value,
+				timestamp: s.Timestamp.UnixMilli(),
+			}
+			key := seriesKey(ts.labels)
+			seen[key] = true
+			if rw.last[key] >= ts.timestamp {
+				continue
+			}
+			rw.last[key] = ts.timestamp
+			for _, q := range rw.endpoints {
+				q.enqueue(ts)
+			}
+		}
+	}
+	for key := range rw.last {
+		if !seen[key] {
+			delete(rw.last, key)
+		}
+	}
+}
+
+// Close stops collecting samples and waits for all queued samples to be
+// sent, or for ctx to expire.
+func (rw *RemoteWriter) Close(ctx context.Context) error {
+	close(rw.stop)
+	<-rw.done
+	done := make(chan struct{})
+	go func() {
+		for _, q := range rw.endpoints {
+			close(q.queue)
+			q.wg.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("remote-write flush: %w", ctx.Err())
+	}
+}
+
+func sampleLabels(s sample, target string) []rwLabel {
+	labels := []rwLabel{{"__name__", s.Name}, {"target", target}}
+	for k, v := range s.Labels {
+		labels = append(labels, rwLabel{k, v})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+func seriesKey(labels []rwLabel) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.name)
+		b.WriteByte(0)
+		b.WriteString(l.value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func (q *remoteWriteQueue) enqueue(ts rwTimeSeries) {
+	select {
+	case q.queue <- ts:
+	default:
+		log.Warningf("Remote-write queue for %s is full, dropping sample", q.cfg.URL)
+	}
+}
+
+func (q *remoteWriteQueue) run() {
+	defer q.wg.Done()
+	batch := make([]rwTimeSeries, 0, q.cfg.BatchSize)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case ts, ok := <-q.queue:
+			if !ok {
+				q.send(batch)
+				return
+			}
+			batch = append(batch, ts)
+			if len(batch) < q.cfg.BatchSize {
+				continue
+			}
+		case <-flush.C:
+		}
+		q.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send pushes a batch, retrying with exponential backoff on network errors,
+// 5xx and 429 responses.
+func (q *remoteWriteQueue) send(batch []rwTimeSeries) {
+	if len(batch) == 0 {
+		return
+	}
+	body := snappy.Encode(nil, q.marshal(batch))
+	backoff := q.cfg.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := q.post(body)
+		if err == nil {
+			log.V(2).Infof("Pushed %d samples to %s", len(batch), q.cfg.URL)
+			return
+		}
+		if !retry || attempt >= q.cfg.MaxRetries {
+			log.Errorf("Failed to push %d samples to %s, dropping them: %v", len(batch), q.cfg.URL, err)
+			return
+		}
+		log.Warningf("Failed to push samples to %s, retrying in %s: %v", q.cfg.URL, backoff, err)
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff)/2+1)))
+		backoff *= 2
+		if backoff > q.cfg.MaxBackoff {
+			backoff = q.cfg.MaxBackoff
+		}
+	}
+}
+
+func (q *remoteWriteQueue) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, q.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "dc908_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if q.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+q.cfg.BearerToken)
+	}
+	if q.cfg.BasicAuth != nil {
+		req.SetBasicAuth(q.cfg.BasicAuth.Username, q.cfg.BasicAuth.Password)
+	}
+	for k, v := range q.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+func hasLabel(labels []rwLabel, name string) bool {
+	for _, l := range labels {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// marshal encodes a batch as a prometheus.WriteRequest protobuf message.
+func (q *remoteWriteQueue) marshal(batch []rwTimeSeries) []byte {
+	var b []byte
+	for _, ts := range batch {
+		var tsb []byte
+		labels := ts.labels
+		if len(q.cfg.ExternalLabels) > 0 {
+			labels = append([]rwLabel{}, labels...)
+			// Like in Prometheus, labels of the series take precedence over
+			// external labels of the same name.
+			for k, v := range q.cfg.ExternalLabels {
+				if !hasLabel(ts.labels, k) {
+					labels = append(labels, rwLabel{k, v})
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+		}
+		for _, l := range labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			tsb = protowire.AppendTag(tsb, 1, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, lb)
+		}
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(ts.value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(ts.timestamp))
+		tsb = protowire.AppendTag(tsb, 2, protowire.BytesType)
+		tsb = protowire.AppendBytes(tsb, sb)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, tsb)
+	}
+	return b
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type rwReceived struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// rwReceiver is a minimal stand-in for a remote-write receiver that decodes
+// every pushed WriteRequest.
+type rwReceiver struct {
+	lock   sync.Mutex
+	series []rwReceived
+	reqs   []*http.Request
+	status func() int
+	errc   chan error
+}
+
+// newRWReceiver returns a receiver that fails t at the end of the test if it
+// received a request it could not decode.
+func newRWReceiver(t *testing.T, status func() int) *rwReceiver {
+	rr := &rwReceiver{status: status, errc: make(chan error, 1)}
+	t.Cleanup(func() {
+		select {
+		case err := <-rr.errc:
+			t.Errorf("Receiver: %v", err)
+		default:
+		}
+	})
+	return rr
+}
+
+// fail reports err to the test, which cannot be failed from the goroutine of
+// the handler.
+func (rr *rwReceiver) fail(w http.ResponseWriter, err error) {
+	select {
+	case rr.errc <- err:
+	default:
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func (rr *rwReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rr.fail(w, err)
+		return
+	}
+	if rr.status != nil {
+		if code := rr.status(); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+	}
+	d, err := snappy.Decode(nil, body)
+	if err != nil {
+		rr.fail(w, err)
+		return
+	}
+	series, err := decodeWriteRequest(d)
+	if err != nil {
+		rr.fail(w, err)
+		return
+	}
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	rr.reqs = append(rr.reqs, r)
+	rr.series = append(rr.series, series...)
+}
+
+// protoField is a single field of an encoded protobuf message.
+type protoField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	bytes []byte
+	value uint64
+}
+
+// protoFields splits an encoded protobuf message into its fields.
+func protoFields(b []byte) ([]protoField, error) {
+	var res []protoField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d of field %d", typ, num)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// decodeWriteRequest decodes a prometheus.WriteRequest as defined in
+// prompb/remote.proto and prompb/types.proto, which has one sample per series
+// when pushed by the exporter.
+func decodeWriteRequest(d []byte) ([]rwReceived, error) {
+	fields, err := protoFields(d)
+	if err != nil {
+		return nil, err
+	}
+	var res []rwReceived
+	for _, f := range fields {
+		// WriteRequest.timeseries = 1
+		if f.num != 1 || f.typ != protowire.BytesType {
+			return nil, fmt.Errorf("unexpected WriteRequest field %d", f.num)
+		}
+		ts, err := protoFields(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		rec := rwReceived{labels: make(map[string]string)}
+		samples := 0
+		for _, tf := range ts {
+			if tf.typ != protowire.BytesType {
+				return nil, fmt.Errorf("unexpected wire type %d of TimeSeries field %d", tf.typ, tf.num)
+			}
+			sub, err := protoFields(tf.bytes)
+			if err != nil {
+				return nil, err
+			}
+			switch tf.num {
+			case 1: // TimeSeries.labels
+				var name, value string
+				for _, lf := range sub {
+					switch {
+					case lf.num == 1 && lf.typ == protowire.BytesType:
+						name = string(lf.bytes)
+					case lf.num == 2 && lf.typ == protowire.BytesType:
+						value = string(lf.bytes)
+					default:
+						return nil, fmt.Errorf("unexpected Label field %d", lf.num)
+					}
+				}
+				if _, ok := rec.labels[name]; ok {
+					return nil, fmt.Errorf("duplicate label %q", name)
+				}
+				rec.labels[name] = value
+			case 2: // TimeSeries.samples
+				samples++
+				for _, sf := range sub {
+					switch {
+					case sf.num == 1 && sf.typ == protowire.Fixed64Type:
+						rec.value = math.Float64frombits(sf.value)
+					case sf.num == 2 && sf.typ == protowire.VarintType:
+						rec.timestamp = int64(sf.value)
+					default:
+						return nil, fmt.Errorf("unexpected Sample field %d", sf.num)
+					}
+				}
+			default:
+				return nil, fmt.Errorf("unexpected TimeSeries field %d", tf.num)
+			}
+		}
+		if samples != 1 {
+			return nil, fmt.Errorf("got %d samples in a series, want 1", samples)
+		}
+		res = append(res, rec)
+	}
+	return res, nil
+}
+
+func (rr *rwReceiver) received() []rwReceived {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	return append([]rwReceived{}, rr.series...)
+}
+
+func testServerWith(target string, mr *metricRegistry) *Server {
+	return &Server{clients: map[string]*Client{
+		target: NewClient(&net.TCPAddr{IP: net.ParseIP(target)}, mr),
+	}}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	assert := assert.New(t)
+	rr := newRWReceiver(t, nil)
+	hs := httptest.NewServer(rr)
+	defer hs.Close()
+
+	mr := NewMetricRegistry()
+	ts := time.Date(2024, 7, 7, 19, 59, 10, 0, time.UTC)
+	if err := mr.UpdateAt("/openconfig-platform:components/component[name=FAN-1-33]/fan/state", ts, `{"speed":4500}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+
+	rw := NewRemoteWriter(testServerWith("10.0.0.1", mr), &RemoteWriteConfig{Endpoints: []RemoteWriteEndpoint{{
+		URL:            hs.URL,
+		BearerToken:    "s3cret",
+		Headers:        map[string]string{"X-Scope-OrgID": "optics"},
+		ExternalLabels: map[string]string{"site": "sto1", "target": "ignored"},
+		QueueSize:      100,
+		BatchSize:      10,
+		Timeout:        time.Second,
+	}}}, 10*time.Millisecond)
+
+	assert.Eventually(func() bool { return len(rr.received()) == 1 }, waitFor, tick)
+	assert.Equal(rwReceived{
+		labels: map[string]string{
+			"__name__": "dc908_fan_rpm",
+			"device":   "FAN-1-33",
+			"target":   "10.0.0.1",
+			"site":     "sto1",
+		},
+		value:     4500,
+		timestamp: ts.UnixMilli(),
+	}, rr.received()[0])
+
+	rr.lock.Lock()
+	req := rr.reqs[0]
+	rr.lock.Unlock()
+	assert.Equal("snappy", req.Header.Get("Content-Encoding"))
+	assert.Equal("application/x-protobuf", req.Header.Get("Content-Type"))
+	assert.Equal("Bearer s3cret", req.Header.Get("Authorization"))
+	assert.Equal("optics", req.Header.Get("X-Scope-OrgID"))
+
+	// Samples without a newer device timestamp are not pushed again.
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(rr.received(), 1)
+
+	if err := mr.UpdateAt("/openconfig-platform:components/component[name=FAN-1-33]/fan/state", ts.Add(time.Second), `{"speed":4600}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+	assert.Eventually(func() bool { return len(rr.received()) == 2 }, waitFor, tick)
+	assert.EqualValues(4600, rr.received()[1].value)
+
+	assert.NoError(rw.Close(context.Background()))
+}
+
+func TestRemoteWriteWithoutTimestamp(t *testing.T) {
+	rr := newRWReceiver(t, nil)
+	hs := httptest.NewServer(rr)
+	defer hs.Close()
+
+	mr := NewMetricRegistry()
+	if err := mr.UpdateAt("/openconfig-system:system/alarms/alarm[id=1]/state", time.UnixMicro(0), `{"resource":"FAN-1-33","severity":"MAJOR","type-id":"FAN_FAIL"}`); err != nil {
+		t.Fatalf("UpdateAt: %v", err)
+	}
+	start := time.Now()
+	// A long interval means only the final collection on Close runs.
+	rw := NewRemoteWriter(testServerWith("10.0.0.1", mr), &RemoteWriteConfig{Endpoints: []RemoteWriteEndpoint{{
+		URL:       hs.URL,
+		QueueSize: 100,
+		BatchSize: 10,
+		Timeout:   time.Second,
+	}}}, time.Hour)
+	assert.NoError(t, rw.Close(context.Background()))
+
+	if got := rr.received(); assert.Len(t, got, 1) {
+		assert.Equal(t, "dc908_alarm_active", got[0].labels["__name__"])
+		assert.GreaterOrEqual(t, got[0].timestamp, start.UnixMilli())
+		assert.LessOrEqual(t, got[0].timestamp, time.Now().UnixMilli())
+	}
+}
+
+func TestRemoteWriteRetries(t *testing.T) {
+	var tests = []struct {
+		name     string
+		code     int
+		attempts int32
+		received int
+	}{
+		{"server error is retried", http.StatusInternalServerError, 3, 1},
+		{"rate limit is retried", http.StatusTooManyRequests, 3, 1},
+		{"client error is not retried", http.StatusBadRequest, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			rr := newRWReceiver(t, func() int {
+				if attempts.Add(1) < 3 {
+					return tt.code
+				}
+				return http.StatusOK
+			})
+			hs := httptest.NewServer(rr)
+			defer hs.Close()
+
+			mr := NewMetricRegistry()
+			if err := mr.Update("/openconfig-platform:components/component[name=FAN-1-33]/fan/state", `{"speed":4500}`); err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			// A long interval means only the final collection on Close runs.
+			rw := NewRemoteWriter(testServerWith("10.0.0.1", mr), &RemoteWriteConfig{Endpoints: []RemoteWriteEndpoint{{
+				URL:        hs.URL,
+				QueueSize:  100,
+				BatchSize:  10,
+				MaxRetries: 5,
+				MinBackoff: time.Millisecond,
+				MaxBackoff: 10 * time.Millisecond,
+				Timeout:    time.Second,
+			}}}, time.Hour)
+
+			assert.NoError(t, rw.Close(context.Background()))
+			assert.Equal(t, tt.attempts, attempts.Load())
+			assert.Len(t, rr.received(), tt.received)
+		})
+	}
+}
+
+func TestLoadRemoteWriteConfig(t *testing.T) {
+	assert := assert.New(t)
+	fn := filepath.Join(t.TempDir(), "rw.yaml")
+	err := os.WriteFile(fn, []byte(`
+endpoints:
+  - url: https://prometheus.example.com/api/v1/write
+    basic_auth:
+      username: dc908
+      password: hunter2
+    timeout: 5s
+`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cfg, err := LoadRemoteWriteConfig(fn)
+	if !assert.NoError(err) || !assert.Len(cfg.Endpoints, 1) {
+		return
+	}
+	ep := cfg.Endpoints[0]
+	assert.Equal("dc908", ep.BasicAuth.Username)
+	assert.Equal(5*time.Second, ep.Timeout)
+	assert.Equal(10000, ep.QueueSize)
+	assert.Equal(500, ep.BatchSize)
+
+	if err := os.WriteFile(fn, []byte("endpoints:\n  - headers: {}\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	_, err = LoadRemoteWriteConfig(fn)
+	assert.Error(err)
+}
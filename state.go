@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	stateFile     = flag.String("state-file", "", "path to a file keeping the latest metrics of every device across restarts, disabled if empty")
+	stateInterval = flag.Duration("state-interval", time.Minute, "how often to write the state file")
+	stateMaxAge   = flag.Duration("state-max-age", time.Hour, "how long after a device was last connected its restored metrics are served")
+
+	// deletedElements are the paths whose deletion drops restored series,
+	// with the label the deleted list entries are exported as. Deleting the
+	// whole list drops all series carrying the label.
+	deletedElements = []struct {
+		re    *regexp.Regexp
+		label string
+	}{
+		{regexp.MustCompile(`^/openconfig-platform:components(?:/component\[name=([^,\]]+)\])?$`), "device"},
+		{regexp.MustCompile(`^/openconfig-terminal-device:terminal-device/logical-channels(?:/channel\[index=([^,\]]+)\])?$`), "logical_channel"},
+	}
+)
+
+// savedDevice is the state of a device in the state file.
+type savedDevice struct {
+	Target string `json:"target"`
+	// Saved is when the device was last connected.
+	Saved time.Time `json:"saved"`
+	// Metrics are the metrics of the device in the Prometheus text format.
+	Metrics string `json:"metrics"`
+}
+
+type savedState struct {
+	Devices []savedDevice `json:"devices"`
+}
+
+type restoredDevice struct {
+	saved    time.Time
+	families []*dto.MetricFamily
+}
+
+// StateStore periodically writes the latest metrics of every device to a
+// file and serves the metrics restored from it at startup until live data
+// replaces them, the device deletes them or they expire.
+type StateStore struct {
+	srv      *Server
+	path     string
+	interval time.Duration
+	maxAge   time.Duration
+	now      func() time.Time
+
+	lock     sync.Mutex
+	restored map[string]restoredDevice
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewStateStore restores the state saved in path, if any. A state file that
+// cannot be parsed is ignored, as it is overwritten anyway.
+func NewStateStore(srv *Server, path string, interval, maxAge time.Duration) (*StateStore, error) {
+	st := &StateStore{
+		srv:      srv,
+		path:     path,
+		interval: interval,
+		maxAge:   maxAge,
+		now:      time.Now,
+		restored: make(map[string]restoredDevice),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	d, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state savedState
+	if err := json.Unmarshal(d, &state); err != nil {
+		log.Warningf("Ignoring state file %s: %v", path, err)
+		return st, nil
+	}
+	now := st.now()
+	for _, sd := range state.Devices {
+		if now.Sub(sd.Saved) > maxAge {
+			continue
+		}
+		mfs, err := parseMetricsText(sd.Metrics)
+		if err != nil {
+			log.Warningf("Ignoring saved state of %q: %v", sd.Target, err)
+			continue
+		}
+		// Alarms may have cleared while the exporter was down and must not
+		// be raised again from the state file.
+		mfs = slices.DeleteFunc(mfs, func(mf *dto.MetricFamily) bool {
+			return mf.GetName() == "dc908_alarm_active"
+		})
+		st.restored[normalizeTarget(sd.Target)] = restoredDevice{saved: sd.Saved, families: mfs}
+	}
+	log.Infof("Restored the state of %d devices from %s", len(st.restored), path)
+	return st, nil
+}
+
+// Start writes the state file every interval until the store is closed.
+func (st *StateStore) Start() {
+	go st.run()
+}
+
+func (st *StateStore) run() {
+	defer close(st.done)
+	t := time.NewTicker(st.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-st.stop:
+			return
+		case <-t.C:
+			if err := st.Save(); err != nil {
+				log.Warningf("Failed to write state file: %v", err)
+			}
+		}
+	}
+}
+
+// Close stops writing the state file periodically and writes it a last time.
+// It has to be called while the devices are still connected.
+func (st *StateStore) Close() error {
+	close(st.stop)
+	<-st.done
+	return st.Save()
+}
+
+// restoredFamilies returns the restored metrics of a device unless they
+// expired.
+func (st *StateStore) restoredFamilies(target string) (restoredDevice, bool) {
+	if st == nil {
+		return restoredDevice{}, false
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	rd, ok := st.restored[target]
+	if ok && st.now().Sub(rd.saved) > st.maxAge {
+		delete(st.restored, target)
+		return restoredDevice{}, false
+	}
+	return rd, ok
+}
+
+// Delete drops the restored series of a device that belong to a path the
+// device deleted.
+func (st *StateStore) Delete(target string, path string) {
+	if st == nil {
+		return
+	}
+	for _, de := range deletedElements {
+		match := de.re.FindStringSubmatch(path)
+		if match == nil {
+			continue
+		}
+		st.lock.Lock()
+		if rd, ok := st.restored[target]; ok {
+			rd.families = withoutSeries(rd.families, de.label, match[1])
+			st.restored[target] = rd
+		}
+		st.lock.Unlock()
+	}
+}
+
+// withoutSeries returns mfs without the series whose label name has value,
+// or any non-empty value if value is empty. mfs is left untouched, as
+// restored families may still be gathered.
+func withoutSeries(mfs []*dto.MetricFamily, name, value string) []*dto.MetricFamily {
+	var res []*dto.MetricFamily
+	for _, mf := range mfs {
+		var kept []*dto.Metric
+		for _, m := range mf.GetMetric() {
+			drop := false
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == name && lp.GetValue() != "" && (value == "" || lp.GetValue() == value) {
+					drop = true
+					break
+				}
+			}
+			if !drop {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		if len(kept) < len(mf.GetMetric()) {
+			mf = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: kept}
+		}
+		res = append(res, mf)
+	}
+	return res
+}
+
+// Restored returns the restored metrics of a device that is not connected.
+func (st *StateStore) Restored(target string) (prometheus.Gatherer, bool) {
+	rd, ok := st.restoredFamilies(target)
+	if !ok {
+		return nil, false
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return rd.families, nil
+	}), true
+}
+
+// Merge adds the restored series of a device that live has not received yet
+// to live. It returns the number of restored series added.
+func (st *StateStore) Merge(target string, live prometheus.Gatherer) (prometheus.Gatherer, int) {
+	rd, ok := st.restoredFamilies(target)
+	if !ok {
+		return live, 0
+	}
+	mfs, err := live.Gather()
+	if err != nil {
+		return live, 0
+	}
+	merged, n := mergeFamilies(mfs, rd.families)
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return merged, nil
+	}), n
+}
+
+// metricKey returns a key identifying a series within its metric family.
+func metricKey(m *dto.Metric) string {
+	var b strings.Builder
+	for _, lp := range m.GetLabel() {
+		b.WriteString(lp.GetName())
+		b.WriteByte('=')
+		b.WriteString(lp.GetValue())
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// mergeFamilies returns live with the series of restored that are not in live
+// added, and the number of series added.
+func mergeFamilies(live, restored []*dto.MetricFamily) ([]*dto.MetricFamily, int) {
+	byName := make(map[string]*dto.MetricFamily, len(live))
+	res := make([]*dto.MetricFamily, 0, len(live)+len(restored))
+	for _, mf := range live {
+		byName[mf.GetName()] = mf
+		res = append(res, mf)
+	}
+	n := 0
+	for _, rmf := range restored {
+		mf, ok := byName[rmf.GetName()]
+		if !ok {
+			res = append(res, rmf)
+			n += len(rmf.GetMetric())
+			continue
+		}
+		if mf.GetType() != rmf.GetType() {
+			continue
+		}
+		seen := make(map[string]bool, len(mf.GetMetric()))
+		for _, m := range mf.GetMetric() {
+			seen[metricKey(m)] = true
+		}
+		for _, m := range rmf.GetMetric() {
+			if !seen[metricKey(m)] {
+				mf.Metric = append(mf.Metric, m)
+				n++
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].GetName() < res[j].GetName() })
+	return res, n
+}
+
+// devices returns the state of the connected devices, including restored
+// series they did not send again yet, and of the restored devices that did
+// not reconnect yet.
+func (st *StateStore) devices() []savedDevice {
+	now := st.now()
+	var res []savedDevice
+	live := st.srv.registries()
+	for target, mr := range live {
+		mfs, err := mr.PrometheusRegistry().Gather()
+		if err != nil {
+			log.Warningf("Failed to gather state of %q: %v", target, err)
+			continue
+		}
+		saved := now
+		if rd, ok := st.restoredFamilies(target); ok {
+			var n int
+			// Restored series the device did not send again keep expiring
+			// from when they were saved.
+			if mfs, n = mergeFamilies(mfs, rd.families); n > 0 {
+				saved = rd.saved
+			}
+		}
+		text, err := metricsText(mfs)
+		if err != nil {
+			log.Warningf("Failed to encode state of %q: %v", target, err)
+			continue
+		}
+		res = append(res, savedDevice{Target: target, Saved: saved, Metrics: text})
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for target, rd := range st.restored {
+		if _, ok := live[target]; ok {
+			continue
+		}
+		if now.Sub(rd.saved) > st.maxAge {
+			delete(st.restored, target)
+			continue
+		}
+		text, err := metricsText(rd.families)
+		if err != nil {
+			log.Warningf("Failed to encode state of %q: %v", target, err)
+			continue
+		}
+		res = append(res, savedDevice{Target: target, Saved: rd.saved, Metrics: text})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Target < res[j].Target })
+	return res
+}
+
+// Save writes the state file, replacing it atomically.
+func (st *StateStore) Save() error {
+	d, err := json.Marshal(savedState{Devices: st.devices()})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(st.path), filepath.Base(st.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), st.path)
+}
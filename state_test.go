@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeFamilies(t *testing.T) {
+	live, err := parseMetricsText(`# TYPE dc908_fan_rpm gauge
+dc908_fan_rpm{device="FAN-1"} 4500
+`)
+	if err != nil {
+		t.Fatalf("parseMetricsText: %v", err)
+	}
+	restored, err := parseMetricsText(`# TYPE dc908_fan_rpm gauge
+dc908_fan_rpm{device="FAN-1"} 4000
+dc908_fan_rpm{device="FAN-2"} 3000
+# TYPE dc908_temperature_celsius gauge
+dc908_temperature_celsius{device="CPU"} 40
+# TYPE dc908_fan_rpm_total counter
+dc908_fan_rpm_total 1
+`)
+	if err != nil {
+		t.Fatalf("parseMetricsText: %v", err)
+	}
+	merged, n := mergeFamilies(live, restored)
+	assert.Equal(t, 3, n)
+	text, err := metricsText(merged)
+	if err != nil {
+		t.Fatalf("metricsText: %v", err)
+	}
+	assert.Equal(t, `# TYPE dc908_fan_rpm gauge
+dc908_fan_rpm{device="FAN-1"} 4500
+dc908_fan_rpm{device="FAN-2"} 3000
+# TYPE dc908_fan_rpm_total counter
+dc908_fan_rpm_total 1
+# TYPE dc908_temperature_celsius gauge
+dc908_temperature_celsius{device="CPU"} 40
+`, text)
+}
+
+func writeState(t *testing.T, state savedState) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "state.json")
+	d, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if err := os.WriteFile(fn, d, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return fn
+}
+
+func TestStateStore(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	metrics := `# TYPE dc908_fan_rpm gauge
+dc908_fan_rpm{device="FAN-1-33"} 4000
+# TYPE dc908_temperature_celsius gauge
+dc908_temperature_celsius{device="CPU-1-1"} 40
+`
+	fn := writeState(t, savedState{Devices: []savedDevice{
+		{Target: "127.0.0.1", Saved: now.Add(-time.Minute), Metrics: metrics},
+		{Target: "127.0.0.9", Saved: now.Add(-2 * time.Hour), Metrics: metrics},
+	}})
+
+	srv := startServer(t)
+	st, err := NewStateStore(srv, fn, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewStateStore: %v", err)
+	}
+	srv.state = st
+
+	// Restored devices are served, but not reported as connected.
+	p := probe(srv, "127.0.0.1")
+	assert.Contains(p, "probe_success 0")
+	assert.Contains(p, "probe_restored 1")
+	assert.Contains(p, `dc908_fan_rpm{device="FAN-1-33"} 4000`)
+	p = probe(srv, "127.0.0.9")
+	assert.Contains(p, "probe_restored 0")
+	assert.NotContains(p, "dc908_fan_rpm")
+
+	// Live values replace restored ones, the others stay until sent again.
+	stream, closer := dialFrom(t, srv, "127.0.0.1")
+	defer closer()
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(func() bool { return probeSucceeds(srv, "127.0.0.1") }, waitFor, tick)
+	p = probe(srv, "127.0.0.1")
+	assert.Contains(p, "probe_restored 1")
+	assert.Contains(p, `dc908_fan_rpm{device="FAN-1-33"} 4500`)
+	assert.Contains(p, `dc908_temperature_celsius{device="CPU-1-1"} 40`)
+
+	if err := st.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	reloaded, err := NewStateStore(srv, fn, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewStateStore: %v", err)
+	}
+	if rd, ok := reloaded.restoredFamilies("127.0.0.1"); assert.True(ok) {
+		text, _ := metricsText(rd.families)
+		assert.Contains(text, `dc908_fan_rpm{device="FAN-1-33"} 4500`)
+		assert.Contains(text, `dc908_temperature_celsius{device="CPU-1-1"} 40`)
+		// The restored temperature still expires from when it was saved.
+		assert.WithinDuration(now.Add(-time.Minute), rd.saved, time.Second)
+	}
+	_, ok := reloaded.restoredFamilies("127.0.0.9")
+	assert.False(ok)
+
+	// Expired restored values are dropped.
+	st.now = func() time.Time { return now.Add(2 * time.Hour) }
+	p = probe(srv, "127.0.0.1")
+	assert.Contains(p, "probe_restored 0")
+	assert.Contains(p, `dc908_fan_rpm{device="FAN-1-33"} 4500`)
+	assert.NotContains(p, "dc908_temperature_celsius")
+}
+
+func TestStateStoreDeletedComponent(t *testing.T) {
+	assert := assert.New(t)
+	fn := writeState(t, savedState{Devices: []savedDevice{
+		{Target: "127.0.0.1", Saved: time.Now().Add(-time.Minute), Metrics: `# TYPE dc908_temperature_celsius gauge
+dc908_temperature_celsius{device="CPU-1-1"} 40
+dc908_temperature_celsius{device="PSU-1-22"} 30
+`},
+	}})
+
+	srv := startServer(t)
+	st, err := NewStateStore(srv, fn, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewStateStore: %v", err)
+	}
+	srv.state = st
+
+	stream, closer := dialFrom(t, srv, "127.0.0.1")
+	defer closer()
+	if err := stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: &gnmi.Notification{
+		Timestamp: time.Now().UnixNano(),
+		Delete: []*gnmi.Path{{Elem: []*gnmi.PathElem{
+			{Name: "openconfig-platform:components"},
+			{Name: "component", Key: map[string]string{"name": "CPU-1-1"}},
+		}}},
+	}}}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(func() bool {
+		return !strings.Contains(probe(srv, "127.0.0.1"), `device="CPU-1-1"`)
+	}, waitFor, tick)
+	p := probe(srv, "127.0.0.1")
+	assert.Contains(p, "probe_restored 1")
+	assert.Contains(p, `dc908_temperature_celsius{device="PSU-1-22"} 30`)
+
+	if err := st.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	assert.NotContains(string(d), "CPU-1-1")
+}
+
+func TestStateStoreClearedAlarm(t *testing.T) {
+	assert := assert.New(t)
+	// The alarm cleared while the exporter was down, so the device does not
+	// send it again after reconnecting.
+	fn := writeState(t, savedState{Devices: []savedDevice{
+		{Target: "127.0.0.1", Saved: time.Now().Add(-time.Minute), Metrics: `# TYPE dc908_alarm_active gauge
+dc908_alarm_active{id="1720382355-17",resource="TRANSCEIVER-1-1-C1",severity="MAJOR",type="IN_PWR_LOW"} 1
+# TYPE dc908_temperature_celsius gauge
+dc908_temperature_celsius{device="CPU-1-1"} 40
+`},
+	}})
+
+	srv := startServer(t)
+	st, err := NewStateStore(srv, fn, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewStateStore: %v", err)
+	}
+	srv.state = st
+
+	p := probe(srv, "127.0.0.1")
+	assert.Contains(p, `dc908_temperature_celsius{device="CPU-1-1"} 40`)
+	assert.NotContains(p, "dc908_alarm_active")
+
+	stream, closer := dialFrom(t, srv, "127.0.0.1")
+	defer closer()
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(func() bool {
+		return strings.Contains(probe(srv, "127.0.0.1"), `dc908_fan_rpm{device="FAN-1-33"} 4500`)
+	}, waitFor, tick)
+	assert.NotContains(probe(srv, "127.0.0.1"), "dc908_alarm_active")
+
+	if err := st.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	assert.NotContains(string(d), "dc908_alarm_active")
+}
+
+func TestStateStoreInvalidFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(fn, []byte("{"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	st, err := NewStateStore(startServer(t), fn, time.Hour, time.Hour)
+	if assert.NoError(t, err) {
+		assert.Empty(t, st.restored)
+	}
+
+	st, err = NewStateStore(startServer(t), filepath.Join(t.TempDir(), "missing.json"), time.Hour, time.Hour)
+	if assert.NoError(t, err) {
+		assert.Empty(t, st.restored)
+	}
+}
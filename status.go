@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+var (
+	readyMinDevices = flag.Int("ready-min-devices", 0, "number of connected devices required before /readyz reports ready")
+
+	statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>dc908_exporter status</title></head>
+<body>
+<h1>dc908_exporter</h1>
+<p>gNMI listener: {{.Address}}</p>
+<table border="1" cellpadding="4">
+<tr><th>Target</th><th>Peer</th><th>Connected</th><th>Messages</th><th>Last update</th><th>Parse errors</th></tr>
+{{range .Sessions}}<tr><td><a href="/probe?target={{.Target}}">{{.Target}}</a></td><td>{{.Peer}}</td><td>{{.ConnectTime.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.Messages}}</td><td>{{with .LastUpdate}}{{.Format "2006-01-02T15:04:05Z07:00"}}{{else}}never{{end}}</td><td>{{.ParseErrors}}</td></tr>
+{{else}}<tr><td colspan="6">No gNMI sessions connected</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+)
+
+type sessionStatus struct {
+	Target      string     `json:"target"`
+	Peer        string     `json:"peer"`
+	ConnectTime time.Time  `json:"connect_time"`
+	Messages    int64      `json:"messages"`
+	LastUpdate  *time.Time `json:"last_update,omitempty"`
+	ParseErrors int64      `json:"parse_errors"`
+}
+
+type serverStatus struct {
+	Address  string          `json:"address"`
+	Sessions []sessionStatus `json:"sessions"`
+}
+
+// Sessions returns a snapshot of all currently registered gNMI sessions,
+// sorted by target.
+func (srv *Server) Sessions() []sessionStatus {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	res := make([]sessionStatus, 0, len(srv.clients))
+	for target, c := range srv.clients {
+		res = append(res, c.status(target))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Target < res[j].Target })
+	return res
+}
+
+func (c *Client) status(target string) sessionStatus {
+	ss := sessionStatus{
+		Target:      target,
+		Peer:        c.String(),
+		ConnectTime: c.connected,
+		Messages:    c.messages.Load(),
+		ParseErrors: c.parseErrors.Load(),
+	}
+	if lu := c.lastUpdate.Load(); lu != 0 {
+		t := time.Unix(0, lu)
+		ss.LastUpdate = &t
+	}
+	return ss
+}
+
+// Ready reports whether the server is accepting gNMI sessions and has at
+// least minDevices of them connected.
+func (srv *Server) Ready(minDevices int) error {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	if !srv.serving.Load() {
+		return fmt.Errorf("gNMI listener is not serving")
+	}
+	if srv.draining {
+		return fmt.Errorf("server is shutting down")
+	}
+	if len(srv.clients) < minDevices {
+		return fmt.Errorf("%d of %d required devices connected", len(srv.clients), minDevices)
+	}
+	return nil
+}
+
+func (srv *Server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (srv *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := srv.Ready(*readyMinDevices); err != nil {
+		log.V(1).Infof("Readiness check failed: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (srv *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	st := serverStatus{
+		Address:  strings.Join(srv.Addresses(), ", "),
+		Sessions: srv.Sessions(),
+	}
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			log.Warningf("Failed to encode status: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, st); err != nil {
+		log.Warningf("Failed to render status page: %v", err)
+	}
+}
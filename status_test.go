@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthz(t *testing.T) {
+	srv := startServer(t)
+	rec := httptest.NewRecorder()
+	srv.serveHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestReadyz(t *testing.T) {
+	srv, err := NewServer(&Config{Port: 0}, nil)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	defer srv.Stop()
+
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		srv.serveReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, readyz())
+
+	go srv.Serve()
+	assert.Eventually(t, func() bool { return readyz() == http.StatusOK }, waitFor, tick)
+
+	assert.Error(t, srv.Ready(1))
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	if err := stream.Send(readTestdata(t, "testdata/fan.textpb")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	assert.Eventually(t, func() bool { return srv.Ready(1) == nil }, waitFor, tick)
+
+	srv.GracefulStop(100 * time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, readyz())
+}
+
+func TestStatus(t *testing.T) {
+	assert := assert.New(t)
+	srv := startServer(t)
+
+	stream, _ := dialFrom(t, srv, "127.0.0.1")
+	for _, fn := range []string{"testdata/fan.textpb", "testdata/psu.textpb"} {
+		if err := stream.Send(readTestdata(t, fn)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	assert.Eventually(func() bool {
+		s := srv.Sessions()
+		return len(s) == 1 && s[0].Messages == 2
+	}, waitFor, tick)
+
+	rec := httptest.NewRecorder()
+	srv.serveStatus(rec, httptest.NewRequest(http.MethodGet, "/status?format=json", nil))
+	assert.Equal("application/json", rec.Header().Get("Content-Type"))
+	var st serverStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	assert.Equal(srv.Address(), st.Address)
+	if assert.Len(st.Sessions, 1) {
+		s := st.Sessions[0]
+		assert.Equal("127.0.0.1", s.Target)
+		assert.Contains(s.Peer, "127.0.0.1:")
+		assert.EqualValues(2, s.Messages)
+		assert.EqualValues(0, s.ParseErrors)
+		assert.NotNil(s.LastUpdate)
+		assert.False(s.ConnectTime.After(*s.LastUpdate))
+	}
+
+	rec = httptest.NewRecorder()
+	srv.serveStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Contains(rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(rec.Body.String(), `<a href="/probe?target=127.0.0.1">127.0.0.1</a>`)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	webConfigFile = flag.String("web-config-file", "", "path to a Prometheus exporter-toolkit compatible web configuration file enabling TLS and authentication on the HTTP port")
+)
+
+// WebConfig is the HTTP server configuration, in the format of the Prometheus
+// exporter-toolkit web configuration file extended by bearer tokens.
+type WebConfig struct {
+	TLSConfig  WebTLSConfig      `yaml:"tls_server_config"`
+	HTTPConfig WebHTTPConfig     `yaml:"http_server_config"`
+	Users      map[string]string `yaml:"basic_auth_users"`
+	// BearerTokens maps names to bcrypt hashes of the tokens, which are sent
+	// as <name>:<token>.
+	BearerTokens map[string]string `yaml:"bearer_tokens"`
+
+	// authCache remembers the credentials that passed the expensive bcrypt
+	// check, keyed by their SHA-256, and evicts the least recently used.
+	// authLimiters limit the bcrypt checks of credentials not remembered per
+	// source address, so that clients sending wrong credentials only lock
+	// out themselves. newAuthLimiter overrides the default limit in tests.
+	authLock       sync.Mutex
+	authCache      map[[sha256.Size]byte]*list.Element
+	authLRU        list.List
+	authLimiters   map[string]*rate.Limiter
+	newAuthLimiter func() *rate.Limiter
+}
+
+type WebTLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAs                string   `yaml:"client_ca_file"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+	ClientAllowedSans        []string `yaml:"client_allowed_sans"`
+}
+
+type WebHTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+const (
+	// maxAuthCache bounds the number of remembered credentials.
+	maxAuthCache = 100
+	// authCheckRate is the number of bcrypt checks per second and source
+	// address of credentials not remembered, each taking tens of
+	// milliseconds.
+	authCheckRate = 10
+	// maxAuthLimiters bounds the number of source addresses limited at once.
+	maxAuthLimiters = 1000
+)
+
+// dummyHash is checked instead of the hash of unknown users, so that they
+// take as long to reject as wrong secrets of known ones.
+var dummyHash = sync.OnceValue(func() []byte {
+	h, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return h
+})
+
+// LoadWebConfig reads a web configuration file. Relative paths in it are
+// relative to the directory of the file.
+func LoadWebConfig(fn string) (*WebConfig, error) {
+	d, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &WebConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(d))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %v", fn, err)
+	}
+	dir := filepath.Dir(fn)
+	for _, p := range []*string{&cfg.TLSConfig.CertFile, &cfg.TLSConfig.KeyFile, &cfg.TLSConfig.ClientCAs} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	for name, hashes := range map[string]map[string]string{"basic_auth_users": cfg.Users, "bearer_tokens": cfg.BearerTokens} {
+		for user, h := range hashes {
+			if _, err := bcrypt.Cost([]byte(h)); err != nil {
+				return nil, fmt.Errorf("%s: %s: invalid bcrypt hash: %v", name, user, err)
+			}
+		}
+	}
+	if _, err := cfg.ServerTLSConfig(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var (
+	tlsVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+	tlsCurves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+	tlsClientAuth = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+)
+
+// ServerTLSConfig returns the TLS configuration of the HTTP server, or nil if
+// TLS is not enabled.
+func (cfg *WebConfig) ServerTLSConfig() (*tls.Config, error) {
+	c := &cfg.TLSConfig
+	if c.CertFile == "" && c.KeyFile == "" {
+		if c.ClientCAs != "" || c.ClientAuth != "" {
+			return nil, fmt.Errorf("client authentication requires cert_file and key_file")
+		}
+		return nil, nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("both cert_file and key_file are required for TLS")
+	}
+	// Load the key pair once to fail early, it is read again on every
+	// handshake to pick up renewed certificates.
+	if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return nil, fmt.Errorf("failed to load X509 key pair: %v", err)
+	}
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load X509 key pair: %v", err)
+			}
+			return &cert, nil
+		},
+	}
+	var ok bool
+	if c.MinVersion != "" {
+		if tc.MinVersion, ok = tlsVersions[c.MinVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", c.MinVersion)
+		}
+	}
+	if c.MaxVersion != "" {
+		if tc.MaxVersion, ok = tlsVersions[c.MaxVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", c.MaxVersion)
+		}
+	}
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	for _, name := range c.CurvePreferences {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		tc.CurvePreferences = append(tc.CurvePreferences, id)
+	}
+	if tc.ClientAuth, ok = tlsClientAuth[c.ClientAuth]; !ok {
+		return nil, fmt.Errorf("invalid client_auth_type %q", c.ClientAuth)
+	}
+	if c.ClientCAs != "" {
+		pem, err := os.ReadFile(c.ClientCAs)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.ClientCAs)
+		}
+	}
+	switch tc.ClientAuth {
+	case tls.VerifyClientCertIfGiven, tls.RequireAndVerifyClientCert:
+		if tc.ClientCAs == nil {
+			return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", c.ClientAuth)
+		}
+	}
+	if len(c.ClientAllowedSans) > 0 {
+		if tc.ClientCAs == nil {
+			return nil, fmt.Errorf("client_allowed_sans requires client_ca_file")
+		}
+		tc.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return fmt.Errorf("no verified client certificate")
+			}
+			cert := chains[0][0]
+			sans := append(append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...), uriStrings(cert)...)
+			for _, ip := range cert.IPAddresses {
+				sans = append(sans, ip.String())
+			}
+			for _, want := range c.ClientAllowedSans {
+				for _, san := range sans {
+					if san == want {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("client certificate SAN not allowed")
+		}
+	}
+	return tc, nil
+}
+
+func uriStrings(cert *x509.Certificate) []string {
+	var res []string
+	for _, u := range cert.URIs {
+		res = append(res, u.String())
+	}
+	return res
+}
+
+func cipherSuite(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// authenticated checks secret against the bcrypt hashes of the given kind of
+// credentials, remembering successful checks. source is the address the
+// credentials were sent from.
+func (cfg *WebConfig) authenticated(source string, kind string, hashes map[string]string, user string, secret string) bool {
+	key := sha256.Sum256([]byte(kind + "\x00" + user + "\x00" + secret))
+	cfg.authLock.Lock()
+	if e, ok := cfg.authCache[key]; ok {
+		cfg.authLRU.MoveToFront(e)
+		cfg.authLock.Unlock()
+		return true
+	}
+	limiter := cfg.authLimiter(source)
+	cfg.authLock.Unlock()
+
+	if !limiter.Allow() {
+		log.V(1).Infof("Too many %s authentication attempts from %s, rejecting %q without checking", kind, source, user)
+		return false
+	}
+	h, ok := hashes[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(secret))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(h), []byte(secret)) != nil {
+		return false
+	}
+
+	cfg.authLock.Lock()
+	defer cfg.authLock.Unlock()
+	if cfg.authCache == nil {
+		cfg.authCache = make(map[[sha256.Size]byte]*list.Element)
+	}
+	if _, ok := cfg.authCache[key]; !ok {
+		cfg.authCache[key] = cfg.authLRU.PushFront(key)
+	}
+	for cfg.authLRU.Len() > maxAuthCache {
+		oldest := cfg.authLRU.Back()
+		cfg.authLRU.Remove(oldest)
+		delete(cfg.authCache, oldest.Value.([sha256.Size]byte))
+	}
+	return true
+}
+
+// authLimiter returns the limiter of bcrypt checks for source. Limiters that
+// are full again are the same as new ones, so they are dropped first when
+// there are too many. It must be called with authLock held.
+func (cfg *WebConfig) authLimiter(source string) *rate.Limiter {
+	if l, ok := cfg.authLimiters[source]; ok {
+		return l
+	}
+	if cfg.authLimiters == nil {
+		cfg.authLimiters = make(map[string]*rate.Limiter)
+	}
+	if len(cfg.authLimiters) >= maxAuthLimiters {
+		for s, l := range cfg.authLimiters {
+			if l.Tokens() >= float64(l.Burst()) {
+				delete(cfg.authLimiters, s)
+			}
+		}
+	}
+	for s := range cfg.authLimiters {
+		if len(cfg.authLimiters) < maxAuthLimiters {
+			break
+		}
+		delete(cfg.authLimiters, s)
+	}
+	l := rate.NewLimiter(authCheckRate, authCheckRate)
+	if cfg.newAuthLimiter != nil {
+		l = cfg.newAuthLimiter()
+	}
+	cfg.authLimiters[source] = l
+	return l
+}
+
+// bearerUser returns the name of the bearer token matching token, which is
+// sent as <name>:<token> so that only one hash has to be checked.
+func (cfg *WebConfig) bearerUser(source string, token string) (string, bool) {
+	name, secret, ok := strings.Cut(token, ":")
+	if !ok || !cfg.authenticated(source, "bearer", cfg.BearerTokens, name, secret) {
+		return "", false
+	}
+	return name, true
+}
+
+// Handler wraps h with the configured response headers and authentication.
+func (cfg *WebConfig) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range cfg.HTTPConfig.Headers {
+			w.Header().Set(k, v)
+		}
+		if len(cfg.Users) == 0 && len(cfg.BearerTokens) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		source, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			source = r.RemoteAddr
+		}
+		if user, pass, ok := r.BasicAuth(); ok {
+			if cfg.authenticated(source, "basic", cfg.Users, user, pass) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if _, ok := cfg.bearerUser(source, token); ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		log.V(1).Infof("Unauthorized HTTP request for %s from %s", r.URL.Path, r.RemoteAddr)
+		if len(cfg.Users) > 0 {
+			w.Header().Set("WWW-Authenticate", "Basic")
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// Configure applies the configuration to an HTTP server.
+func (cfg *WebConfig) Configure(srv *http.Server) error {
+	tc, err := cfg.ServerTLSConfig()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = tc
+	if srv.Handler == nil {
+		srv.Handler = http.DefaultServeMux
+	}
+	srv.Handler = cfg.Handler(srv.Handler)
+	if cfg.HTTPConfig.HTTP2 != nil && !*cfg.HTTPConfig.HTTP2 {
+		// A non-nil empty map disables HTTP/2.
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return nil
+}
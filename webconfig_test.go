@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+// writeCert writes a certificate and key for name to dir, signed by parent or
+// self-signed if parent is nil.
+func writeCert(t *testing.T, dir, name string, parent *tls.Certificate, isCA bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+func bcryptHash(t *testing.T, s string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+	return string(h)
+}
+
+// startWebServer serves an OK handler with the web configuration cfg written
+// to dir and returns its URL.
+func startWebServer(t *testing.T, dir, cfg string) string {
+	t.Helper()
+	fn := filepath.Join(dir, "web.yaml")
+	if err := os.WriteFile(fn, []byte(cfg), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	wc, err := LoadWebConfig(fn)
+	if err != nil {
+		t.Fatalf("LoadWebConfig: %v", err)
+	}
+	hs := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}),
+		ErrorLog: stdlog.New(io.Discard, "", 0),
+	}
+	if err := wc.Configure(hs); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { hs.Close() })
+	if hs.TLSConfig != nil {
+		go hs.ServeTLS(lis, "", "")
+		return "https://" + lis.Addr().String()
+	}
+	go hs.Serve(lis)
+	return "http://" + lis.Addr().String()
+}
+
+func TestWebConfigAuth(t *testing.T) {
+	dir := t.TempDir()
+	url := startWebServer(t, dir, `
+http_server_config:
+  headers:
+    X-Frame-Options: deny
+basic_auth_users:
+  prometheus: `+bcryptHash(t, "s3cret")+`
+bearer_tokens:
+  grafana: `+bcryptHash(t, "t0ken")+`
+`)
+
+	var tests = []struct {
+		name string
+		set  func(r *http.Request)
+		want int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("prometheus", "s3cret") }, http.StatusOK},
+		{"bad password", func(r *http.Request) { r.SetBasicAuth("prometheus", "guess") }, http.StatusUnauthorized},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("grafana", "t0ken") }, http.StatusUnauthorized},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer grafana:t0ken") }, http.StatusOK},
+		{"bad token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer grafana:s3cret") }, http.StatusUnauthorized},
+		{"token without name", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") }, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Twice to also cover remembered credentials.
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(http.MethodGet, url+"/probe", nil)
+				tt.set(req)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("Do: %v", err)
+				}
+				resp.Body.Close()
+				assert.Equal(t, tt.want, resp.StatusCode)
+				assert.Equal(t, "deny", resp.Header.Get("X-Frame-Options"))
+			}
+		})
+	}
+}
+
+func TestWebConfigAuthCache(t *testing.T) {
+	assert := assert.New(t)
+	users := map[string]string{"grafana": bcryptHash(t, "t0ken")}
+	for i := 0; i < maxAuthCache+10; i++ {
+		users[fmt.Sprintf("user%d", i)] = bcryptHash(t, "s3cret")
+	}
+	cfg := &WebConfig{newAuthLimiter: func() *rate.Limiter { return rate.NewLimiter(rate.Inf, 0) }}
+	for i := 0; i < maxAuthCache+10; i++ {
+		// grafana stays in use, so it is never evicted.
+		assert.True(cfg.authenticated("10.0.0.1", "basic", users, "grafana", "t0ken"))
+		assert.True(cfg.authenticated("10.0.0.1", "basic", users, fmt.Sprintf("user%d", i), "s3cret"))
+	}
+	assert.Len(cfg.authCache, maxAuthCache)
+	assert.Equal(maxAuthCache, cfg.authLRU.Len())
+
+	// Without any bcrypt checks left, only remembered credentials pass.
+	cfg.authLimiters = nil
+	cfg.newAuthLimiter = func() *rate.Limiter { return rate.NewLimiter(0, 0) }
+	assert.True(cfg.authenticated("10.0.0.1", "basic", users, "grafana", "t0ken"))
+	assert.True(cfg.authenticated("10.0.0.1", "basic", users, fmt.Sprintf("user%d", maxAuthCache+9), "s3cret"))
+	assert.False(cfg.authenticated("10.0.0.1", "basic", users, "user0", "s3cret"))
+}
+
+func TestWebConfigAuthLimitPerSource(t *testing.T) {
+	assert := assert.New(t)
+	users := map[string]string{"grafana": bcryptHash(t, "t0ken")}
+	cfg := &WebConfig{newAuthLimiter: func() *rate.Limiter { return rate.NewLimiter(0, 1) }}
+
+	// Unknown users use up checks like wrong secrets do.
+	assert.False(cfg.authenticated("10.0.0.1", "basic", users, "nobody", "guess"))
+	assert.False(cfg.authenticated("10.0.0.1", "basic", users, "grafana", "t0ken"))
+	// Other sources are not locked out.
+	assert.True(cfg.authenticated("10.0.0.2", "basic", users, "grafana", "t0ken"))
+
+	cfg.authLock.Lock()
+	for i := 0; i < maxAuthLimiters+10; i++ {
+		cfg.authLimiter(fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+	}
+	cfg.authLock.Unlock()
+	assert.Len(cfg.authLimiters, maxAuthLimiters)
+}
+
+func TestWebConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil, true)
+	writeCert(t, dir, "server", &ca, false)
+	client := writeCert(t, dir, "client", &ca, false)
+	other := writeCert(t, dir, "other", &ca, false)
+	url := startWebServer(t, dir, `
+tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+  client_allowed_sans: [client]
+  min_version: TLS12
+`)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(certs []tls.Certificate) error {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := c.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	assert.NoError(t, get([]tls.Certificate{client}))
+	assert.Error(t, get(nil))
+	assert.Error(t, get([]tls.Certificate{other}))
+}
+
+func TestLoadWebConfigErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{"unknown field", "tls_config: {}", "field tls_config not found"},
+		{"missing key", "tls_server_config: {cert_file: x.crt}", "both cert_file and key_file"},
+		{"missing cert", "tls_server_config: {cert_file: x.crt, key_file: x.key}", "failed to load X509 key pair"},
+		{"client auth without TLS", "tls_server_config: {client_ca_file: ca.crt}", "requires cert_file and key_file"},
+		{"plain password", "basic_auth_users: {prometheus: s3cret}", "invalid bcrypt hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "web.yaml")
+			if err := os.WriteFile(fn, []byte(tt.cfg), 0600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			_, err := LoadWebConfig(fn)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}